@@ -59,7 +59,7 @@ func main() {
 
 type Config struct {
 	Server           *ServerConfig         `json:"server"`
-	AuthServerConfig *server.Configuration `json:"server"`
+	AuthServerConfig *server.Configuration `json:"authserver"`
 }
 
 type ServerConfig struct {
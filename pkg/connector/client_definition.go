@@ -5,5 +5,15 @@ import (
 )
 
 type Client interface {
+	// AuthenticateRequest adds the Authorization bearer information to the given query
 	AuthenticateRequest(request *http.Request) error
 }
+
+// LogoutClient is a Client that can also revoke its authentication, as the clients returned by this package. It
+// does not extend Client itself, so that the clients implemented before are still Clients.
+type LogoutClient interface {
+	Client
+	// Logout revokes the authentication of the client on the SSO server. The client can not be used afterwards.
+	// If the connector of the client is not a RevokingConnector, ErrRevocationNotSupported is returned.
+	Logout() error
+}
@@ -3,6 +3,7 @@ package connector
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/twuillemin/easy-sso-common/pkg/common"
@@ -12,15 +13,31 @@ type clientImpl struct {
 	connector      Connector
 	authentication common.AuthenticationResponse
 	expireAt       int64
+	// The connector, if the client is authenticated as the client of the connector (without refresh token)
+	serviceConnector ClientCredentialsConnector
+	// Serializes the uses of the authentication, so that a refresh token is only sent once
+	mutex sync.Mutex
 }
 
-// AuthenticateRequest adds the Authorization bearer information to the given query.
-func (client clientImpl) AuthenticateRequest(request *http.Request) error {
+// AuthenticateRequest adds the Authorization bearer information to the given query. As the refresh tokens
+// can only be used once, the client keeps the new refresh token received with each refreshed token. The
+// concurrent queries wait for the refresh in progress, as sending the same refresh token twice would make the
+// server revoke the authentication.
+func (client *clientImpl) AuthenticateRequest(request *http.Request) error {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
 
 	// If the token is expired (with a 5 seconds margin)
-	if client.expireAt > (time.Now().Unix() - 5) {
+	if time.Now().Unix() > (client.expireAt - 5) {
 		// Request a new token
-		authentication, err := client.connector.RequestRefresh(client.authentication.RefreshToken)
+		var authentication *common.AuthenticationResponse
+		var err error
+		if client.serviceConnector != nil {
+			authentication, err = client.serviceConnector.RequestClientToken()
+		} else {
+			authentication, err = client.connector.RequestRefresh(client.authentication.RefreshToken)
+		}
 		if err != nil {
 			return err
 		}
@@ -37,3 +54,28 @@ func (client clientImpl) AuthenticateRequest(request *http.Request) error {
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.authentication.AccessToken))
 	return nil
 }
+
+// Logout revokes the authentication of the client on the SSO server. Both the refresh token (and so all the
+// refresh tokens obtained from the same authentication) and the current access token are revoked. The connector
+// must be a RevokingConnector.
+func (client *clientImpl) Logout() error {
+
+	revokingConnector, ok := client.connector.(RevokingConnector)
+	if !ok {
+		return ErrRevocationNotSupported
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	// A service client only has an access token
+	if client.serviceConnector != nil {
+		return revokingConnector.Revoke(client.authentication.AccessToken)
+	}
+
+	if err := revokingConnector.Revoke(client.authentication.RefreshToken); err != nil {
+		return err
+	}
+
+	return revokingConnector.Revoke(client.authentication.AccessToken)
+}
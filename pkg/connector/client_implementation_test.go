@@ -0,0 +1,183 @@
+package connector
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+// rotatingConnector is a Connector giving a new refresh token with each refresh, and refusing the refresh tokens
+// already used as the SSO server does
+type rotatingConnector struct {
+	Connector
+	mutex           sync.Mutex
+	refreshToken    string
+	refreshes       int
+	reusedRefreshes int
+}
+
+func (connector *rotatingConnector) RequestRefresh(refreshToken string) (*common.AuthenticationResponse, error) {
+
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+
+	if refreshToken != connector.refreshToken {
+		connector.reusedRefreshes++
+		return nil, errors.New("the refresh token given was already used")
+	}
+
+	connector.refreshes++
+	connector.refreshToken = "refresh-" + strconv.Itoa(connector.refreshes)
+
+	return &common.AuthenticationResponse{
+		TokenType:    "bearer",
+		AccessToken:  newTestAccessToken(time.Now().Unix() + 300),
+		RefreshToken: connector.refreshToken,
+	}, nil
+}
+
+// newTestAccessToken returns an access token expiring at the given time. The signature is not verified by the
+// client.
+func newTestAccessToken(expiresAt int64) string {
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &common.CustomClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expiresAt,
+		},
+	})
+	tokenString, _ := token.SignedString([]byte("test"))
+	return tokenString
+}
+
+func TestAuthenticateRequestRefreshesOnceWhenUsedConcurrently(t *testing.T) {
+
+	connector := &rotatingConnector{refreshToken: "refresh-0"}
+	client := &clientImpl{
+		connector: connector,
+		authentication: common.AuthenticationResponse{
+			AccessToken:  newTestAccessToken(time.Now().Unix() - 1),
+			RefreshToken: "refresh-0",
+		},
+	}
+
+	var wait sync.WaitGroup
+	for index := 0; index < 20; index++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+			if err := client.AuthenticateRequest(request); err != nil {
+				t.Error("Unable to authenticate the request: ", err)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if connector.refreshes != 1 {
+		t.Error("The token was refreshed ", connector.refreshes, " times instead of once")
+	}
+	if connector.reusedRefreshes != 0 {
+		t.Error("A refresh token was sent ", connector.reusedRefreshes, " times again")
+	}
+}
+
+// revokingConnector is a RevokingConnector keeping the tokens revoked
+type revokingConnector struct {
+	Connector
+	revokedTokens []string
+}
+
+func (connector *revokingConnector) Revoke(token string) error {
+
+	connector.revokedTokens = append(connector.revokedTokens, token)
+	return nil
+}
+
+func TestLogoutRevokesTheTokensOfTheClient(t *testing.T) {
+
+	// The connector of the package can revoke the tokens
+	var _ RevokingConnector = connectorImpl{}
+
+	connector := &revokingConnector{}
+	var client Client = &clientImpl{
+		connector:      connector,
+		authentication: common.AuthenticationResponse{AccessToken: "access", RefreshToken: "refresh"},
+	}
+
+	logoutClient, ok := client.(LogoutClient)
+	if !ok {
+		t.Fatal("The client can not log out")
+	}
+	if err := logoutClient.Logout(); err != nil {
+		t.Fatal("Unable to log out: ", err)
+	}
+	if (len(connector.revokedTokens) != 2) || (connector.revokedTokens[0] != "refresh") || (connector.revokedTokens[1] != "access") {
+		t.Error("The tokens revoked are ", connector.revokedTokens)
+	}
+}
+
+func TestLogoutWithAConnectorNotRevoking(t *testing.T) {
+
+	client := &clientImpl{
+		connector:      &rotatingConnector{},
+		authentication: common.AuthenticationResponse{AccessToken: "access", RefreshToken: "refresh"},
+	}
+
+	if err := client.Logout(); err != ErrRevocationNotSupported {
+		t.Error("The logout with a connector that can not revoke returned ", err)
+	}
+}
+
+// clientCredentialsConnector is a ClientCredentialsConnector giving a new token for the client at each request
+type clientCredentialsConnector struct {
+	Connector
+	requests int
+}
+
+func (connector *clientCredentialsConnector) RequestClientToken() (*common.AuthenticationResponse, error) {
+
+	connector.requests++
+	return &common.AuthenticationResponse{
+		TokenType:   "bearer",
+		AccessToken: newTestAccessToken(time.Now().Unix() + 300),
+	}, nil
+}
+
+func TestServiceClientRequestsANewTokenWhenExpired(t *testing.T) {
+
+	// The connector of the package can authenticate as the client
+	var _ ClientCredentialsConnector = connectorImpl{}
+
+	connector := &clientCredentialsConnector{}
+	client, err := NewServiceClient(connector)
+	if err != nil {
+		t.Fatal("Unable to build the service client: ", err)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if err := client.AuthenticateRequest(request); err != nil || connector.requests != 1 {
+		t.Fatal("The token of the client was requested again before its expiration: ", connector.requests, err)
+	}
+
+	client.(*clientImpl).expireAt = time.Now().Unix() - 1
+	if err := client.AuthenticateRequest(request); err != nil || connector.requests != 2 {
+		t.Fatal("No new token was requested for the client at the expiration: ", connector.requests, err)
+	}
+	if request.Header.Get("Authorization") != "Bearer "+client.(*clientImpl).authentication.AccessToken {
+		t.Error("The request is not authenticated with the new token")
+	}
+}
+
+func TestConnectorImplementsTheTokenExchange(t *testing.T) {
+
+	var connector Connector = connectorImpl{}
+	if _, ok := connector.(TokenExchangeConnector); !ok {
+		t.Error("The connector can not exchange the tokens")
+	}
+}
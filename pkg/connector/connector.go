@@ -37,6 +37,35 @@ func NewClient(connector Connector, userName string, password string) (Client, e
 	}, nil
 }
 
+// NewServiceClient allocates a new SsoClient authenticated as the client of the connector itself, with the
+// client id and password of its configuration. This is intended for the services that do not act on behalf of
+// a user. As no refresh token is given, a new token is requested when the current one expires.
+func NewServiceClient(connector ClientCredentialsConnector) (Client, error) {
+
+	if connector == nil {
+		log.Error("No connector was given for the client to connect")
+		return nil, fmt.Errorf("no connector was given for the client to connect")
+	}
+
+	// Use the connector to connect
+	authentication, err := connector.RequestClientToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expireAt, err := getExpirationFromToken(authentication.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientImpl{
+		connector:        connector,
+		authentication:   *authentication,
+		expireAt:         expireAt,
+		serviceConnector: connector,
+	}, nil
+}
+
 // NewConnector allocates a new SsoClient with the given configuration
 func NewConnector(configuration *AuthConnectorConfig) (Connector, error) {
 
@@ -1,14 +1,45 @@
 package connector
 
 import (
+	"errors"
+
 	"github.com/twuillemin/easy-sso-common/pkg/common"
 )
 
+// ErrRevocationNotSupported is returned by Logout when the connector of the client is not a RevokingConnector
+var ErrRevocationNotSupported = errors.New("the connector can not revoke the tokens")
+
 // Connector is a generic interface for connecting to the SSO server. Currently only the HTTP
-// connector is implemented
+// connector is implemented. The features added later are given by the interfaces extending Connector, so that
+// the connectors implemented before are still Connectors. The HTTP connector implements all of them.
 type Connector interface {
 	// RequestToken requests a new Token from the SSO server
 	RequestToken(userName string, password string) (*common.AuthenticationResponse, error)
 	// RequestRefresh requests a refreshed Token from the SSO server
 	RequestRefresh(refreshToken string) (*common.AuthenticationResponse, error)
 }
+
+// ClientCredentialsConnector is a Connector that can also authenticate as the client itself
+type ClientCredentialsConnector interface {
+	Connector
+	// RequestClientToken requests a new Token for the client itself from the SSO server, with the client id and
+	// password of the configuration (client credentials grant). No refresh token is given with the Token.
+	RequestClientToken() (*common.AuthenticationResponse, error)
+}
+
+// TokenExchangeConnector is a Connector that can also exchange the tokens of the users
+type TokenExchangeConnector interface {
+	Connector
+	// ExchangeToken exchanges the access token of a user, received by the service, for a new token restricted to
+	// the given audiences (token exchange), so that the service can call other services on behalf of the user. The
+	// scopes, separated by spaces, can be empty for keeping the ones of the subject token. The client id and
+	// password of the configuration are used for authenticating. No refresh token is given with the Token.
+	ExchangeToken(subjectToken string, audiences []string, scope string) (*common.AuthenticationResponse, error)
+}
+
+// RevokingConnector is a Connector that can also revoke the tokens
+type RevokingConnector interface {
+	Connector
+	// Revoke asks the SSO server to invalidate the given token, that can be a refresh token or an access token
+	Revoke(token string) error
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
 )
 
 type connectorImpl struct {
@@ -70,6 +74,134 @@ func (client connectorImpl) RequestToken(userName string, password string) (*com
 	return &response, nil
 }
 
+// RequestClientToken requests a new Token for the client itself from the SSO server, with the client id and
+// password of the configuration (client credentials grant). No refresh token is given with the Token.
+func (client connectorImpl) RequestClientToken() (*common.AuthenticationResponse, error) {
+
+	if len(client.serverClientId) == 0 {
+		return nil, common.ErrBadParameters
+	}
+
+	// Prepare the content of the query
+	formRequest := url.Values{
+		"grant_type": {protocol.GrantTypeClientCredentials},
+	}
+
+	// Prepare the base query
+	requestGetToken, err := http.NewRequest(
+		"POST",
+		client.serverBaseURL+"/token",
+		strings.NewReader(formRequest.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the authentication of the client
+	requestGetToken.SetBasicAuth(client.serverClientId, client.serverClientPassword)
+
+	// Add the ContentType
+	requestGetToken.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	// Make the query
+	responseGetToken, err := client.httpClient.Do(requestGetToken)
+	if err != nil {
+		return nil, err
+	}
+	defer responseGetToken.Body.Close()
+
+	switch responseGetToken.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, common.ErrUnauthorized
+	default:
+		return nil, fmt.Errorf("the server answered the client token request with the status %d", responseGetToken.StatusCode)
+	}
+
+	// Get the body of the query
+	rawToken := getBody(responseGetToken)
+	if rawToken == nil {
+		return nil, common.ErrEmptyResponseFromServer
+	}
+
+	var response common.AuthenticationResponse
+	if err := json.Unmarshal(rawToken.Bytes(), &response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// ExchangeToken exchanges the access token of a user, received by the service, for a new token restricted to the
+// given audiences (token exchange), so that the service can call other services on behalf of the user. The
+// scopes, separated by spaces, can be empty for keeping the ones of the subject token. The client id and password
+// of the configuration are used for authenticating. No refresh token is given with the Token.
+func (client connectorImpl) ExchangeToken(subjectToken string, audiences []string, scope string) (*common.AuthenticationResponse, error) {
+
+	if len(client.serverClientId) == 0 || len(subjectToken) == 0 || len(audiences) == 0 {
+		return nil, common.ErrBadParameters
+	}
+
+	// Prepare the content of the query
+	formRequest := url.Values{
+		"grant_type":           {protocol.GrantTypeTokenExchange},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {protocol.TokenTypeAccessToken},
+		"requested_token_type": {protocol.TokenTypeAccessToken},
+		"audience":             audiences,
+	}
+	if len(scope) > 0 {
+		formRequest.Set("scope", scope)
+	}
+
+	// Prepare the base query
+	requestExchange, err := http.NewRequest(
+		"POST",
+		client.serverBaseURL+"/token",
+		strings.NewReader(formRequest.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the authentication of the client
+	requestExchange.SetBasicAuth(client.serverClientId, client.serverClientPassword)
+
+	// Add the ContentType
+	requestExchange.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	// Make the query
+	responseExchange, err := client.httpClient.Do(requestExchange)
+	if err != nil {
+		return nil, err
+	}
+	defer responseExchange.Body.Close()
+
+	switch responseExchange.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, common.ErrUnauthorized
+	default:
+		// Give the error returned by the server, for example when the subject token is expired
+		var oauthError protocol.OAuthError
+		if body := getBody(responseExchange); body != nil && json.Unmarshal(body.Bytes(), &oauthError) == nil && len(oauthError.Error) > 0 {
+			return nil, fmt.Errorf("the server answered the token exchange with the status %d and the error %s", responseExchange.StatusCode, oauthError.Error)
+		}
+		return nil, fmt.Errorf("the server answered the token exchange with the status %d", responseExchange.StatusCode)
+	}
+
+	// Get the body of the query
+	rawToken := getBody(responseExchange)
+	if rawToken == nil {
+		return nil, common.ErrEmptyResponseFromServer
+	}
+
+	var response common.AuthenticationResponse
+	if err := json.Unmarshal(rawToken.Bytes(), &response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
 // RequestRefresh requests a refreshed Token from the SSO server
 func (client connectorImpl) RequestRefresh(refreshToken string) (*common.AuthenticationResponse, error) {
 
@@ -120,6 +252,52 @@ func (client connectorImpl) RequestRefresh(refreshToken string) (*common.Authent
 	return &response, nil
 }
 
+// Revoke asks the SSO server to invalidate the given token, that can be a refresh token or an access token
+func (client connectorImpl) Revoke(token string) error {
+
+	// Prepare the content of the query
+	jsonRequest, err := json.Marshal(
+		protocol.TokenRevocationBody{
+			Token: token,
+		})
+	if err != nil {
+		return err
+	}
+
+	// Prepare the base query
+	requestRevoke, err := http.NewRequest(
+		"POST",
+		client.serverBaseURL+"/revoke",
+		bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return err
+	}
+
+	// Add the authentication to the server
+	if len(client.serverClientId) > 0 {
+		requestRevoke.SetBasicAuth(client.serverClientId, client.serverClientPassword)
+	}
+
+	// Add the ContentType
+	requestRevoke.Header.Add("Content-Type", "application/json")
+
+	// Make the query
+	responseRevoke, err := client.httpClient.Do(requestRevoke)
+	if err != nil {
+		return err
+	}
+	defer responseRevoke.Body.Close()
+
+	switch responseRevoke.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return common.ErrUnauthorized
+	default:
+		return fmt.Errorf("the server answered the revocation with the status %d", responseRevoke.StatusCode)
+	}
+}
+
 // Define a non redirecting policy. Useful when doing queries that are redirecting as go
 // is automatically following the redirect
 func noRedirectPolicy(_ *http.Request, _ []*http.Request) error {
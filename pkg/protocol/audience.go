@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"encoding/json"
+)
+
+// Audience holds the audiences of a token (claim aud). As allowed by the RFC 7519, a single audience is given as
+// a string and several audiences as an array of strings.
+type Audience []string
+
+// MarshalJSON writes the audience as a string if there is a single audience, as an array otherwise
+func (audience Audience) MarshalJSON() ([]byte, error) {
+
+	if len(audience) == 1 {
+		return json.Marshal(audience[0])
+	}
+
+	return json.Marshal([]string(audience))
+}
+
+// UnmarshalJSON reads an audience given either as a string or as an array of strings
+func (audience *Audience) UnmarshalJSON(data []byte) error {
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = Audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+
+	*audience = Audience(multiple)
+	return nil
+}
+
+// Contains returns true if the given audience is one of the audiences
+func (audience Audience) Contains(value string) bool {
+
+	for _, item := range audience {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
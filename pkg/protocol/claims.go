@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"encoding/json"
+)
+
+// ReservedClaimNames are the names of the claims defined by TokenClaims, that can not be given as additional
+// claims
+var ReservedClaimNames = []string{
+	"iss", "sub", "aud", "exp", "nbf", "iat", "jti",
+	"user", "roles", "azp", "client_id", "scope", "act",
+}
+
+// tokenClaimsFields has the fields of TokenClaims, without its methods, so that they can be encoded normally
+type tokenClaimsFields TokenClaims
+
+// MarshalJSON writes the claims, adding the additional claims to the standard ones
+func (claims TokenClaims) MarshalJSON() ([]byte, error) {
+
+	data, err := json.Marshal(tokenClaimsFields(claims))
+	if err != nil || len(claims.Extra) == 0 {
+		return data, err
+	}
+
+	allClaims := make(map[string]interface{})
+	if err := json.Unmarshal(data, &allClaims); err != nil {
+		return nil, err
+	}
+	for name, value := range claims.Extra {
+		if !isReservedClaimName(name) {
+			allClaims[name] = value
+		}
+	}
+
+	return json.Marshal(allClaims)
+}
+
+// UnmarshalJSON reads the claims, keeping the claims that are not defined by TokenClaims as additional claims
+func (claims *TokenClaims) UnmarshalJSON(data []byte) error {
+
+	var fields tokenClaimsFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	allClaims := make(map[string]interface{})
+	if err := json.Unmarshal(data, &allClaims); err != nil {
+		return err
+	}
+	for name, value := range allClaims {
+		if !isReservedClaimName(name) {
+			if fields.Extra == nil {
+				fields.Extra = make(map[string]interface{})
+			}
+			fields.Extra[name] = value
+		}
+	}
+
+	*claims = TokenClaims(fields)
+	return nil
+}
+
+// isReservedClaimName returns true if the given name is one of ReservedClaimNames
+func isReservedClaimName(name string) bool {
+
+	for _, reservedName := range ReservedClaimNames {
+		if reservedName == name {
+			return true
+		}
+	}
+
+	return false
+}
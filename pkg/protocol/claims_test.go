@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+func TestExtraClaimsDoNotOverwriteTheReservedClaims(t *testing.T) {
+
+	claims := TokenClaims{
+		CustomClaims: common.CustomClaims{User: "alice", Roles: []string{"user"}},
+		Scope:        "read",
+		Extra: map[string]interface{}{
+			"email": "alice@example.com",
+			"user":  "mallory",
+			"roles": []string{"admin"},
+			"scope": "write",
+			"sub":   "mallory",
+		},
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal("Unable to write the claims: ", err)
+	}
+
+	written := make(map[string]interface{})
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal("Unable to read the written claims: ", err)
+	}
+	if (written["user"] != "alice") || (written["scope"] != "read") || (written["email"] != "alice@example.com") {
+		t.Error("The extra claims replaced the reserved claims: ", string(data))
+	}
+	if _, ok := written["sub"]; ok {
+		t.Error("The extra claims added a reserved claim: ", string(data))
+	}
+
+	var read TokenClaims
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal("Unable to read the claims: ", err)
+	}
+	if (read.User != "alice") || (len(read.Extra) != 1) || (read.Extra["email"] != "alice@example.com") {
+		t.Errorf("The claims were not read back: %+v", read)
+	}
+}
@@ -0,0 +1,257 @@
+// Package protocol holds the structures exchanged between the SSO server and its clients that are not (yet)
+// defined in the easy-sso-common project.
+package protocol
+
+import (
+	"time"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+// TokenClaims holds the claims of the tokens issued by the server. The claims of the easy-sso-common project are
+// extended with the id of the client that obtained the token, given both as azp (OpenID Connect) and client_id
+// (RFC 8693), with the scopes granted, separated by spaces (RFC 8693), and with the actor for the tokens obtained
+// by a token exchange (RFC 8693). The audience replaces the one of the standard claims, that can not hold several
+// audiences.
+type TokenClaims struct {
+	common.CustomClaims
+	Audience        Audience `json:"aud,omitempty"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	ClientId        string   `json:"client_id,omitempty"`
+	Scope           string   `json:"scope,omitempty"`
+	Actor           *Actor   `json:"act,omitempty"`
+	// The additional claims, such as the ones mapped from the attributes of the user. They can not replace the
+	// claims above (see ReservedClaimNames).
+	Extra map[string]interface{} `json:"-"`
+}
+
+// Actor identifies the client acting on behalf of the subject of a token obtained by a token exchange (RFC 8693,
+// section 4.1). When the token was itself obtained by exchanging a token with an actor, the previous actor is
+// nested.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// TokenRequestBody holds the information expected from the body of the Token query. The body defined by the
+// easy-sso-common project is extended with the audiences and the scopes (separated by spaces) requested for the
+// token.
+type TokenRequestBody struct {
+	common.TokenRequestBody
+	Audiences []string `json:"audiences,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+}
+
+// TokenRefreshBody holds the information expected from the body of the RefreshToken query. The body defined by
+// the easy-sso-common project is extended with the scopes (separated by spaces) requested for the new token, that
+// must have been granted with the refresh token. If not given, the same scopes are granted.
+type TokenRefreshBody struct {
+	common.TokenRefreshBody
+	Scope string `json:"scope,omitempty"`
+}
+
+// AuthenticationResponse defines the data returned when an Authentication/Refresh query is executed successfully.
+// The response defined by the easy-sso-common project is extended with the scopes granted, separated by spaces,
+// and with the type of the token issued by a token exchange (RFC 8693).
+type AuthenticationResponse struct {
+	common.AuthenticationResponse
+	Scope           string `json:"scope,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// TokenRevocationBody holds the information expected from the body of the RevokeToken query. Either the token
+// (a refresh token or an access token) or the id of an access token must be given.
+type TokenRevocationBody struct {
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"tokenTypeHint"`
+	AccessTokenId string `json:"accessTokenId"`
+}
+
+// Values of TokenTypeHint
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// TokenIntrospectionBody holds the information expected from the body of the IntrospectToken query
+type TokenIntrospectionBody struct {
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"tokenTypeHint"`
+}
+
+// IntrospectionResponse defines the data returned by the IntrospectToken query. As defined by the RFC 7662,
+// only the attribute active is given if the token is not active.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	UserName  string   `json:"username,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	TokenId   string   `json:"jti,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Actor     *Actor   `json:"act,omitempty"`
+}
+
+// Session defines a session returned by the administration of the sessions. A session starts with the
+// authentication of a user and lasts as long as its refresh tokens are used.
+type Session struct {
+	SessionId     string `json:"sessionId"`
+	UserName      string `json:"userName"`
+	ClientId      string `json:"clientId,omitempty"`
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	CreatedAt     int64  `json:"createdAt"`
+	LastRefreshAt int64  `json:"lastRefreshAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+}
+
+// SessionRevocationBody holds the information expected from the body of the RevokeSessions query. Either the id
+// of a session or the name of a user (for revoking all its sessions) must be given.
+type SessionRevocationBody struct {
+	SessionId string `json:"sessionId"`
+	UserName  string `json:"userName"`
+}
+
+// SessionRevocationResponse defines the data returned by the RevokeSessions query
+type SessionRevocationResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// Lockout defines a user or an address that can not authenticate anymore until the end of its lock, because of
+// too many failed authentications
+type Lockout struct {
+	UserName      string `json:"userName,omitempty"`
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	LockedUntil   int64  `json:"lockedUntil"`
+}
+
+// UnlockBody holds the information expected from the body of the Unlock query. The user, the address or both
+// can be given.
+type UnlockBody struct {
+	UserName      string `json:"userName"`
+	RemoteAddress string `json:"remoteAddress"`
+}
+
+// UnlockResponse defines the data returned by the Unlock query
+type UnlockResponse struct {
+	Unlocked int `json:"unlocked"`
+}
+
+// AuditEvent defines a single entry of the audit log, as written to the file and syslog sinks and posted to the
+// webhook sink. The outcome is either "success" or "failure", the reason giving the cause of a failure.
+type AuditEvent struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Outcome       string    `json:"outcome"`
+	Reason        string    `json:"reason,omitempty"`
+	UserName      string    `json:"userName,omitempty"`
+	ClientId      string    `json:"clientId,omitempty"`
+	Provider      string    `json:"provider,omitempty"`
+	RemoteAddress string    `json:"remoteAddress,omitempty"`
+	GrantType     string    `json:"grantType,omitempty"`
+	SessionId     string    `json:"sessionId,omitempty"`
+	// The address unlocked by an unlock event
+	TargetAddress string `json:"targetAddress,omitempty"`
+}
+
+// Values of Event of AuditEvent
+const (
+	AuditEventToken         = "token"
+	AuditEventAuthorization = "authorization"
+	AuditEventRefresh       = "refresh"
+	AuditEventRevocation    = "revocation"
+	AuditEventReload        = "reload"
+	AuditEventSessions      = "sessions"
+	AuditEventUnlock        = "unlock"
+)
+
+// Values of Outcome of AuditEvent
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// ReadinessResponse defines the data returned by the Readiness query. The status is "ok" only if all the checks
+// are ok.
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks []*ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck defines the result of a single check of the Readiness query: a provider or the signing key. As
+// the query is not authenticated, the details of the failures are only logged by the server.
+type ReadinessCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// Values of Status of ReadinessResponse and ReadinessCheck
+const (
+	ReadinessStatusOk     = "ok"
+	ReadinessStatusFailed = "failed"
+)
+
+// JsonWebKey holds the public part of a key used for signing the tokens, as defined by the RFC 7517
+type JsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyId     string `json:"kid,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JsonWebKeySet defines the data returned by the query of the public keys of the server
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+// OpenIDConfiguration defines the data returned by the query of the OpenID Connect discovery document. The
+// endpoint refresh_endpoint is specific to EasySSO.
+type OpenIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	RefreshEndpoint                  string   `json:"refresh_endpoint"`
+	RevocationEndpoint               string   `json:"revocation_endpoint"`
+	JwksURI                          string   `json:"jwks_uri"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported"`
+	ScopesSupported                  []string `json:"scopes_supported,omitempty"`
+}
+
+// OAuthError defines the data returned when a request following the OAuth 2.0 protocol (RFC 6749) fails
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Values of the grant_type parameter of the form based token requests. The password and refresh_token grants
+// are only used by the JSON based requests of the endpoints /token and /refresh.
+const (
+	GrantTypePassword          = "password"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Values of the subject_token_type, requested_token_type and issued_token_type parameters of the token exchange
+// (RFC 8693, section 3). Only the access tokens issued by the server can be exchanged.
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// auditSink is what it needs to be implemented for receiving the audit events
+type auditSink interface {
+	// Write records the given event. The event must not be modified.
+	Write(event *protocol.AuditEvent) error
+	// Name returns the name of the sink, for the logs
+	Name() string
+}
+
+// auditLogger dispatches the audit events to all the configured sinks. The events are also always written to the
+// standard log. The sinks are only created when the server starts, they are not replaced when the configuration
+// is reloaded.
+type auditLogger struct {
+	sinks []auditSink
+}
+
+// newAuditLogger allocates a new auditLogger with the sinks given by the configuration, that can be nil
+func newAuditLogger(configuration *AuditConfiguration) (*auditLogger, error) {
+
+	logger := &auditLogger{
+		sinks: make([]auditSink, 0),
+	}
+
+	if configuration == nil {
+		return logger, nil
+	}
+
+	if configuration.File != nil {
+		sink, err := buildFileAuditSink(*configuration.File)
+		if err != nil {
+			log.Error("Unable to open the file for the audit events")
+			return nil, common.ErrBadConfiguration
+		}
+		logger.sinks = append(logger.sinks, sink)
+	}
+
+	if configuration.Syslog != nil {
+		logger.sinks = append(logger.sinks, buildSyslogAuditSink(*configuration.Syslog))
+	}
+
+	if configuration.Webhook != nil {
+		logger.sinks = append(logger.sinks, buildWebhookAuditSink(*configuration.Webhook))
+	}
+
+	return logger, nil
+}
+
+// Emit dates the given event and writes it to all the sinks. A sink failing does not prevent the others from
+// receiving the event.
+func (logger *auditLogger) Emit(event *protocol.AuditEvent) {
+
+	event.Time = time.Now().UTC()
+
+	log.WithFields(log.Fields{
+		"audit":         true,
+		"event":         event.Event,
+		"outcome":       event.Outcome,
+		"reason":        event.Reason,
+		"user":          event.UserName,
+		"clientId":      event.ClientId,
+		"provider":      event.Provider,
+		"remoteAddress": event.RemoteAddress,
+		"grantType":     event.GrantType,
+		"sessionId":     event.SessionId,
+		"targetAddress": event.TargetAddress,
+	}).Info("Audit event")
+
+	for _, sink := range logger.sinks {
+		if err := sink.Write(event); err != nil {
+			log.Error("Unable to write the audit event to the sink ", sink.Name())
+		}
+	}
+}
+
+// newAuditEvent returns a new event for the given user (that can be nil if unknown), with the outcome and the
+// reason given by the error
+func newAuditEvent(eventType string, grantType string, clientId string, user *authenticatedUser, err error) *protocol.AuditEvent {
+
+	event := &protocol.AuditEvent{
+		Event:     eventType,
+		Outcome:   protocol.AuditOutcomeSuccess,
+		ClientId:  clientId,
+		GrantType: grantType,
+	}
+	if user != nil {
+		event.UserName = user.UserName
+		event.Provider = user.Provider
+	}
+	if err != nil {
+		event.Outcome = protocol.AuditOutcomeFailure
+		event.Reason = auditReason(err)
+	}
+
+	return event
+}
+
+// auditReason returns the reason of a failure, as written in the audit events, for an error returned by the engine
+func auditReason(err error) string {
+
+	if _, ok := err.(*lockoutError); ok {
+		return "locked"
+	}
+
+	switch err {
+	case common.ErrUserNotFound, common.ErrUnauthorized:
+		return "invalid_credentials"
+	case common.ErrNoAuthorization:
+		return "invalid_client"
+	case errClientNotAllowed:
+		return "client_not_allowed"
+	case common.ErrRefreshTokenNotFound:
+		return "unknown_refresh_token"
+	case common.ErrRefreshTooOld:
+		return "expired_refresh_token"
+	case errRefreshTokenReused:
+		return "refresh_token_reused"
+	case errTooManyRefreshTokens:
+		return "too_many_sessions"
+	case errAuthorizationCodeInvalid:
+		return "invalid_authorization_code"
+	case errAudienceNotAllowed:
+		return "audience_not_allowed"
+	case errScopeNotAllowed:
+		return "scope_not_allowed"
+	case errSubjectTokenInvalid:
+		return "invalid_subject_token"
+	case errTokenNotOwned:
+		return "token_not_owned"
+	default:
+		return "server_error"
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// recordingAuditSink keeps the events written
+type recordingAuditSink struct {
+	events []*protocol.AuditEvent
+	mutex  sync.Mutex
+}
+
+func (sink *recordingAuditSink) Write(event *protocol.AuditEvent) error {
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *recordingAuditSink) Name() string {
+	return "recording"
+}
+
+// readAuditFile returns the events written in the given file
+func readAuditFile(t *testing.T, path string) []*protocol.AuditEvent {
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Unable to open the file of the audit events: ", err)
+	}
+	defer file.Close()
+
+	events := make([]*protocol.AuditEvent, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event protocol.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal("Unable to read the audit event: ", err)
+		}
+		events = append(events, &event)
+	}
+
+	return events
+}
+
+func TestFileAuditSinkRotatesItsFiles(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, _ := json.Marshal(&protocol.AuditEvent{Event: protocol.AuditEventToken, Outcome: protocol.AuditOutcomeSuccess, UserName: "user-0"})
+
+	// Each file holds two events
+	sink, err := buildFileAuditSink(AuditFileConfiguration{
+		Path:         &path,
+		MaxSizeBytes: int64Pointer(int64(2 * (len(line) + 1))),
+		MaxBackups:   intPointer(2),
+	})
+	if err != nil {
+		t.Fatal("Unable to build the sink: ", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(&protocol.AuditEvent{Event: protocol.AuditEventToken, Outcome: protocol.AuditOutcomeSuccess, UserName: fmt.Sprintf("user-%d", i)}); err != nil {
+			t.Fatal("Unable to write the event: ", err)
+		}
+	}
+
+	tests := []struct {
+		path      string
+		userNames []string
+	}{
+		{path, []string{"user-6"}},
+		{path + ".1", []string{"user-4", "user-5"}},
+		{path + ".2", []string{"user-2", "user-3"}},
+	}
+	for _, test := range tests {
+		events := readAuditFile(t, test.path)
+		if len(events) != len(test.userNames) {
+			t.Errorf("%s: %d events are written, expected %d", filepath.Base(test.path), len(events), len(test.userNames))
+			continue
+		}
+		for index, event := range events {
+			if event.UserName != test.userNames[index] {
+				t.Errorf("%s: the event of %s is written, expected %s", filepath.Base(test.path), event.UserName, test.userNames[index])
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("More files than the maximum backups are kept: ", err)
+	}
+
+	// The events already written are kept when the sink is opened again
+	sink.file.Close()
+	sink, err = buildFileAuditSink(AuditFileConfiguration{Path: &path})
+	if err != nil {
+		t.Fatal("Unable to open the sink again: ", err)
+	}
+	defer sink.file.Close()
+	sink.Write(&protocol.AuditEvent{Event: protocol.AuditEventToken, UserName: "user-7"})
+	if events := readAuditFile(t, path); len(events) != 2 {
+		t.Errorf("%d events are in the file opened again, expected 2", len(events))
+	}
+}
+
+func TestFileAuditSinkWithoutBackupDropsTheEvents(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := buildFileAuditSink(AuditFileConfiguration{Path: &path, MaxSizeBytes: int64Pointer(1), MaxBackups: intPointer(0)})
+	if err != nil {
+		t.Fatal("Unable to build the sink: ", err)
+	}
+	defer sink.file.Close()
+
+	for i := 0; i < 3; i++ {
+		sink.Write(&protocol.AuditEvent{Event: protocol.AuditEventToken, UserName: fmt.Sprintf("user-%d", i)})
+	}
+
+	// A line bigger than the maximum size is written alone in the file
+	if events := readAuditFile(t, path); (len(events) != 1) || (events[0].UserName != "user-2") {
+		t.Error("The file does not have only the last event: ", events)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Error("A backup is kept: ", err)
+	}
+}
+
+func TestSyslogAuditSinkSendsRFC5424Messages(t *testing.T) {
+
+	socketPath := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Skip("Unable to listen on a unix datagram socket: ", err)
+	}
+	defer listener.Close()
+
+	sink := buildSyslogAuditSink(AuditSyslogConfiguration{SocketPath: &socketPath, AppName: stringPointer("sso-test")})
+	tests := []struct {
+		outcome  string
+		priority string
+	}{
+		// The facility authpriv (10) with the severity informational (6) or warning (4)
+		{protocol.AuditOutcomeSuccess, "<86>1 "},
+		{protocol.AuditOutcomeFailure, "<84>1 "},
+	}
+
+	for _, test := range tests {
+		event := &protocol.AuditEvent{Time: time.Now().UTC(), Event: protocol.AuditEventToken, Outcome: test.outcome, UserName: testUserName}
+		if err := sink.Write(event); err != nil {
+			t.Fatal("Unable to write the event: ", err)
+		}
+
+		buffer := make([]byte, 4096)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		size, err := listener.Read(buffer)
+		if err != nil {
+			t.Fatal("Unable to read the message: ", err)
+		}
+		message := string(buffer[:size])
+
+		if !strings.HasPrefix(message, test.priority) {
+			t.Errorf("%s: the message does not start with %s: %s", test.outcome, test.priority, message)
+		}
+		fields := strings.SplitN(message, " ", 8)
+		if (len(fields) != 8) || (fields[3] != "sso-test") || (fields[5] != protocol.AuditEventToken) || (fields[6] != "-") {
+			t.Errorf("%s: the message is not formatted as RFC 5424: %s", test.outcome, message)
+			continue
+		}
+		var written protocol.AuditEvent
+		if err := json.Unmarshal([]byte(fields[7]), &written); err != nil || written.UserName != testUserName {
+			t.Errorf("%s: the message does not hold the event: %s", test.outcome, message)
+		}
+	}
+}
+
+func TestWebhookAuditSinkPostsTheEvents(t *testing.T) {
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		received <- request
+		bodies <- body
+	}))
+	defer server.Close()
+
+	sink := buildWebhookAuditSink(AuditWebhookConfiguration{
+		URL:     stringPointer(server.URL),
+		Headers: &map[string]*string{"Authorization": stringPointer("Bearer audit-token")},
+	})
+	if err := sink.Write(&protocol.AuditEvent{Event: protocol.AuditEventToken, UserName: testUserName}); err != nil {
+		t.Fatal("Unable to queue the event: ", err)
+	}
+
+	select {
+	case request := <-received:
+		if request.Header.Get("Authorization") != "Bearer audit-token" || request.Header.Get("Content-Type") != "application/json" {
+			t.Error("The event is not posted with the configured headers: ", request.Header)
+		}
+		var event protocol.AuditEvent
+		if err := json.Unmarshal(<-bodies, &event); err != nil || event.UserName != testUserName {
+			t.Error("The posted event can not be read: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The event was not posted")
+	}
+}
+
+func TestHandlersAuditTheAuthentications(t *testing.T) {
+
+	server := newTestServer(t, newTestConfigurationWithClients(t, "client-a"))
+	sink := &recordingAuditSink{}
+	server.audit = &auditLogger{sinks: []auditSink{sink}}
+
+	requestTestToken(t, server, "client-a")
+	body := protocol.TokenRequestBody{}
+	body.UserName = testUserName
+	body.Password = "wrong-password"
+	postJSON(server.handleTokenRequest, "/token", "client-a", body)
+	postJSON(server.handleTokenRequest, "/token", "unknown-client", body)
+
+	expected := []protocol.AuditEvent{
+		{Event: protocol.AuditEventToken, Outcome: protocol.AuditOutcomeSuccess, UserName: testUserName, ClientId: "client-a", Provider: "basic"},
+		{Event: protocol.AuditEventToken, Outcome: protocol.AuditOutcomeFailure, Reason: "invalid_credentials", UserName: testUserName, ClientId: "client-a"},
+		{Event: protocol.AuditEventToken, Outcome: protocol.AuditOutcomeFailure, Reason: "invalid_client"},
+	}
+	if len(sink.events) != len(expected) {
+		t.Fatalf("%d events are audited, expected %d", len(sink.events), len(expected))
+	}
+	for index, event := range sink.events {
+		if event.Time.IsZero() || (event.RemoteAddress != "192.0.2.1") || (event.GrantType != protocol.GrantTypePassword) {
+			t.Errorf("The event %d is not completed: %+v", index, event)
+		}
+		if (event.Event != expected[index].Event) ||
+			(event.Outcome != expected[index].Outcome) ||
+			(event.Reason != expected[index].Reason) ||
+			(event.UserName != expected[index].UserName) ||
+			(event.ClientId != expected[index].ClientId) ||
+			(event.Provider != expected[index].Provider) {
+			t.Errorf("The event %d is %+v, expected %+v", index, event, expected[index])
+		}
+	}
+}
+
+func TestAuditReasons(t *testing.T) {
+
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{common.ErrUserNotFound, "invalid_credentials"},
+		{common.ErrUnauthorized, "invalid_credentials"},
+		{common.ErrNoAuthorization, "invalid_client"},
+		{errRefreshTokenReused, "refresh_token_reused"},
+		{&lockoutError{}, "locked"},
+		{os.ErrClosed, "server_error"},
+	}
+
+	for _, test := range tests {
+		if reason := auditReason(test.err); reason != test.reason {
+			t.Errorf("The error %v is audited as %s, expected %s", test.err, reason, test.reason)
+		}
+	}
+}
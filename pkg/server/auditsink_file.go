@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// fileAuditSink writes the audit events as JSON lines in a file. When the file would exceed its maximum size, it
+// is renamed with the suffix .1 (the previous .1 becoming .2 and so on) and a new file is started.
+type fileAuditSink struct {
+	path         string
+	maxSizeBytes int64
+	maxBackups   int
+	file         *os.File
+	size         int64
+	mutex        sync.Mutex
+}
+
+func (sink *fileAuditSink) Write(event *protocol.AuditEvent) error {
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	// A line bigger than the maximum size is still written, alone in its file. If the rotation fails, the event
+	// is still written in the current file.
+	if (sink.size > 0) && (sink.size+int64(len(line)) > sink.maxSizeBytes) {
+		if err := sink.rotate(); err != nil {
+			log.Error("Unable to rotate the file of the audit events ", sink.path)
+		}
+	}
+
+	written, err := sink.file.Write(line)
+	sink.size += int64(written)
+
+	return err
+}
+
+func (sink *fileAuditSink) Name() string {
+	return "file"
+}
+
+// rotate closes the current file, shifts the previous files and opens a new file. If the files can not be
+// shifted, the current file is opened again so that the events are not lost.
+func (sink *fileAuditSink) rotate() error {
+
+	// The file may already be closed by a previous rotation that could not open the new file
+	if err := sink.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+
+	shiftErr := sink.shiftFiles()
+	if err := sink.open(); err != nil {
+		return err
+	}
+
+	return shiftErr
+}
+
+// shiftFiles renames the current file and the previous ones, dropping the oldest
+func (sink *fileAuditSink) shiftFiles() error {
+
+	// Without backup, the events of the current file are dropped
+	if sink.maxBackups == 0 {
+		if err := os.Remove(sink.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	for index := sink.maxBackups - 1; index > 0; index-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", sink.path, index), fmt.Sprintf("%s.%d", sink.path, index+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(sink.path, sink.path+".1")
+}
+
+// open opens (or creates) the file for appending the events
+func (sink *fileAuditSink) open() error {
+
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	sink.file = file
+	sink.size = info.Size()
+
+	return nil
+}
+
+// buildFileAuditSink opens the file of the audit events, keeping the events already written
+func buildFileAuditSink(configuration AuditFileConfiguration) (*fileAuditSink, error) {
+
+	sink := &fileAuditSink{
+		path:         *configuration.Path,
+		maxSizeBytes: 10 * 1024 * 1024,
+		maxBackups:   5,
+	}
+	if configuration.MaxSizeBytes != nil {
+		sink.maxSizeBytes = *configuration.MaxSizeBytes
+	}
+	if configuration.MaxBackups != nil {
+		sink.maxBackups = *configuration.MaxBackups
+	}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// Severities of the syslog messages (RFC 5424)
+const (
+	syslogSeverityWarning       = 4
+	syslogSeverityInformational = 6
+)
+
+// syslogAuditSink sends the audit events to the local syslog daemon through its unix socket, as RFC 5424
+// messages. The message is the JSON of the event. The socket is opened at the first event and opened again if
+// the daemon was restarted.
+type syslogAuditSink struct {
+	socketPath string
+	appName    string
+	facility   int
+	hostName   string
+	connection net.Conn
+	stream     bool
+	mutex      sync.Mutex
+}
+
+func (sink *syslogAuditSink) Write(event *protocol.AuditEvent) error {
+
+	message, err := sink.formatMessage(event)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	// Try a second time with a new connection, as the daemon may have been restarted
+	for attempt := 0; ; attempt++ {
+		if sink.connection == nil {
+			if err := sink.connect(); err != nil {
+				return err
+			}
+		}
+		// The messages sent over a stream socket are separated by a new line (RFC 6587)
+		data := message
+		if sink.stream {
+			data = append(message, '\n')
+		}
+		if _, err = sink.connection.Write(data); err == nil || attempt > 0 {
+			break
+		}
+		sink.connection.Close()
+		sink.connection = nil
+	}
+
+	return err
+}
+
+func (sink *syslogAuditSink) Name() string {
+	return "syslog"
+}
+
+// formatMessage returns the RFC 5424 message for the given event. The failures are sent as warnings, the
+// successes as informational messages.
+func (sink *syslogAuditSink) formatMessage(event *protocol.AuditEvent) ([]byte, error) {
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	severity := syslogSeverityInformational
+	if event.Outcome == protocol.AuditOutcomeFailure {
+		severity = syslogSeverityWarning
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return []byte(fmt.Sprintf(
+		"<%d>1 %s %s %s %d %s - %s",
+		sink.facility*8+severity,
+		event.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		sink.hostName,
+		sink.appName,
+		os.Getpid(),
+		event.Event,
+		content)), nil
+}
+
+// connect opens the socket of the syslog daemon, that is usually a datagram socket but may be a stream socket
+func (sink *syslogAuditSink) connect() error {
+
+	connection, err := net.Dial("unixgram", sink.socketPath)
+	if err == nil {
+		sink.connection = connection
+		sink.stream = false
+		return nil
+	}
+
+	connection, err = net.Dial("unix", sink.socketPath)
+	if err != nil {
+		return err
+	}
+	sink.connection = connection
+	sink.stream = true
+
+	return nil
+}
+
+// buildSyslogAuditSink creates the sink for the local syslog daemon. The socket is only opened with the first
+// event, so that the server can start before the daemon.
+func buildSyslogAuditSink(configuration AuditSyslogConfiguration) *syslogAuditSink {
+
+	sink := &syslogAuditSink{
+		socketPath: "/dev/log",
+		appName:    "easy-sso",
+		// The facility is by default authpriv (security/authorization messages)
+		facility: 10,
+		hostName: "-",
+	}
+	if configuration.SocketPath != nil {
+		sink.socketPath = *configuration.SocketPath
+	}
+	if configuration.AppName != nil {
+		sink.appName = *configuration.AppName
+	}
+	if configuration.Facility != nil {
+		sink.facility = *configuration.Facility
+	}
+	if hostName, err := os.Hostname(); err == nil && isPrintableASCII(hostName, 255) {
+		sink.hostName = hostName
+	}
+
+	return sink
+}
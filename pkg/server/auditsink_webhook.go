@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// errAuditQueueFull is returned when an audit event can not be queued for the webhook
+var errAuditQueueFull = errors.New("the queue of the audit events is full")
+
+// webhookAuditSink posts each audit event, as JSON, to an HTTP endpoint. The events are queued and posted in
+// background so that the queries are not slowed down by the endpoint. When the queue is full, the events are
+// dropped.
+type webhookAuditSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	queue   chan []byte
+}
+
+func (sink *webhookAuditSink) Write(event *protocol.AuditEvent) error {
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case sink.queue <- content:
+		return nil
+	default:
+		return errAuditQueueFull
+	}
+}
+
+func (sink *webhookAuditSink) Name() string {
+	return "webhook"
+}
+
+// postEvents posts the queued events one after the other
+func (sink *webhookAuditSink) postEvents() {
+
+	for content := range sink.queue {
+		if err := sink.post(content); err != nil {
+			log.Error("Unable to post the audit event to the webhook: ", err)
+		}
+	}
+}
+
+// post sends a single event. Any status other than 2xx is an error.
+func (sink *webhookAuditSink) post(content []byte) error {
+
+	request, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range sink.headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("unexpected status " + response.Status)
+	}
+
+	return nil
+}
+
+// buildWebhookAuditSink creates the sink posting to the webhook and starts posting in background
+func buildWebhookAuditSink(configuration AuditWebhookConfiguration) *webhookAuditSink {
+
+	timeoutSeconds := int64(5)
+	if configuration.TimeoutSeconds != nil {
+		timeoutSeconds = *configuration.TimeoutSeconds
+	}
+	queueSize := 1000
+	if configuration.QueueSize != nil {
+		queueSize = *configuration.QueueSize
+	}
+
+	headers := make(map[string]string)
+	if configuration.Headers != nil {
+		for name, value := range *configuration.Headers {
+			headers[name] = *value
+		}
+	}
+
+	sink := &webhookAuditSink{
+		url:     *configuration.URL,
+		headers: headers,
+		client:  &http.Client{Timeout: time.Duration(timeoutSeconds) * time.Second},
+		queue:   make(chan []byte, queueSize),
+	}
+
+	go sink.postEvents()
+
+	return sink
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// authorizationCodeSecondsToLive is the time for redeeming an authorization code. The RFC 6749 recommends a
+// maximum of 10 minutes, but the code is normally redeemed immediately after the redirection.
+const authorizationCodeSecondsToLive = 60
+
+// authorizationCode holds the information bound to an authorization code, waiting for its redemption
+type authorizationCode struct {
+	authenticatedUser *authenticatedUser
+	grant             tokenGrant
+	redirectURI       string
+	codeChallenge     string
+	expiresAt         int64
+}
+
+// authorizationCodeStore holds the authorization codes not redeemed yet. The codes are only kept in memory
+// as they are short-lived, but the store is shared by the engines created when the configuration is reloaded.
+type authorizationCodeStore struct {
+	codes map[string]*authorizationCode
+	mutex sync.Mutex
+}
+
+// Put stores a new authorization code and returns its value. The codes that are expired are removed.
+func (store *authorizationCodeStore) Put(information *authorizationCode) (string, error) {
+
+	codeData := make([]byte, 32)
+	if _, err := rand.Read(codeData); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(codeData)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for existingCode, existingInformation := range store.codes {
+		if existingInformation.expiresAt < now {
+			delete(store.codes, existingCode)
+		}
+	}
+
+	store.codes[code] = information
+	return code, nil
+}
+
+// Consume removes the given authorization code and returns its information, so that a code can only be used
+// once. If the code is not known, nil is returned.
+func (store *authorizationCodeStore) Consume(code string) *authorizationCode {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	information := store.codes[code]
+	delete(store.codes, code)
+
+	return information
+}
+
+func buildAuthorizationCodeStore() *authorizationCodeStore {
+
+	return &authorizationCodeStore{
+		codes: make(map[string]*authorizationCode),
+	}
+}
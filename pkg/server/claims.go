@@ -0,0 +1,61 @@
+package server
+
+// claimMapping holds the mapping of an attribute of the users to a claim of the tokens
+type claimMapping struct {
+	attribute string
+	claim     string
+	// If true, the claim has all the values of the attribute, otherwise only the first one
+	multiple bool
+}
+
+// newClaimMappings builds the mappings of the attributes from the configuration. The configuration is checked
+// while loading config.
+func newClaimMappings(configuration *SsoConfiguration) []*claimMapping {
+
+	mappings := make([]*claimMapping, 0)
+	if configuration.ClaimMappings == nil {
+		return mappings
+	}
+
+	for _, mappingConfiguration := range *configuration.ClaimMappings {
+
+		mapping := &claimMapping{
+			attribute: *mappingConfiguration.Attribute,
+			claim:     *mappingConfiguration.Claim,
+		}
+
+		if mappingConfiguration.Multiple != nil {
+			mapping.multiple = *mappingConfiguration.Multiple
+		}
+
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings
+}
+
+// mapAttributesToClaims returns the claims for the attributes of the given user. The attributes that the user
+// does not have are not mapped. Returns nil if there is no claim.
+func mapAttributesToClaims(mappings []*claimMapping, authenticatedUser *authenticatedUser) map[string]interface{} {
+
+	var claims map[string]interface{}
+	for _, mapping := range mappings {
+
+		values := authenticatedUser.Attributes[mapping.attribute]
+		if len(values) == 0 {
+			continue
+		}
+
+		if claims == nil {
+			claims = make(map[string]interface{})
+		}
+
+		if mapping.multiple {
+			claims[mapping.claim] = values
+		} else {
+			claims[mapping.claim] = values[0]
+		}
+	}
+
+	return claims
+}
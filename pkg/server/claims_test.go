@@ -0,0 +1,74 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMapAttributesToClaims(t *testing.T) {
+
+	mappings := []*claimMapping{
+		{attribute: "mail", claim: "email"},
+		{attribute: "memberOf", claim: "groups", multiple: true},
+		{attribute: "department", claim: "dept"},
+	}
+
+	tests := []struct {
+		name       string
+		attributes map[string][]string
+		expected   map[string]interface{}
+	}{
+		{"no attribute", nil, nil},
+		{"attributes not mapped", map[string][]string{"phone": {"123"}}, nil},
+		{"empty attribute", map[string][]string{"mail": {}}, nil},
+		{"first value only", map[string][]string{"mail": {"alice@example.com", "alice@example.org"}}, map[string]interface{}{"email": "alice@example.com"}},
+		{"all the values", map[string][]string{"memberOf": {"a", "b"}}, map[string]interface{}{"groups": []string{"a", "b"}}},
+		{"missing attributes are not mapped", map[string][]string{"mail": {"alice@example.com"}, "phone": {"123"}}, map[string]interface{}{"email": "alice@example.com"}},
+	}
+
+	for _, test := range tests {
+		claims := mapAttributesToClaims(mappings, &authenticatedUser{UserName: testUserName, Attributes: test.attributes})
+		if !reflect.DeepEqual(claims, test.expected) {
+			t.Errorf("%s: the attributes are mapped to %v, expected %v", test.name, claims, test.expected)
+		}
+	}
+}
+
+func TestClaimMappingsCanNotUseTheReservedClaims(t *testing.T) {
+
+	for _, claim := range []string{"sub", "user", "roles", "scope", "act"} {
+		configuration := newTestConfiguration(t)
+		configuration.Sso.ClaimMappings = &[]*ClaimMappingConfiguration{
+			{Attribute: stringPointer("mail"), Claim: stringPointer(claim)},
+		}
+		if err := ValidateConfiguration(configuration); err == nil {
+			t.Errorf("The claim mapping to the reserved claim %s was accepted", claim)
+		}
+	}
+}
+
+func TestTokensHaveTheClaimsOfTheAttributesOfTheUser(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	(*configuration.Basic.Users)[0].Attributes = &map[string]*string{"mail": stringPointer("alice@example.com")}
+	configuration.Sso.ClaimMappings = &[]*ClaimMappingConfiguration{
+		{Attribute: stringPointer("mail"), Claim: stringPointer("email")},
+		{Attribute: stringPointer("department"), Claim: stringPointer("dept")},
+	}
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal("Unable to validate the configuration: ", err)
+	}
+	accessToken, _ := enrollTestUser(t, newTestEngine(t, configuration), tokenGrant{})
+
+	claims := readTestTokenClaims(t, accessToken)
+
+	if claims["email"] != "alice@example.com" {
+		t.Error("The token does not have the mapped claim: ", claims)
+	}
+	if _, ok := claims["dept"]; ok {
+		t.Error("The token has a claim for an attribute that the provider did not return: ", claims)
+	}
+	if claims["user"] != testUserName {
+		t.Error("The token does not have the user: ", claims)
+	}
+}
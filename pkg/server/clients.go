@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errClientNotAllowed is returned when an authenticated client uses an endpoint or a grant that it is not
+// allowed to use
+var errClientNotAllowed = errors.New("the client is not allowed to use this endpoint or grant")
+
+// clientEndpoints are the endpoints that can be allowed to a client
+var clientEndpoints = []string{"token", "refresh", "revoke", "introspect", "status", "reload-sso-configuration", "sessions", "lockouts", "metrics"}
+
+// defaultClientEndpoints are the endpoints allowed to a client without allowedEndpoints: the public endpoints. The
+// administration endpoints must be explicitly allowed.
+var defaultClientEndpoints = []string{"token", "refresh", "revoke"}
+
+// publicClientEndpoints are the endpoints that a public client (without secret) can use when the endpoints require an
+// authentication. As it can only give its id, it is limited to the endpoints where it presents its own tokens.
+var publicClientEndpoints = []string{"refresh", "revoke"}
+
+// clientGrants are the grants that can be allowed to a client
+var clientGrants = []string{
+	protocol.GrantTypePassword,
+	protocol.GrantTypeRefreshToken,
+	protocol.GrantTypeAuthorizationCode,
+	protocol.GrantTypeClientCredentials,
+	protocol.GrantTypeTokenExchange,
+}
+
+// endpointAuthenticationFunction checks the authentication of the client calling an endpoint, and returns the
+// id of the client. If the endpoints are not protected, an empty id is returned.
+type endpointAuthenticationFunction func(request *http.Request, endpoint string) (string, error)
+
+// registeredClient holds the information about a client (an application) registered for using the SSO
+type registeredClient struct {
+	clientId     string
+	redirectURIs []string
+	// The bcrypt hashes of the secrets of the client. Several secrets can be valid at once, so that they can be
+	// changed without interruption.
+	secretHashes [][]byte
+	// The roles of the tokens issued for the client itself
+	roles []string
+	// The time to live of the tokens issued for the client, 0 for the default of the SSO
+	tokenSecondsToLive   int64
+	refreshSecondsToLive int64
+	// The endpoints that the client can use
+	allowedEndpoints []string
+	// The grants that the client can use, nil if not restricted
+	allowedGrants []string
+	// The audiences that the client can request, nil for the audiences of the SSO
+	allowedAudiences []string
+	// The scopes that the client can request, nil if not restricted
+	allowedScopes []string
+	// The audiences, besides the id of the client, of the tokens that the client can exchange
+	exchangeAudiences []string
+}
+
+// newRegisteredClients builds the registered clients from the configuration, indexed by their id. The
+// configuration is checked while loading config.
+func newRegisteredClients(configuration *Configuration) map[string]*registeredClient {
+
+	clients := make(map[string]*registeredClient)
+	if configuration.Clients == nil {
+		return clients
+	}
+
+	for _, clientConfiguration := range *configuration.Clients {
+
+		client := &registeredClient{
+			clientId:          *clientConfiguration.ClientId,
+			redirectURIs:      make([]string, 0),
+			secretHashes:      make([][]byte, 0),
+			roles:             make([]string, 0),
+			allowedEndpoints:  defaultClientEndpoints,
+			exchangeAudiences: make([]string, 0),
+		}
+
+		if clientConfiguration.RedirectURIs != nil {
+			for _, redirectURI := range *clientConfiguration.RedirectURIs {
+				client.redirectURIs = append(client.redirectURIs, *redirectURI)
+			}
+		}
+
+		if clientConfiguration.Secrets != nil {
+			for _, secret := range *clientConfiguration.Secrets {
+				client.secretHashes = append(client.secretHashes, []byte(*secret))
+			}
+		}
+
+		if clientConfiguration.Roles != nil {
+			for _, role := range *clientConfiguration.Roles {
+				client.roles = append(client.roles, *role)
+			}
+		}
+
+		if clientConfiguration.TokenSecondsToLive != nil {
+			client.tokenSecondsToLive = *clientConfiguration.TokenSecondsToLive
+		}
+
+		if clientConfiguration.RefreshSecondsToLive != nil {
+			client.refreshSecondsToLive = *clientConfiguration.RefreshSecondsToLive
+		}
+
+		if clientConfiguration.AllowedEndpoints != nil {
+			client.allowedEndpoints = make([]string, 0)
+			for _, endpoint := range *clientConfiguration.AllowedEndpoints {
+				client.allowedEndpoints = append(client.allowedEndpoints, *endpoint)
+			}
+		}
+
+		if clientConfiguration.AllowedGrants != nil {
+			client.allowedGrants = make([]string, 0)
+			for _, grant := range *clientConfiguration.AllowedGrants {
+				client.allowedGrants = append(client.allowedGrants, *grant)
+			}
+		}
+
+		if clientConfiguration.AllowedAudiences != nil {
+			client.allowedAudiences = make([]string, 0)
+			for _, audience := range *clientConfiguration.AllowedAudiences {
+				client.allowedAudiences = append(client.allowedAudiences, *audience)
+			}
+		}
+
+		if clientConfiguration.AllowedScopes != nil {
+			client.allowedScopes = make([]string, 0)
+			for _, scope := range *clientConfiguration.AllowedScopes {
+				client.allowedScopes = append(client.allowedScopes, *scope)
+			}
+		}
+
+		if clientConfiguration.ExchangeAudiences != nil {
+			for _, audience := range *clientConfiguration.ExchangeAudiences {
+				client.exchangeAudiences = append(client.exchangeAudiences, *audience)
+			}
+		}
+
+		clients[client.clientId] = client
+	}
+
+	return clients
+}
+
+// isRedirectURIAllowed returns true if the given URI is registered for the client. As recommended by the
+// OAuth 2.0 Security Best Current Practice, the URI must match exactly.
+func (client *registeredClient) isRedirectURIAllowed(redirectURI string) bool {
+
+	for _, allowedURI := range client.redirectURIs {
+		if allowedURI == redirectURI {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecretValid returns true if the given secret matches one of the secrets of the client
+func (client *registeredClient) isSecretValid(secret string) bool {
+
+	if len(secret) == 0 {
+		return false
+	}
+
+	for _, secretHash := range client.secretHashes {
+		if bcrypt.CompareHashAndPassword(secretHash, []byte(secret)) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEndpointAllowed returns true if the client can use the given endpoint
+func (client *registeredClient) isEndpointAllowed(endpoint string) bool {
+
+	return containsString(client.allowedEndpoints, endpoint)
+}
+
+// isGrantAllowed returns true if the client can use the given grant
+func (client *registeredClient) isGrantAllowed(grant string) bool {
+
+	return (client.allowedGrants == nil) || containsString(client.allowedGrants, grant)
+}
+
+// isScopeAllowed returns true if the client can request the given scope
+func (client *registeredClient) isScopeAllowed(scope string) bool {
+
+	return (client.allowedScopes == nil) || containsString(client.allowedScopes, scope)
+}
+
+// isSubjectTokenAllowed returns true if the client can exchange the token with the given claims. The audiences of
+// the token must include the id of the client or one of its exchange audiences. A token without audience, as issued
+// when no audience is requested, can only be exchanged by the client that obtained it.
+func (client *registeredClient) isSubjectTokenAllowed(claims *protocol.TokenClaims) bool {
+
+	if len(claims.Audience) == 0 {
+		return claims.ClientId == client.clientId
+	}
+
+	if claims.Audience.Contains(client.clientId) {
+		return true
+	}
+
+	for _, audience := range client.exchangeAudiences {
+		if claims.Audience.Contains(audience) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// toAuthenticatedUser returns the client as the user of the tokens it obtains for itself
+func (client *registeredClient) toAuthenticatedUser() *authenticatedUser {
+
+	return &authenticatedUser{
+		UserName: client.clientId,
+		Roles:    client.roles,
+		Provider: authenticatedUserProviderClient,
+	}
+}
+
+// buildEndpointAuthenticationFunction builds the function checking the authentication of the clients on the
+// endpoints. The clients authenticate with a Basic HTTP authentication, using either the historical clientId and
+// clientPassword of the SSO configuration or the id and a secret of a registered client. If none of them is
+// configured, the endpoints are not protected. A public client (without secret) only gives its id, either with an
+// empty password or as the client_id of a form, and can only use the endpoints of publicClientEndpoints.
+func buildEndpointAuthenticationFunction(configuration Configuration) endpointAuthenticationFunction {
+
+	// The clients that can authenticate on the endpoints, and the public clients that can only identify themselves
+	clients := make(map[string]*registeredClient)
+	publicClients := make(map[string]*registeredClient)
+	for clientId, client := range newRegisteredClients(&configuration) {
+		if len(client.secretHashes) > 0 {
+			clients[clientId] = client
+		} else {
+			publicClients[clientId] = client
+		}
+	}
+
+	sharedClient := (configuration.Sso != nil) && (configuration.Sso.ClientId != nil) && (configuration.Sso.ClientPassword != nil)
+
+	// If no configuration, skip
+	if !sharedClient && (len(clients) == 0) {
+		return nil
+	}
+
+	return func(request *http.Request, endpoint string) (string, error) {
+
+		clientId, clientPassword, ok := request.BasicAuth()
+		if !ok {
+			// A public client can give its id in a form, as for the authorization code grant
+			if !isFormRequest(request) || (publicClients[request.PostFormValue("client_id")] == nil) {
+				return "", common.ErrNoAuthorization
+			}
+			clientId = request.PostFormValue("client_id")
+		}
+
+		if publicClient := publicClients[clientId]; (publicClient != nil) && (len(clientPassword) == 0) {
+			if !containsString(publicClientEndpoints, endpoint) || !publicClient.isEndpointAllowed(endpoint) {
+				log.WithFields(log.Fields{
+					"security": true,
+					"clientId": clientId,
+					"endpoint": endpoint,
+				}).Warn("A public client tried to use an endpoint that it is not allowed to use")
+				return "", errClientNotAllowed
+			}
+			return clientId, nil
+		}
+
+		// Both the id and the password must match
+		if sharedClient &&
+			(subtle.ConstantTimeCompare([]byte(clientId), []byte(*configuration.Sso.ClientId)) == 1) &&
+			(subtle.ConstantTimeCompare([]byte(clientPassword), []byte(*configuration.Sso.ClientPassword)) == 1) {
+			return clientId, nil
+		}
+
+		client := clients[clientId]
+		if (client == nil) || !client.isSecretValid(clientPassword) {
+			log.WithFields(log.Fields{
+				"security": true,
+				"clientId": clientId,
+				"endpoint": endpoint,
+			}).Warn("A client failed to authenticate on an endpoint")
+			return "", common.ErrNoAuthorization
+		}
+
+		if !client.isEndpointAllowed(endpoint) {
+			log.WithFields(log.Fields{
+				"security": true,
+				"clientId": clientId,
+				"endpoint": endpoint,
+			}).Warn("A client tried to use an endpoint that it is not allowed to use")
+			return "", errClientNotAllowed
+		}
+
+		return clientId, nil
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// authenticateOnEndpoint calls the given endpoint authentication with the given client id and secret
+func authenticateOnEndpoint(checkAuthentication endpointAuthenticationFunction, endpoint string, clientId string, clientSecret string) (string, error) {
+
+	request := httptest.NewRequest(http.MethodPost, "/"+endpoint, nil)
+	request.SetBasicAuth(clientId, clientSecret)
+	return checkAuthentication(request, endpoint)
+}
+
+func TestClientsWithoutAllowedEndpointsOnlyUseThePublicEndpoints(t *testing.T) {
+
+	checkAuthentication := buildEndpointAuthenticationFunction(*newTestConfigurationWithClients(t, "client-a"))
+
+	for _, endpoint := range []string{"token", "refresh", "revoke"} {
+		if clientId, err := authenticateOnEndpoint(checkAuthentication, endpoint, "client-a", testClientSecret); err != nil || clientId != "client-a" {
+			t.Error("The client can not use the public endpoint ", endpoint, ": ", err)
+		}
+	}
+	for _, endpoint := range []string{"introspect", "status", "reload-sso-configuration", "sessions", "lockouts", "metrics"} {
+		if _, err := authenticateOnEndpoint(checkAuthentication, endpoint, "client-a", testClientSecret); err != errClientNotAllowed {
+			t.Error("The client can use the administration endpoint ", endpoint, ": ", err)
+		}
+	}
+}
+
+func TestClientsOnlyUseTheirAllowedEndpoints(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "client-a")
+	(*configuration.Clients)[0].AllowedEndpoints = &[]*string{stringPointer("introspect")}
+	checkAuthentication := buildEndpointAuthenticationFunction(*configuration)
+
+	if _, err := authenticateOnEndpoint(checkAuthentication, "introspect", "client-a", testClientSecret); err != nil {
+		t.Error("The client can not use its allowed endpoint: ", err)
+	}
+	if _, err := authenticateOnEndpoint(checkAuthentication, "token", "client-a", testClientSecret); err != errClientNotAllowed {
+		t.Error("The client can use an endpoint that is not in its allowed endpoints: ", err)
+	}
+}
+
+func TestClientsAuthenticateWithTheirSecret(t *testing.T) {
+
+	checkAuthentication := buildEndpointAuthenticationFunction(*newTestConfigurationWithClients(t, "client-a", "client-b"))
+
+	if _, err := authenticateOnEndpoint(checkAuthentication, "token", "client-a", "wrong-secret"); err != common.ErrNoAuthorization {
+		t.Error("The client authenticated with a wrong secret: ", err)
+	}
+	if _, err := authenticateOnEndpoint(checkAuthentication, "token", "unknown-client", testClientSecret); err != common.ErrNoAuthorization {
+		t.Error("An unknown client authenticated: ", err)
+	}
+	if _, err := authenticateOnEndpoint(checkAuthentication, "token", "client-a", ""); err != common.ErrNoAuthorization {
+		t.Error("The client authenticated without secret: ", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/token", nil)
+	if _, err := checkAuthentication(request, "token"); err != common.ErrNoAuthorization {
+		t.Error("A query without authentication was accepted: ", err)
+	}
+}
+
+func TestSharedClientUsesAllTheEndpoints(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "client-a")
+	configuration.Sso.ClientId = stringPointer("shared-client")
+	configuration.Sso.ClientPassword = stringPointer("shared-password")
+	checkAuthentication := buildEndpointAuthenticationFunction(*configuration)
+
+	for _, endpoint := range clientEndpoints {
+		if _, err := authenticateOnEndpoint(checkAuthentication, endpoint, "shared-client", "shared-password"); err != nil {
+			t.Error("The shared client can not use the endpoint ", endpoint, ": ", err)
+		}
+	}
+	if _, err := authenticateOnEndpoint(checkAuthentication, "token", "shared-client", "wrong-password"); err != common.ErrNoAuthorization {
+		t.Error("The shared client authenticated with a wrong password: ", err)
+	}
+}
+
+func TestClientsAreForbiddenOnTheEndpointsNotAllowed(t *testing.T) {
+
+	server := newTestServer(t, newTestConfigurationWithClients(t, "client-a"))
+
+	body := protocol.TokenIntrospectionBody{Token: "any-token"}
+	if recorder := postJSON(server.handleIntrospectRequest, "/introspect", "client-a", body); recorder.Code != http.StatusForbidden {
+		t.Error("The client used the introspection endpoint, status ", recorder.Code)
+	}
+	if recorder := postJSON(server.handleIntrospectRequest, "/introspect", "", body); recorder.Code != http.StatusUnauthorized {
+		t.Error("The introspection endpoint was used without authentication, status ", recorder.Code)
+	}
+}
+
+func TestClientsOnlyUseTheirAllowedGrants(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "client-a")
+	(*configuration.Clients)[0].AllowedGrants = &[]*string{stringPointer(protocol.GrantTypeClientCredentials)}
+	server := newTestServer(t, configuration)
+
+	body := protocol.TokenRequestBody{}
+	body.UserName = testUserName
+	body.Password = testPassword
+	if recorder := postJSON(server.handleTokenRequest, "/token", "client-a", body); recorder.Code != http.StatusForbidden {
+		t.Error("The client used the password grant, status ", recorder.Code)
+	}
+}
+
+func TestPublicClientsOnlyUseTheEndpointsOfTheirTokens(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "client-a")
+	*configuration.Clients = append(*configuration.Clients,
+		&ClientConfiguration{ClientId: stringPointer("public-a")},
+		&ClientConfiguration{ClientId: stringPointer("public-b"), AllowedEndpoints: &[]*string{stringPointer("revoke")}})
+	checkAuthentication := buildEndpointAuthenticationFunction(*configuration)
+
+	tests := []struct {
+		name          string
+		clientId      string
+		clientSecret  string
+		endpoint      string
+		expectedError error
+	}{
+		{"refresh", "public-a", "", "refresh", nil},
+		{"revoke", "public-a", "", "revoke", nil},
+		{"token", "public-a", "", "token", errClientNotAllowed},
+		{"administration endpoint", "public-a", "", "introspect", errClientNotAllowed},
+		{"endpoint not allowed", "public-b", "", "refresh", errClientNotAllowed},
+		{"with a secret", "public-a", testClientSecret, "refresh", common.ErrNoAuthorization},
+		{"confidential client without its secret", "client-a", "", "refresh", common.ErrNoAuthorization},
+	}
+
+	for _, test := range tests {
+		clientId, err := authenticateOnEndpoint(checkAuthentication, test.endpoint, test.clientId, test.clientSecret)
+		if err != test.expectedError {
+			t.Errorf("%s: the authentication returned %v, expected %v", test.name, err, test.expectedError)
+			continue
+		}
+		if (err == nil) && (clientId != test.clientId) {
+			t.Errorf("%s: the client is authenticated as %s", test.name, clientId)
+		}
+	}
+
+	// The id can be given in a form
+	for clientId, expectedError := range map[string]error{"public-a": nil, "client-a": common.ErrNoAuthorization, "unknown": common.ErrNoAuthorization} {
+		request := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(url.Values{"client_id": {clientId}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := checkAuthentication(request, "revoke"); err != expectedError {
+			t.Errorf("The client %s giving its id in a form is authenticated with %v, expected %v", clientId, err, expectedError)
+		}
+	}
+}
@@ -1,36 +1,181 @@
 package server
 
 import (
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Configuration struct {
-	Sso   *SsoConfiguration           `json:"sso"`
-	Ldap  *LdapProviderConfiguration  `json:"ldap"`
-	Basic *BasicProviderConfiguration `json:"basic"`
+	Sso     *SsoConfiguration           `json:"sso"`
+	Ldap    *LdapProviderConfiguration  `json:"ldap"`
+	Basic   *BasicProviderConfiguration `json:"basic"`
+	Clients *[]*ClientConfiguration     `json:"clients"`
+	Audit   *AuditConfiguration         `json:"audit"`
 }
 
 // SsoConfiguration contains the general parameters for the SSO server
 type SsoConfiguration struct {
+	ClientId              *string                       `json:"clientId"`
+	ClientPassword        *string                       `json:"clientPassword"`
+	PrivateKeyPath        *string                       `json:"privateKeyPath"`
+	TokenSecondsToLive    *int64                        `json:"tokenSecondsToLive"`
+	RefreshSecondsToLive  *int64                        `json:"refreshSecondsToLive"`
+	ExchangeSecondsToLive *int64                        `json:"exchangeSecondsToLive"`
+	Providers             *[]*string                    `json:"providers"`
+	ProviderPolicy        *string                       `json:"providerPolicy"`
+	RefreshTokenStore     *string                       `json:"refreshTokenStore"`
+	RefreshTokenStorePath *string                       `json:"refreshTokenStorePath"`
+	RefreshSweepSeconds   *int64                        `json:"refreshSweepSeconds"`
+	MaxRefreshTokens      *int                          `json:"maxRefreshTokens"`
+	RefreshEvictionPolicy *string                       `json:"refreshEvictionPolicy"`
+	SigningKeys           *[]*SigningKeyConfiguration   `json:"signingKeys"`
+	KeyRotation           *KeyRotationConfiguration     `json:"keyRotation"`
+	SigningAlgorithm      *string                       `json:"signingAlgorithm"`
+	Issuer                *string                       `json:"issuer"`
+	Audiences             *[]*string                    `json:"audiences"`
+	Scopes                *[]*ScopeConfiguration        `json:"scopes"`
+	ClaimMappings         *[]*ClaimMappingConfiguration `json:"claimMappings"`
+	RoleMapping           *RoleMappingConfiguration     `json:"roleMapping"`
+	RoleHierarchy         *RoleHierarchyConfiguration   `json:"roleHierarchy"`
+	Lockout               *LockoutConfiguration         `json:"lockout"`
+	TrustedProxies        *[]*string                    `json:"trustedProxies"`
+}
+
+// LockoutConfiguration contains the limits of the failed authentications of the users. When a user or an address
+// fails too many times in the window, it is locked for a duration that doubles at each new lock.
+type LockoutConfiguration struct {
+	MaxFailures       *int   `json:"maxFailures"`
+	WindowSeconds     *int64 `json:"windowSeconds"`
+	LockoutSeconds    *int64 `json:"lockoutSeconds"`
+	MaxLockoutSeconds *int64 `json:"maxLockoutSeconds"`
+	ByUser            *bool  `json:"byUser"`
+	ByAddress         *bool  `json:"byAddress"`
+}
+
+// ClaimMappingConfiguration contains the mapping of an attribute of the users (as given by the providers) to a
+// claim of the tokens. The claim is the first value of the attribute, or all its values if multiple is true.
+type ClaimMappingConfiguration struct {
+	Attribute *string `json:"attribute"`
+	Claim     *string `json:"claim"`
+	Multiple  *bool   `json:"multiple"`
+}
+
+// RoleMappingConfiguration contains the rewriting of the groups given by the providers into the roles of the
+// tokens. The providers (basic or ldap) can have their own table, the table given at the top level being used for
+// the providers without one.
+type RoleMappingConfiguration struct {
+	RoleMappingTableConfiguration
+	Providers *map[string]*RoleMappingTableConfiguration `json:"providers"`
+}
+
+// RoleMappingTableConfiguration contains the rules of a table of the role mapping. The groups not matched by any
+// rule are dropped unless keepUnmapped is true. The default roles are given to all the users.
+type RoleMappingTableConfiguration struct {
+	Rules        *[]*RoleMappingRuleConfiguration `json:"rules"`
+	DefaultRoles *[]*string                       `json:"defaultRoles"`
+	KeepUnmapped *bool                            `json:"keepUnmapped"`
+}
+
+// RoleMappingRuleConfiguration contains a rule of the role mapping. The group is matched exactly (default), as a
+// prefix or as a regular expression matching the whole group. The role can use the submatches of a regular
+// expression ($1, ${name}), and can be omitted for a prefix, the role being the group without the prefix.
+type RoleMappingRuleConfiguration struct {
+	Match *string `json:"match"`
+	Group *string `json:"group"`
+	Role  *string `json:"role"`
+}
+
+// RoleHierarchyConfiguration contains the roles implied by other roles, for example {"admin": ["editor"],
+// "editor": ["viewer"]}. The tokens have by default all the roles of the users, including the implied ones
+// (tokenRoles "expanded"), or only the roles not implied by another role of the user (tokenRoles "topLevel").
+type RoleHierarchyConfiguration struct {
+	Roles      *map[string]*[]*string `json:"roles"`
+	TokenRoles *string                `json:"tokenRoles"`
+}
+
+// ScopeConfiguration contains a scope that can be requested for the tokens, and the roles that the users must
+// have (one of) for obtaining it. A scope without roles can be obtained by all the users.
+type ScopeConfiguration struct {
+	Name  *string    `json:"name"`
+	Roles *[]*string `json:"roles"`
+}
+
+// SigningKeyConfiguration contains a single key for signing the tokens. Only the active key is used for signing,
+// the other keys are still published and accepted
+type SigningKeyConfiguration struct {
+	PrivateKeyPath *string `json:"privateKeyPath"`
+	Active         *bool   `json:"active"`
+}
+
+// KeyRotationConfiguration contains the parameters for generating periodically a new key for signing the tokens
+type KeyRotationConfiguration struct {
+	SecondsInterval *int64  `json:"secondsInterval"`
+	KeyDirectory    *string `json:"keyDirectory"`
+}
+
+// ClientConfiguration contains a single client (an application) registered for using the SSO. The secrets are
+// bcrypt hashes, and the roles are the ones of the client itself when it authenticates with its secret
+type ClientConfiguration struct {
 	ClientId             *string    `json:"clientId"`
-	ClientPassword       *string    `json:"clientPassword"`
-	PrivateKeyPath       *string    `json:"privateKeyPath"`
+	RedirectURIs         *[]*string `json:"redirectUris"`
+	Secrets              *[]*string `json:"secrets"`
+	Roles                *[]*string `json:"roles"`
 	TokenSecondsToLive   *int64     `json:"tokenSecondsToLive"`
 	RefreshSecondsToLive *int64     `json:"refreshSecondsToLive"`
-	Providers            *[]*string `json:"providers"`
+	AllowedEndpoints     *[]*string `json:"allowedEndpoints"`
+	AllowedGrants        *[]*string `json:"allowedGrants"`
+	AllowedAudiences     *[]*string `json:"allowedAudiences"`
+	AllowedScopes        *[]*string `json:"allowedScopes"`
+	ExchangeAudiences    *[]*string `json:"exchangeAudiences"`
+}
+
+// AuditConfiguration contains the sinks to which the audit events are written. Any number of them can be given.
+type AuditConfiguration struct {
+	File    *AuditFileConfiguration    `json:"file"`
+	Syslog  *AuditSyslogConfiguration  `json:"syslog"`
+	Webhook *AuditWebhookConfiguration `json:"webhook"`
+}
+
+// AuditFileConfiguration contains the parameters for writing the audit events as JSON lines in a file. The file is
+// rotated when it reaches its maximum size, keeping the given number of previous files.
+type AuditFileConfiguration struct {
+	Path         *string `json:"path"`
+	MaxSizeBytes *int64  `json:"maxSizeBytes"`
+	MaxBackups   *int    `json:"maxBackups"`
+}
+
+// AuditSyslogConfiguration contains the parameters for sending the audit events to the local syslog (RFC 5424)
+type AuditSyslogConfiguration struct {
+	SocketPath *string `json:"socketPath"`
+	AppName    *string `json:"appName"`
+	Facility   *int    `json:"facility"`
+}
+
+// AuditWebhookConfiguration contains the parameters for posting the audit events to an HTTP endpoint. The events
+// are posted in background, the ones that can not be queued are dropped.
+type AuditWebhookConfiguration struct {
+	URL            *string             `json:"url"`
+	Headers        *map[string]*string `json:"headers"`
+	TimeoutSeconds *int64              `json:"timeoutSeconds"`
+	QueueSize      *int                `json:"queueSize"`
 }
 
 // LdapProviderConfiguration contains the parameters for connecting to a LDAP server for client authentication
 type LdapProviderConfiguration struct {
-	Host         *string `json:"host"`
-	Port         *int    `json:"port"`
-	Ssl          *bool   `json:"ssl"`
-	BaseDN       *string `json:"baseDN"`
-	BindDN       *string `json:"bindDN"`
-	BindPassword *string `json:"bindPassword"`
+	Host         *string    `json:"host"`
+	Port         *int       `json:"port"`
+	Ssl          *bool      `json:"ssl"`
+	BaseDN       *string    `json:"baseDN"`
+	BindDN       *string    `json:"bindDN"`
+	BindPassword *string    `json:"bindPassword"`
+	Attributes   *[]*string `json:"attributes"`
 }
 
 // BasicProviderConfiguration contains the parameters for keeping the user and their roles hard-coded
@@ -40,9 +185,10 @@ type BasicProviderConfiguration struct {
 
 // BasicProviderUserConfiguration contains a single user definition
 type BasicProviderUserConfiguration struct {
-	UserName *string    `json:"userName"`
-	Password *string    `json:"password"`
-	Roles    *[]*string `json:"roles"`
+	UserName   *string             `json:"userName"`
+	Password   *string             `json:"password"`
+	Roles      *[]*string          `json:"roles"`
+	Attributes *map[string]*string `json:"attributes"`
 }
 
 // ValidateConfiguration validates the configuration file
@@ -74,6 +220,20 @@ func ValidateConfiguration(configuration *Configuration) error {
 		}
 	}
 
+	if configuration.Clients != nil {
+		err = validateClientsConfiguration(*configuration.Clients)
+		if err != nil {
+			return err
+		}
+	}
+
+	if configuration.Audit != nil {
+		err = validateAuditConfiguration(configuration.Audit)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -86,10 +246,6 @@ func validateSsoConfiguration(configuration *SsoConfiguration) error {
 	}
 
 	// Basic tests
-	if configuration.PrivateKeyPath == nil {
-		log.Error("Configuration for SSO is missing the definition for privateKeyPath attribute")
-		return common.ErrBadConfiguration
-	}
 	if configuration.TokenSecondsToLive == nil {
 		log.Error("Configuration for SSO is missing the definition for tokenSecondsToLive attribute")
 		return common.ErrBadConfiguration
@@ -124,9 +280,8 @@ func validateSsoConfiguration(configuration *SsoConfiguration) error {
 	}
 
 	// More advanced test
-	if _, err := os.Stat(*configuration.PrivateKeyPath); os.IsNotExist(err) {
-		log.Error("Configuration for SSO, attribute tokenCertificate is referencing a not existing file")
-		return common.ErrBadConfiguration
+	if err := validateSigningKeysConfiguration(configuration); err != nil {
+		return err
 	}
 	if *configuration.TokenSecondsToLive < 0 {
 		log.Error("Configuration for SSO, attribute tokenSecondsToLive can not be less than 0")
@@ -140,10 +295,592 @@ func validateSsoConfiguration(configuration *SsoConfiguration) error {
 		log.Error("Configuration for SSO, attribute refreshSecondsToLive can not be less than tokenSecondsToLive")
 		return common.ErrBadConfiguration
 	}
+	if (configuration.ExchangeSecondsToLive != nil) && (*configuration.ExchangeSecondsToLive <= 0) {
+		log.Error("Configuration for SSO, attribute exchangeSecondsToLive must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.Issuer != nil) && (len(*configuration.Issuer) == 0) {
+		log.Error("Configuration for SSO, attribute issuer can not be empty")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.ProviderPolicy != nil) && !containsString(providerPolicies, *configuration.ProviderPolicy) {
+		log.Error("Configuration for SSO, attribute providerPolicy can only be \"firstMatch\", \"mergeAll\" or \"primary\"")
+		return common.ErrBadConfiguration
+	}
+	if configuration.RefreshTokenStore != nil {
+		if (*configuration.RefreshTokenStore != "memory") && (*configuration.RefreshTokenStore != "file") {
+			log.Error("Configuration for SSO, attribute refreshTokenStore can only be \"memory\" or \"file\"")
+			return common.ErrBadConfiguration
+		}
+		if (*configuration.RefreshTokenStore == "file") && (configuration.RefreshTokenStorePath == nil) {
+			log.Error("Configuration for SSO, attribute refreshTokenStore is set to \"file\" but refreshTokenStorePath is missing")
+			return common.ErrBadConfiguration
+		}
+	}
+	if (configuration.RefreshSweepSeconds != nil) && (*configuration.RefreshSweepSeconds <= 0) {
+		log.Error("Configuration for SSO, attribute refreshSweepSeconds must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.MaxRefreshTokens != nil) && (*configuration.MaxRefreshTokens < 0) {
+		log.Error("Configuration for SSO, attribute maxRefreshTokens can not be less than 0")
+		return common.ErrBadConfiguration
+	}
+	if configuration.RefreshEvictionPolicy != nil {
+		if (*configuration.RefreshEvictionPolicy != "oldest") && (*configuration.RefreshEvictionPolicy != "reject") {
+			log.Error("Configuration for SSO, attribute refreshEvictionPolicy can only be \"oldest\" or \"reject\"")
+			return common.ErrBadConfiguration
+		}
+	}
+	if configuration.Audiences != nil {
+		if err := validateAudiencesConfiguration(*configuration.Audiences); err != nil {
+			return err
+		}
+	}
+	if configuration.Scopes != nil {
+		if err := validateScopesConfiguration(*configuration.Scopes); err != nil {
+			return err
+		}
+	}
+	if configuration.ClaimMappings != nil {
+		if err := validateClaimMappingsConfiguration(*configuration.ClaimMappings); err != nil {
+			return err
+		}
+	}
+	if configuration.TrustedProxies != nil {
+		if err := validateTrustedProxiesConfiguration(*configuration.TrustedProxies); err != nil {
+			return err
+		}
+	}
+	if configuration.Lockout != nil {
+		if err := validateLockoutConfiguration(configuration.Lockout); err != nil {
+			return err
+		}
+	}
+	if configuration.RoleMapping != nil {
+		if err := validateRoleMappingConfiguration(configuration.RoleMapping); err != nil {
+			return err
+		}
+	}
+	if configuration.RoleHierarchy != nil {
+		if err := validateRoleHierarchyConfiguration(configuration.RoleHierarchy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateLockoutConfiguration checks the limits of the failed authentications
+func validateLockoutConfiguration(configuration *LockoutConfiguration) error {
+
+	if (configuration.MaxFailures != nil) && (*configuration.MaxFailures <= 0) {
+		log.Error("Configuration for SSO, attribute maxFailures of lockout must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.WindowSeconds != nil) && (*configuration.WindowSeconds <= 0) {
+		log.Error("Configuration for SSO, attribute windowSeconds of lockout must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.LockoutSeconds != nil) && (*configuration.LockoutSeconds <= 0) {
+		log.Error("Configuration for SSO, attribute lockoutSeconds of lockout must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.MaxLockoutSeconds != nil) && (*configuration.MaxLockoutSeconds <= 0) {
+		log.Error("Configuration for SSO, attribute maxLockoutSeconds of lockout must be greater than 0")
+		return common.ErrBadConfiguration
+	}
+
+	// Compare with the default values if not given
+	lockoutSeconds := int64(60)
+	if configuration.LockoutSeconds != nil {
+		lockoutSeconds = *configuration.LockoutSeconds
+	}
+	maxLockoutSeconds := int64(3600)
+	if configuration.MaxLockoutSeconds != nil {
+		maxLockoutSeconds = *configuration.MaxLockoutSeconds
+	}
+	if maxLockoutSeconds < lockoutSeconds {
+		log.Error("Configuration for SSO, attribute maxLockoutSeconds of lockout can not be less than lockoutSeconds")
+		return common.ErrBadConfiguration
+	}
+
+	if (configuration.ByUser != nil) && (configuration.ByAddress != nil) && !*configuration.ByUser && !*configuration.ByAddress {
+		log.Error("Configuration for SSO, lockout must be done at least by user or by address")
+		return common.ErrBadConfiguration
+	}
+
+	return nil
+}
+
+// validateRoleMappingConfiguration checks the tables of the role mapping
+func validateRoleMappingConfiguration(configuration *RoleMappingConfiguration) error {
+
+	if err := validateRoleMappingTableConfiguration("roleMapping", configuration.RoleMappingTableConfiguration); err != nil {
+		return err
+	}
+
+	if configuration.Providers != nil {
+		for provider, table := range *configuration.Providers {
+			if (provider != "basic") && (provider != "ldap") {
+				log.Error("Configuration for SSO, attribute providers of roleMapping can only have the providers \"basic\" and \"ldap\"")
+				return common.ErrBadConfiguration
+			}
+			if table == nil {
+				log.Error("Configuration for SSO, the table of roleMapping for the provider ", provider, " is empty")
+				return common.ErrBadConfiguration
+			}
+			if err := validateRoleMappingTableConfiguration("roleMapping of the provider "+provider, *table); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRoleMappingTableConfiguration checks the rules of a table of the role mapping
+func validateRoleMappingTableConfiguration(tableName string, configuration RoleMappingTableConfiguration) error {
+
+	if configuration.Rules != nil {
+		for _, rule := range *configuration.Rules {
+			if (rule == nil) || (rule.Group == nil) || (len(*rule.Group) == 0) {
+				log.Error("Configuration for SSO, the rules of ", tableName, " have an entry without group")
+				return common.ErrBadConfiguration
+			}
+			match := roleMatchExact
+			if rule.Match != nil {
+				match = *rule.Match
+			}
+			if !containsString(roleMatches, match) {
+				log.Error("Configuration for SSO, the match of the rules of ", tableName, " can only be one of ", strings.Join(roleMatches, ", "))
+				return common.ErrBadConfiguration
+			}
+			if (match != roleMatchPrefix) && ((rule.Role == nil) || (len(*rule.Role) == 0)) {
+				log.Error("Configuration for SSO, the rule of ", tableName, " for the group ", *rule.Group, " is missing the role")
+				return common.ErrBadConfiguration
+			}
+			if (rule.Role != nil) && (len(*rule.Role) == 0) {
+				log.Error("Configuration for SSO, the rule of ", tableName, " for the group ", *rule.Group, " has an empty role")
+				return common.ErrBadConfiguration
+			}
+			if match == roleMatchRegex {
+				if _, err := regexp.Compile("^(?:" + *rule.Group + ")$"); err != nil {
+					log.Error("Configuration for SSO, the rule of ", tableName, " has the invalid regular expression ", *rule.Group)
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+	}
+
+	if configuration.DefaultRoles != nil {
+		for _, role := range *configuration.DefaultRoles {
+			if (role == nil) || (len(*role) == 0) {
+				log.Error("Configuration for SSO, the defaultRoles of ", tableName, " have an empty entry")
+				return common.ErrBadConfiguration
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRoleHierarchyConfiguration checks the role hierarchy, that can not have a cycle
+func validateRoleHierarchyConfiguration(configuration *RoleHierarchyConfiguration) error {
+
+	if configuration.Roles == nil {
+		log.Error("Configuration for SSO, roleHierarchy is missing the definition for roles attribute")
+		return common.ErrBadConfiguration
+	}
+
+	impliedRoles := make(map[string][]string)
+	for role, roleImpliedRoles := range *configuration.Roles {
+		if len(role) == 0 {
+			log.Error("Configuration for SSO, the roles of roleHierarchy have an empty role")
+			return common.ErrBadConfiguration
+		}
+		if roleImpliedRoles == nil {
+			log.Error("Configuration for SSO, the role ", role, " of roleHierarchy is missing its implied roles")
+			return common.ErrBadConfiguration
+		}
+		impliedRoles[role] = make([]string, 0, len(*roleImpliedRoles))
+		for _, impliedRole := range *roleImpliedRoles {
+			if (impliedRole == nil) || (len(*impliedRole) == 0) {
+				log.Error("Configuration for SSO, the role ", role, " of roleHierarchy has an empty implied role")
+				return common.ErrBadConfiguration
+			}
+			impliedRoles[role] = append(impliedRoles[role], *impliedRole)
+		}
+	}
+
+	if cycle := findRoleHierarchyCycle(impliedRoles); cycle != nil {
+		log.Error("Configuration for SSO, roleHierarchy has the cycle ", strings.Join(cycle, " -> "))
+		return common.ErrBadConfiguration
+	}
+
+	if configuration.TokenRoles != nil {
+		if (*configuration.TokenRoles != tokenRolesExpanded) && (*configuration.TokenRoles != tokenRolesTopLevel) {
+			log.Error("Configuration for SSO, attribute tokenRoles of roleHierarchy can only be \"expanded\" or \"topLevel\"")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	return nil
+}
+
+// validateSigningKeysConfiguration checks the definition of the keys used for signing the tokens
+func validateSigningKeysConfiguration(configuration *SsoConfiguration) error {
+
+	if (configuration.PrivateKeyPath == nil) && (configuration.SigningKeys == nil) && (configuration.KeyRotation == nil) {
+		log.Error("Configuration for SSO is missing the definition for privateKeyPath, signingKeys or keyRotation attribute")
+		return common.ErrBadConfiguration
+	}
+	if (configuration.PrivateKeyPath != nil) && (configuration.SigningKeys != nil) {
+		log.Error("Configuration for SSO, attributes privateKeyPath and signingKeys can not be both defined")
+		return common.ErrBadConfiguration
+	}
+
+	if configuration.SigningAlgorithm != nil {
+		supported := false
+		for _, algorithm := range supportedSigningAlgorithms {
+			supported = supported || (*configuration.SigningAlgorithm == algorithm)
+		}
+		if !supported {
+			log.Error("Configuration for SSO, attribute signingAlgorithm can only be one of ", strings.Join(supportedSigningAlgorithms, ", "))
+			return common.ErrBadConfiguration
+		}
+	}
+
+	if configuration.PrivateKeyPath != nil {
+		if _, err := os.Stat(*configuration.PrivateKeyPath); os.IsNotExist(err) {
+			log.Error("Configuration for SSO, attribute privateKeyPath is referencing a not existing file")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	if configuration.SigningKeys != nil {
+		activeKeys := 0
+		for _, signingKey := range *configuration.SigningKeys {
+			if (signingKey == nil) || (signingKey.PrivateKeyPath == nil) {
+				log.Error("Configuration for SSO, attribute signingKeys has an entry without privateKeyPath")
+				return common.ErrBadConfiguration
+			}
+			if _, err := os.Stat(*signingKey.PrivateKeyPath); os.IsNotExist(err) {
+				log.Error("Configuration for SSO, attribute signingKeys is referencing a not existing file")
+				return common.ErrBadConfiguration
+			}
+			if (signingKey.Active != nil) && *signingKey.Active {
+				activeKeys++
+			}
+		}
+		if (configuration.KeyRotation == nil) && (activeKeys != 1) {
+			log.Error("Configuration for SSO, attribute signingKeys must have exactly one active key")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.KeyRotation != nil) && (activeKeys != 0) {
+			log.Error("Configuration for SSO, attribute signingKeys can not have an active key when keyRotation is defined")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	if configuration.KeyRotation != nil {
+		if (configuration.KeyRotation.SecondsInterval == nil) || (*configuration.KeyRotation.SecondsInterval <= 0) {
+			log.Error("Configuration for SSO, attribute keyRotation must have a secondsInterval greater than 0")
+			return common.ErrBadConfiguration
+		}
+		if configuration.KeyRotation.KeyDirectory == nil {
+			log.Error("Configuration for SSO, attribute keyRotation is missing the definition for keyDirectory attribute")
+			return common.ErrBadConfiguration
+		}
+		if info, err := os.Stat(*configuration.KeyRotation.KeyDirectory); err != nil || !info.IsDir() {
+			log.Error("Configuration for SSO, attribute keyRotation is referencing a not existing keyDirectory")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	return nil
+}
+
+// validateAudiencesConfiguration checks the audiences that can be requested by the clients not registered
+func validateAudiencesConfiguration(audiences []*string) error {
+
+	for _, audience := range audiences {
+		if (audience == nil) || (len(*audience) == 0) {
+			log.Error("Configuration for SSO, attribute audiences has an empty entry")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	return nil
+}
+
+// validateTrustedProxiesConfiguration checks the addresses and the networks of the trusted proxies
+func validateTrustedProxiesConfiguration(trustedProxies []*string) error {
+
+	for _, trustedProxy := range trustedProxies {
+		if trustedProxy == nil {
+			log.Error("Configuration for SSO, attribute trustedProxies has an empty entry")
+			return common.ErrBadConfiguration
+		}
+		if _, err := parseTrustedProxy(*trustedProxy); err != nil {
+			log.Error("Configuration for SSO, attribute trustedProxies has an invalid address or network ", *trustedProxy)
+			return common.ErrBadConfiguration
+		}
+	}
+
+	return nil
+}
+
+// validateScopesConfiguration checks the scopes that can be requested for the tokens
+func validateScopesConfiguration(scopes []*ScopeConfiguration) error {
+
+	scopeNames := make(map[string]bool)
+	for _, scope := range scopes {
+		// The name of a scope can not have a space, as the scopes are given separated by spaces
+		if (scope == nil) || (scope.Name == nil) || (len(*scope.Name) == 0) || strings.ContainsAny(*scope.Name, " \"") {
+			log.Error("Configuration for SSO, attribute scopes has an entry without a valid name")
+			return common.ErrBadConfiguration
+		}
+		if scopeNames[*scope.Name] {
+			log.Error("Configuration for SSO, attribute scopes has the scope ", *scope.Name, " defined twice")
+			return common.ErrBadConfiguration
+		}
+		scopeNames[*scope.Name] = true
+		if scope.Roles != nil {
+			for _, role := range *scope.Roles {
+				if role == nil {
+					log.Error("Configuration for SSO, the scope ", *scope.Name, " has an empty roles entry")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateClaimMappingsConfiguration checks the mappings of the attributes of the users to the claims of the tokens
+func validateClaimMappingsConfiguration(mappings []*ClaimMappingConfiguration) error {
+
+	claims := make(map[string]bool)
+	for _, mapping := range mappings {
+		if (mapping == nil) || (mapping.Attribute == nil) || (len(*mapping.Attribute) == 0) {
+			log.Error("Configuration for SSO, attribute claimMappings has an entry without attribute")
+			return common.ErrBadConfiguration
+		}
+		if (mapping.Claim == nil) || (len(*mapping.Claim) == 0) {
+			log.Error("Configuration for SSO, attribute claimMappings has an entry without claim")
+			return common.ErrBadConfiguration
+		}
+		// The claims of the tokens can not be replaced
+		if containsString(protocol.ReservedClaimNames, *mapping.Claim) {
+			log.Error("Configuration for SSO, attribute claimMappings can not use the claims ", strings.Join(protocol.ReservedClaimNames, ", "))
+			return common.ErrBadConfiguration
+		}
+		if claims[*mapping.Claim] {
+			log.Error("Configuration for SSO, attribute claimMappings has the claim ", *mapping.Claim, " defined twice")
+			return common.ErrBadConfiguration
+		}
+		claims[*mapping.Claim] = true
+	}
+
+	return nil
+}
+
+// validateClientsConfiguration checks the definition of the registered clients
+func validateClientsConfiguration(clients []*ClientConfiguration) error {
+
+	clientIds := make(map[string]bool)
+	for _, client := range clients {
+
+		if (client == nil) || (client.ClientId == nil) || (len(*client.ClientId) == 0) {
+			log.Error("Configuration for clients has an entry without clientId")
+			return common.ErrBadConfiguration
+		}
+		if clientIds[*client.ClientId] {
+			log.Error("Configuration for clients has the clientId ", *client.ClientId, " defined twice")
+			return common.ErrBadConfiguration
+		}
+		clientIds[*client.ClientId] = true
+
+		if client.RedirectURIs != nil {
+			for _, redirectURI := range *client.RedirectURIs {
+				// The redirection URI must be absolute and without fragment (RFC 6749, section 3.1.2)
+				if redirectURI == nil {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty redirectUris entry")
+					return common.ErrBadConfiguration
+				}
+				parsedURI, err := url.Parse(*redirectURI)
+				if err != nil || !parsedURI.IsAbs() || len(parsedURI.Host) == 0 || len(parsedURI.Fragment) != 0 {
+					log.Error("Configuration for the client ", *client.ClientId, ", the redirect URI ", *redirectURI, " must be an absolute URI without fragment")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.Secrets != nil {
+			for _, secret := range *client.Secrets {
+				if secret == nil {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty secrets entry")
+					return common.ErrBadConfiguration
+				}
+				if _, err := bcrypt.Cost([]byte(*secret)); err != nil {
+					log.Error("Configuration for the client ", *client.ClientId, ", the secrets must be bcrypt hashes")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.Roles != nil {
+			for _, role := range *client.Roles {
+				if role == nil {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty roles entry")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if (client.TokenSecondsToLive != nil) && (*client.TokenSecondsToLive <= 0) {
+			log.Error("Configuration for the client ", *client.ClientId, ", attribute tokenSecondsToLive must be greater than 0")
+			return common.ErrBadConfiguration
+		}
+		if (client.RefreshSecondsToLive != nil) && (*client.RefreshSecondsToLive <= 0) {
+			log.Error("Configuration for the client ", *client.ClientId, ", attribute refreshSecondsToLive must be greater than 0")
+			return common.ErrBadConfiguration
+		}
+		if (client.TokenSecondsToLive != nil) && (client.RefreshSecondsToLive != nil) && (*client.RefreshSecondsToLive <= *client.TokenSecondsToLive) {
+			log.Error("Configuration for the client ", *client.ClientId, ", attribute refreshSecondsToLive can not be less than tokenSecondsToLive")
+			return common.ErrBadConfiguration
+		}
+
+		if client.AllowedEndpoints != nil {
+			for _, endpoint := range *client.AllowedEndpoints {
+				if (endpoint == nil) || !containsString(clientEndpoints, *endpoint) {
+					log.Error("Configuration for the client ", *client.ClientId, ", attribute allowedEndpoints can only have the values ", strings.Join(clientEndpoints, ", "))
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.AllowedGrants != nil {
+			for _, grant := range *client.AllowedGrants {
+				if (grant == nil) || !containsString(clientGrants, *grant) {
+					log.Error("Configuration for the client ", *client.ClientId, ", attribute allowedGrants can only have the values ", strings.Join(clientGrants, ", "))
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.AllowedAudiences != nil {
+			for _, audience := range *client.AllowedAudiences {
+				if (audience == nil) || (len(*audience) == 0) {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty allowedAudiences entry")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.AllowedScopes != nil {
+			for _, scope := range *client.AllowedScopes {
+				if (scope == nil) || (len(*scope) == 0) {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty allowedScopes entry")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+
+		if client.ExchangeAudiences != nil {
+			for _, audience := range *client.ExchangeAudiences {
+				if (audience == nil) || (len(*audience) == 0) {
+					log.Error("Configuration for the client ", *client.ClientId, " has an empty exchangeAudiences entry")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+	}
 
 	return nil
 }
 
+// validateAuditConfiguration checks the definition of the sinks of the audit events
+func validateAuditConfiguration(configuration *AuditConfiguration) error {
+
+	if configuration.File != nil {
+		if configuration.File.Path == nil || len(*configuration.File.Path) == 0 {
+			log.Error("Configuration for audit, the file sink is missing the definition for path attribute")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.File.MaxSizeBytes != nil) && (*configuration.File.MaxSizeBytes <= 0) {
+			log.Error("Configuration for audit, attribute maxSizeBytes of the file sink must be greater than 0")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.File.MaxBackups != nil) && (*configuration.File.MaxBackups < 0) {
+			log.Error("Configuration for audit, attribute maxBackups of the file sink can not be less than 0")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	if configuration.Syslog != nil {
+		if (configuration.Syslog.SocketPath != nil) && (len(*configuration.Syslog.SocketPath) == 0) {
+			log.Error("Configuration for audit, attribute socketPath of the syslog sink can not be empty")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.Syslog.AppName != nil) && !isPrintableASCII(*configuration.Syslog.AppName, 48) {
+			log.Error("Configuration for audit, attribute appName of the syslog sink must be 1 to 48 printable ASCII characters")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.Syslog.Facility != nil) && ((*configuration.Syslog.Facility < 0) || (*configuration.Syslog.Facility > 23)) {
+			log.Error("Configuration for audit, attribute facility of the syslog sink must be between 0 and 23")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	if configuration.Webhook != nil {
+		if configuration.Webhook.URL == nil {
+			log.Error("Configuration for audit, the webhook sink is missing the definition for url attribute")
+			return common.ErrBadConfiguration
+		}
+		webhookURL, err := url.Parse(*configuration.Webhook.URL)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || len(webhookURL.Host) == 0 {
+			log.Error("Configuration for audit, attribute url of the webhook sink must be an absolute http or https URL")
+			return common.ErrBadConfiguration
+		}
+		if configuration.Webhook.Headers != nil {
+			for name, value := range *configuration.Webhook.Headers {
+				if len(name) == 0 || value == nil {
+					log.Error("Configuration for audit, the headers of the webhook sink must have a name and a value")
+					return common.ErrBadConfiguration
+				}
+			}
+		}
+		if (configuration.Webhook.TimeoutSeconds != nil) && (*configuration.Webhook.TimeoutSeconds <= 0) {
+			log.Error("Configuration for audit, attribute timeoutSeconds of the webhook sink must be greater than 0")
+			return common.ErrBadConfiguration
+		}
+		if (configuration.Webhook.QueueSize != nil) && (*configuration.Webhook.QueueSize <= 0) {
+			log.Error("Configuration for audit, attribute queueSize of the webhook sink must be greater than 0")
+			return common.ErrBadConfiguration
+		}
+	}
+
+	return nil
+}
+
+// isPrintableASCII returns true if the given value has between 1 and maxLength printable ASCII characters, without
+// space
+func isPrintableASCII(value string, maxLength int) bool {
+
+	if len(value) == 0 || len(value) > maxLength {
+		return false
+	}
+	for _, character := range value {
+		if character < 33 || character > 126 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func validateLdapConfiguration(configuration *LdapProviderConfiguration) error {
 
 	if configuration == nil {
@@ -181,6 +918,15 @@ func validateLdapConfiguration(configuration *LdapProviderConfiguration) error {
 		return common.ErrBadConfiguration
 	}
 
+	if configuration.Attributes != nil {
+		for _, attribute := range *configuration.Attributes {
+			if (attribute == nil) || (len(*attribute) == 0) {
+				log.Error("Configuration for LDAP, attribute attributes has an empty entry")
+				return common.ErrBadConfiguration
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The user known by the basic provider of the test configuration
+const (
+	testUserName = "alice"
+	testPassword = "alice-password"
+)
+
+// testClientSecret is the secret of the clients registered by newTestClientConfiguration
+const testClientSecret = "client-secret"
+
+func stringPointer(value string) *string {
+	return &value
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+// newTestConfiguration returns a valid configuration using a basic provider that knows testUserName. The key
+// signing the tokens is generated in a temporary directory.
+func newTestConfiguration(t *testing.T) *Configuration {
+
+	keyDirectory := t.TempDir()
+
+	return &Configuration{
+		Sso: &SsoConfiguration{
+			TokenSecondsToLive:   int64Pointer(300),
+			RefreshSecondsToLive: int64Pointer(3600),
+			Providers:            &[]*string{stringPointer("basic")},
+			SigningAlgorithm:     stringPointer("ES256"),
+			KeyRotation: &KeyRotationConfiguration{
+				SecondsInterval: int64Pointer(3600),
+				KeyDirectory:    &keyDirectory,
+			},
+		},
+		Basic: &BasicProviderConfiguration{
+			Users: &[]*BasicProviderUserConfiguration{
+				{
+					UserName: stringPointer(testUserName),
+					Password: stringPointer(testPassword),
+					Roles:    &[]*string{stringPointer("user")},
+				},
+			},
+		},
+	}
+}
+
+// newTestClientConfiguration returns a registered client with the given id, authenticating with testClientSecret
+func newTestClientConfiguration(t *testing.T, clientId string) *ClientConfiguration {
+
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(testClientSecret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Unable to hash the secret of the client: ", err)
+	}
+
+	return &ClientConfiguration{
+		ClientId: stringPointer(clientId),
+		Secrets:  &[]*string{stringPointer(string(secretHash))},
+	}
+}
+
+// newTestConfigurationWithClients returns the test configuration with the given registered clients
+func newTestConfigurationWithClients(t *testing.T, clientIds ...string) *Configuration {
+
+	configuration := newTestConfiguration(t)
+	clients := make([]*ClientConfiguration, 0, len(clientIds))
+	for _, clientId := range clientIds {
+		clients = append(clients, newTestClientConfiguration(t, clientId))
+	}
+	configuration.Clients = &clients
+
+	return configuration
+}
+
+// newTestEngine validates the given configuration and builds an engine with it
+func newTestEngine(t *testing.T, configuration *Configuration) ssoEngine {
+
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal("The test configuration is not valid: ", err)
+	}
+
+	engine, err := newSsoEngine(configuration)
+	if err != nil {
+		t.Fatal("Unable to build the engine: ", err)
+	}
+
+	return engine
+}
+
+// newTestServer builds a server without audit sink for the given configuration. The configuration can be
+// reloaded, the new engine being built from the same configuration.
+func newTestServer(t *testing.T, configuration *Configuration) *authServerImpl {
+
+	audit, err := newAuditLogger(nil)
+	if err != nil {
+		t.Fatal("Unable to build the audit logger: ", err)
+	}
+
+	return newAuthServer(
+		newAuthServerState(newTestEngine(t, configuration), *configuration),
+		buildReloadConfigurationFunction(func() (*Configuration, error) { return configuration, nil }),
+		audit)
+}
+
+// enrollTestUser authenticates testUserName with the given engine and returns its access token and refresh token
+func enrollTestUser(t *testing.T, engine ssoEngine, grant tokenGrant) (string, string) {
+
+	user, err := engine.Authenticate(testUserName, testPassword, "")
+	if err != nil {
+		t.Fatal("Unable to authenticate the test user: ", err)
+	}
+
+	response, err := engine.Enroll(user, grant)
+	if err != nil {
+		t.Fatal("Unable to enroll the test user: ", err)
+	}
+
+	return response.AccessToken, response.RefreshToken
+}
+
+// readTestTokenClaims returns the claims of the given token, without checking its signature
+func readTestTokenClaims(t *testing.T, token string) map[string]interface{} {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("The token is malformed: ", token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal("Unable to decode the token: ", err)
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal("Unable to read the claims of the token: ", err)
+	}
+
+	return claims
+}
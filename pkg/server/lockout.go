@@ -0,0 +1,386 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// lockoutError is returned when an authentication is refused without being tried, because of too many failed
+// authentications for the user or from the address
+type lockoutError struct {
+	// The number of seconds before the authentication can be tried again
+	retryAfter int64
+}
+
+func (err *lockoutError) Error() string {
+	return "too many failed authentications"
+}
+
+// lockoutPolicy holds the limits of the failed authentications. The failures are counted in a sliding window
+// and reaching the maximum locks the user or the address. Each new lock of the same user or address lasts twice
+// as long as the previous one, up to a maximum.
+type lockoutPolicy struct {
+	maxFailures       int
+	windowSeconds     int64
+	lockoutSeconds    int64
+	maxLockoutSeconds int64
+	byUser            bool
+	byAddress         bool
+}
+
+// authenticationFailures holds the failed authentications of a single user or address
+type authenticationFailures struct {
+	// The time of the failures in the window, oldest first
+	failures []int64
+	// The number of consecutive locks, for computing the duration of the next one
+	lockouts int
+	// The end of the current lock, 0 if never locked
+	lockedUntil int64
+	// The time of the last failure
+	lastFailure int64
+	// The number of authentications reserved and not ended yet
+	inProgress int
+}
+
+// authenticationFailureStore holds the failed authentications by user and by address. The failures are only kept
+// in memory, but the store is shared by the engines created when the configuration is reloaded.
+type authenticationFailureStore struct {
+	users     map[string]*authenticationFailures
+	addresses map[string]*authenticationFailures
+	mutex     sync.Mutex
+}
+
+// newLockoutPolicy returns the policy defined in the configuration, or nil if the authentications are not limited
+func newLockoutPolicy(configuration SsoConfiguration) *lockoutPolicy {
+
+	if configuration.Lockout == nil {
+		return nil
+	}
+
+	policy := &lockoutPolicy{
+		maxFailures:       5,
+		windowSeconds:     300,
+		lockoutSeconds:    60,
+		maxLockoutSeconds: 3600,
+		byUser:            true,
+		byAddress:         true,
+	}
+	if configuration.Lockout.MaxFailures != nil {
+		policy.maxFailures = *configuration.Lockout.MaxFailures
+	}
+	if configuration.Lockout.WindowSeconds != nil {
+		policy.windowSeconds = *configuration.Lockout.WindowSeconds
+	}
+	if configuration.Lockout.LockoutSeconds != nil {
+		policy.lockoutSeconds = *configuration.Lockout.LockoutSeconds
+	}
+	if configuration.Lockout.MaxLockoutSeconds != nil {
+		policy.maxLockoutSeconds = *configuration.Lockout.MaxLockoutSeconds
+	}
+	if configuration.Lockout.ByUser != nil {
+		policy.byUser = *configuration.Lockout.ByUser
+	}
+	if configuration.Lockout.ByAddress != nil {
+		policy.byAddress = *configuration.Lockout.ByAddress
+	}
+
+	return policy
+}
+
+// TryBegin reserves an authentication of the user from the address and returns 0, or returns the number of seconds
+// before the authentication can be tried if it can not be tried now. The authentications in progress are counted as
+// failures until they end, so that concurrent attempts can not exceed the maximum of failures in the window. A
+// reserved authentication must be ended with AddFailure, AddSuccess or Cancel.
+func (store *authenticationFailureStore) TryBegin(policy *lockoutPolicy, userName string, remoteAddress string) int64 {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().Unix()
+	entries := store.getFailures(policy, userName, remoteAddress, true)
+
+	retryAfter := int64(0)
+	for _, failures := range entries {
+		if failures.lockedUntil-now > retryAfter {
+			retryAfter = failures.lockedUntil - now
+		}
+		// The attempts in progress may all fail: the next one can only be tried once some of them ended
+		if (retryAfter == 0) && (failures.countFailures(policy, now)+failures.inProgress >= policy.maxFailures) {
+			retryAfter = 1
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	for _, failures := range entries {
+		failures.inProgress++
+	}
+
+	return 0
+}
+
+// AddFailure ends an authentication reserved with TryBegin that failed because of invalid credentials, locking
+// the user and the address if the maximum of failures in the window is reached
+func (store *authenticationFailureStore) AddFailure(policy *lockoutPolicy, userName string, remoteAddress string) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for _, failures := range store.getFailures(policy, userName, remoteAddress, true) {
+
+		failures.end()
+
+		// Forget the locks once a full lock duration passed without failure
+		if (failures.lockouts > 0) && (failures.lastFailure+policy.maxLockoutSeconds < now) {
+			failures.lockouts = 0
+		}
+		failures.lastFailure = now
+
+		// Keep only the failures in the window
+		kept := failures.failures[:0]
+		for _, failure := range failures.failures {
+			if failure > now-policy.windowSeconds {
+				kept = append(kept, failure)
+			}
+		}
+		failures.failures = append(kept, now)
+
+		if len(failures.failures) >= policy.maxFailures {
+			lockoutSeconds := policy.lockoutSeconds
+			for i := 0; (i < failures.lockouts) && (lockoutSeconds < policy.maxLockoutSeconds); i++ {
+				lockoutSeconds *= 2
+			}
+			if lockoutSeconds > policy.maxLockoutSeconds {
+				lockoutSeconds = policy.maxLockoutSeconds
+			}
+			failures.lockouts++
+			failures.lockedUntil = now + lockoutSeconds
+			failures.failures = nil
+		}
+	}
+}
+
+// AddSuccess ends an authentication reserved with TryBegin that succeeded, forgetting the failures of the user. The
+// failures from the address are kept, so that an attacker can not clear them with its own account.
+func (store *authenticationFailureStore) AddSuccess(policy *lockoutPolicy, userName string, remoteAddress string) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, failures := range store.getFailures(policy, userName, remoteAddress, false) {
+		failures.end()
+	}
+
+	// The entry is kept while other authentications of the user are in progress
+	userName = strings.ToLower(userName)
+	if failures, ok := store.users[userName]; ok {
+		if failures.inProgress > 0 {
+			store.users[userName] = &authenticationFailures{inProgress: failures.inProgress}
+		} else {
+			delete(store.users, userName)
+		}
+	}
+
+	store.forgetUnused(policy, userName, remoteAddress)
+}
+
+// Cancel ends an authentication reserved with TryBegin that could not be done, for example because a provider could
+// not be reached. As the credentials were not verified, no failure is recorded.
+func (store *authenticationFailureStore) Cancel(policy *lockoutPolicy, userName string, remoteAddress string) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, failures := range store.getFailures(policy, userName, remoteAddress, false) {
+		failures.end()
+	}
+
+	store.forgetUnused(policy, userName, remoteAddress)
+}
+
+// forgetUnused removes the entries of the user and of the address that have nothing to remember once their
+// authentications ended, so that only the users and the addresses with failures are kept until they are swept. The
+// caller must hold the mutex.
+func (store *authenticationFailureStore) forgetUnused(policy *lockoutPolicy, userName string, remoteAddress string) {
+
+	now := time.Now().Unix()
+	forget := func(entries map[string]*authenticationFailures, key string) {
+		if failures, ok := entries[key]; ok && failures.isUnused(now) {
+			delete(entries, key)
+		}
+	}
+
+	if policy.byUser && len(userName) > 0 {
+		forget(store.users, strings.ToLower(userName))
+	}
+	if policy.byAddress && len(remoteAddress) > 0 {
+		forget(store.addresses, remoteAddress)
+	}
+}
+
+// Unlock forgets the failures of the given user and of the given address (any of them can be empty) and returns
+// the number of them that were locked
+func (store *authenticationFailureStore) Unlock(userName string, remoteAddress string) int {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().Unix()
+	unlocked := 0
+	if len(userName) > 0 {
+		userName = strings.ToLower(userName)
+		if failures, ok := store.users[userName]; ok && failures.lockedUntil > now {
+			unlocked++
+		}
+		delete(store.users, userName)
+	}
+	if len(remoteAddress) > 0 {
+		if failures, ok := store.addresses[remoteAddress]; ok && failures.lockedUntil > now {
+			unlocked++
+		}
+		delete(store.addresses, remoteAddress)
+	}
+
+	return unlocked
+}
+
+// GetLockouts returns the users and the addresses currently locked, sorted by the end of their lock
+func (store *authenticationFailureStore) GetLockouts() []*protocol.Lockout {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().Unix()
+	lockouts := make([]*protocol.Lockout, 0)
+	for userName, failures := range store.users {
+		if failures.lockedUntil > now {
+			lockouts = append(lockouts, &protocol.Lockout{UserName: userName, LockedUntil: failures.lockedUntil})
+		}
+	}
+	for remoteAddress, failures := range store.addresses {
+		if failures.lockedUntil > now {
+			lockouts = append(lockouts, &protocol.Lockout{RemoteAddress: remoteAddress, LockedUntil: failures.lockedUntil})
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].LockedUntil != lockouts[j].LockedUntil {
+			return lockouts[i].LockedUntil < lockouts[j].LockedUntil
+		}
+		return lockouts[i].UserName+lockouts[i].RemoteAddress < lockouts[j].UserName+lockouts[j].RemoteAddress
+	})
+
+	return lockouts
+}
+
+// Sweep forgets the users and the addresses that are not locked and that have no failure in the window nor lock
+// to remember, and returns the number of them removed. The locks are always kept until they end, even without
+// policy, so that they are still there if the policy is enabled again by a reload.
+func (store *authenticationFailureStore) Sweep(policy *lockoutPolicy) int {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Without policy, nothing is recorded anymore
+	now := time.Now().Unix()
+	isForgotten := func(failures *authenticationFailures) bool {
+		return (failures.lockedUntil <= now) && (failures.inProgress == 0)
+	}
+	if policy != nil {
+		isForgotten = func(failures *authenticationFailures) bool {
+			return (failures.lockedUntil <= now) &&
+				(failures.inProgress == 0) &&
+				(failures.lastFailure+policy.windowSeconds < now) &&
+				(failures.lastFailure+policy.maxLockoutSeconds < now)
+		}
+	}
+
+	swept := 0
+	for _, entries := range []map[string]*authenticationFailures{store.users, store.addresses} {
+		for key, failures := range entries {
+			if isForgotten(failures) {
+				delete(entries, key)
+				swept++
+			}
+		}
+	}
+
+	return swept
+}
+
+// countFailures returns the number of failures in the window of the policy
+func (failures *authenticationFailures) countFailures(policy *lockoutPolicy, now int64) int {
+
+	count := 0
+	for _, failure := range failures.failures {
+		if failure > now-policy.windowSeconds {
+			count++
+		}
+	}
+	return count
+}
+
+// isUnused returns true if there is no authentication in progress, no failure, no lock and no previous lock to
+// remember
+func (failures *authenticationFailures) isUnused(now int64) bool {
+
+	return (failures.inProgress == 0) &&
+		(len(failures.failures) == 0) &&
+		(failures.lockouts == 0) &&
+		(failures.lockedUntil <= now)
+}
+
+// end forgets an authentication in progress. The failures may have been forgotten meanwhile, by an unlock or a
+// success of the user.
+func (failures *authenticationFailures) end() {
+
+	if failures.inProgress > 0 {
+		failures.inProgress--
+	}
+}
+
+// getFailures returns the failures of the user and of the address that are limited by the policy, creating them
+// if asked
+func (store *authenticationFailureStore) getFailures(
+	policy *lockoutPolicy,
+	userName string,
+	remoteAddress string,
+	create bool) []*authenticationFailures {
+
+	result := make([]*authenticationFailures, 0, 2)
+
+	get := func(entries map[string]*authenticationFailures, key string) {
+		failures, ok := entries[key]
+		if !ok && create {
+			failures = &authenticationFailures{}
+			entries[key] = failures
+		}
+		if failures != nil {
+			result = append(result, failures)
+		}
+	}
+
+	// The user names are not case sensitive for most of the providers
+	if policy.byUser && len(userName) > 0 {
+		get(store.users, strings.ToLower(userName))
+	}
+	if policy.byAddress && len(remoteAddress) > 0 {
+		get(store.addresses, remoteAddress)
+	}
+
+	return result
+}
+
+func buildAuthenticationFailureStore() *authenticationFailureStore {
+
+	return &authenticationFailureStore{
+		users:     make(map[string]*authenticationFailures),
+		addresses: make(map[string]*authenticationFailures),
+	}
+}
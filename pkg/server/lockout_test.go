@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+// unreachableProvider is a provider whose server can never be reached
+type unreachableProvider struct{}
+
+var errUnreachableProvider = errors.New("the server of the provider is not reachable")
+
+func (unreachableProvider) Authenticate(string, string) (*authenticatedUser, error) {
+	return nil, errUnreachableProvider
+}
+
+func (unreachableProvider) Lookup(string) (*authenticatedUser, error) {
+	return nil, errUnreachableProvider
+}
+
+func (unreachableProvider) Name() string {
+	return "unreachable"
+}
+
+func (unreachableProvider) Instance() string {
+	return "unreachable"
+}
+
+func (unreachableProvider) CheckHealth() error {
+	return errUnreachableProvider
+}
+
+func newTestLockoutPolicy(maxFailures int) *lockoutPolicy {
+
+	return &lockoutPolicy{
+		maxFailures:       maxFailures,
+		windowSeconds:     300,
+		lockoutSeconds:    60,
+		maxLockoutSeconds: 3600,
+		byUser:            true,
+		byAddress:         true,
+	}
+}
+
+func TestConcurrentAttemptsDoNotExceedTheMaximumOfFailures(t *testing.T) {
+
+	const attempts = 20
+	policy := newTestLockoutPolicy(3)
+	store := buildAuthenticationFailureStore()
+
+	// The attempts are all reserved before any of them ends
+	var begun int32
+	var waitGroup sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			if store.TryBegin(policy, testUserName, "10.0.0.1") == 0 {
+				atomic.AddInt32(&begun, 1)
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if begun != int32(policy.maxFailures) {
+		t.Fatalf("%d attempts were begun, expected %d", begun, policy.maxFailures)
+	}
+
+	for i := int32(0); i < begun; i++ {
+		store.AddFailure(policy, testUserName, "10.0.0.1")
+	}
+
+	if retryAfter := store.TryBegin(policy, testUserName, "10.0.0.1"); retryAfter <= 1 {
+		t.Fatalf("The user should be locked after the failures, got a retry after %d seconds", retryAfter)
+	}
+	if len(store.GetLockouts()) != 2 {
+		t.Fatal("Both the user and the address should be locked")
+	}
+}
+
+func TestEndedAttemptsFreeTheirReservation(t *testing.T) {
+
+	policy := newTestLockoutPolicy(2)
+	store := buildAuthenticationFailureStore()
+
+	for i := 0; i < 10; i++ {
+		if retryAfter := store.TryBegin(policy, testUserName, "10.0.0.1"); retryAfter > 0 {
+			t.Fatalf("The attempt %d was refused for %d seconds", i, retryAfter)
+		}
+		if i%2 == 0 {
+			store.Cancel(policy, testUserName, "10.0.0.1")
+		} else {
+			store.AddSuccess(policy, testUserName, "10.0.0.1")
+		}
+	}
+
+	// Without failure, nothing is left to sweep
+	if (len(store.users) != 0) || (len(store.addresses) != 0) {
+		t.Fatal("The user and the address should have been forgotten once their authentications ended")
+	}
+}
+
+func TestOnlyTheFailuresAreKept(t *testing.T) {
+
+	policy := newTestLockoutPolicy(5)
+	store := buildAuthenticationFailureStore()
+
+	// Attempts with many unknown user names, ended without failure
+	for i := 0; i < 1000; i++ {
+		userName := "unknown-" + strconv.Itoa(i)
+		if retryAfter := store.TryBegin(policy, userName, "10.0.0.1"); retryAfter > 0 {
+			t.Fatalf("The attempt %d was refused for %d seconds", i, retryAfter)
+		}
+		store.Cancel(policy, userName, "10.0.0.1")
+	}
+	if (len(store.users) != 0) || (len(store.addresses) != 0) {
+		t.Fatalf("%d users and %d addresses are kept without failure", len(store.users), len(store.addresses))
+	}
+
+	store.TryBegin(policy, testUserName, "10.0.0.2")
+	store.AddFailure(policy, testUserName, "10.0.0.2")
+	if (len(store.users) != 1) || (len(store.addresses) != 1) {
+		t.Fatal("The user and the address of the failure should be kept")
+	}
+
+	// The success only forgets the user, the failure of the address is kept
+	store.TryBegin(policy, testUserName, "10.0.0.2")
+	store.AddSuccess(policy, testUserName, "10.0.0.2")
+	if (len(store.users) != 0) || (len(store.addresses) != 1) {
+		t.Fatalf("%d users and %d addresses are kept after the success, expected only the address", len(store.users), len(store.addresses))
+	}
+}
+
+func TestProviderErrorsAreNotCountedAsFailures(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	configuration.Sso.Lockout = &LockoutConfiguration{MaxFailures: intPointer(2)}
+	engine := newTestEngine(t, configuration)
+	engine.(*ssoEngineImpl).providers = []authenticationProvider{unreachableProvider{}}
+
+	for i := 0; i < 5; i++ {
+		if _, err := engine.Authenticate(testUserName, testPassword, "10.0.0.1"); err != errUnreachableProvider {
+			t.Fatalf("The attempt %d returned %v, expected the error of the provider", i, err)
+		}
+	}
+	if lockouts := engine.GetLockouts(); len(lockouts) != 0 {
+		t.Fatalf("%d lockouts were recorded for errors of the provider", len(lockouts))
+	}
+}
+
+func TestInvalidCredentialsAreCountedAsFailures(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	configuration.Sso.Lockout = &LockoutConfiguration{MaxFailures: intPointer(2)}
+	engine := newTestEngine(t, configuration)
+
+	for i := 0; i < 2; i++ {
+		if _, err := engine.Authenticate(testUserName, "wrong-password", "10.0.0.1"); err != common.ErrUnauthorized {
+			t.Fatalf("The attempt %d returned %v, expected an unauthorized error", i, err)
+		}
+	}
+
+	_, err := engine.Authenticate(testUserName, testPassword, "10.0.0.1")
+	if _, ok := err.(*lockoutError); !ok {
+		t.Fatalf("The authentication returned %v, expected a lockout", err)
+	}
+}
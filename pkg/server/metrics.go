@@ -0,0 +1,272 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsDurationBuckets are the upper bounds, in seconds, of the buckets of the duration histograms
+var metricsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Outcomes of the queries and of the authentications, as given in the metrics
+const (
+	metricsOutcomeSuccess = "success"
+	metricsOutcomeFailure = "failure"
+	metricsOutcomeError   = "error"
+)
+
+// serverMetrics holds the metrics of the server, written in the Prometheus text format. The metrics are shared
+// by the engines created when the configuration is reloaded.
+type serverMetrics struct {
+	requests          *counterVec
+	requestDurations  *histogramVec
+	providerDurations *histogramVec
+	signingDurations  *histogramVec
+}
+
+// counterVec holds a counter for each combination of the values of its labels
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]*counterValue
+	mutex      sync.Mutex
+}
+
+type counterValue struct {
+	labelValues []string
+	value       uint64
+}
+
+// histogramVec holds a histogram for each combination of the values of its labels
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	values     map[string]*histogramValue
+	mutex      sync.Mutex
+}
+
+type histogramValue struct {
+	labelValues []string
+	// The number of observations in each bucket (not cumulative)
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// newServerMetrics allocates the metrics of the server, all empty
+func newServerMetrics() *serverMetrics {
+
+	return &serverMetrics{
+		requests: newCounterVec(
+			"easysso_requests_total",
+			"The number of queries served, by endpoint and outcome.",
+			"endpoint", "outcome"),
+		requestDurations: newHistogramVec(
+			"easysso_request_duration_seconds",
+			"The duration of the queries, by endpoint and outcome.",
+			"endpoint", "outcome"),
+		providerDurations: newHistogramVec(
+			"easysso_provider_authentication_duration_seconds",
+			"The duration of the authentications by the providers, by provider, instance and outcome.",
+			"provider", "instance", "outcome"),
+		signingDurations: newHistogramVec(
+			"easysso_token_signing_duration_seconds",
+			"The duration of the signature of the tokens, by algorithm.",
+			"algorithm"),
+	}
+}
+
+// ObserveRequest records a query of the given endpoint. The outcome is given by the HTTP status: a success below
+// 400, a failure below 500 and an error otherwise.
+func (metrics *serverMetrics) ObserveRequest(endpoint string, status int, duration time.Duration) {
+
+	outcome := metricsOutcomeSuccess
+	if status >= 500 {
+		outcome = metricsOutcomeError
+	} else if status >= 400 {
+		outcome = metricsOutcomeFailure
+	}
+
+	metrics.requests.Inc(endpoint, outcome)
+	metrics.requestDurations.Observe(duration.Seconds(), endpoint, outcome)
+}
+
+// ObserveProviderAuthentication records an authentication by a provider
+func (metrics *serverMetrics) ObserveProviderAuthentication(provider string, instance string, outcome string, duration time.Duration) {
+	metrics.providerDurations.Observe(duration.Seconds(), provider, instance, outcome)
+}
+
+// ObserveSigning records the signature of a token
+func (metrics *serverMetrics) ObserveSigning(algorithm string, duration time.Duration) {
+	metrics.signingDurations.Observe(duration.Seconds(), algorithm)
+}
+
+// Write writes all the metrics in the Prometheus text format
+func (metrics *serverMetrics) Write(writer io.Writer) {
+
+	metrics.requests.Write(writer)
+	metrics.requestDurations.Write(writer)
+	metrics.providerDurations.Write(writer)
+	metrics.signingDurations.Write(writer)
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+}
+
+// Inc increments the counter with the given values of the labels
+func (counter *counterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add increases the counter with the given values of the labels
+func (counter *counterVec) Add(increment uint64, labelValues ...string) {
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	value, ok := counter.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		counter.values[key] = value
+	}
+	value.value += increment
+}
+
+// Write writes the counters, sorted by the values of their labels
+func (counter *counterVec) Write(writer io.Writer) {
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", counter.name, counter.help)
+	fmt.Fprintf(writer, "# TYPE %s counter\n", counter.name)
+
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := counter.values[key]
+		fmt.Fprintf(writer, "%s%s %d\n", counter.name, formatLabels(counter.labelNames, value.labelValues), value.value)
+	}
+}
+
+func newHistogramVec(name string, help string, labelNames ...string) *histogramVec {
+
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    metricsDurationBuckets,
+		values:     make(map[string]*histogramValue),
+	}
+}
+
+// Observe records the given value in the histogram with the given values of the labels
+func (histogram *histogramVec) Observe(observed float64, labelValues ...string) {
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	value, ok := histogram.values[key]
+	if !ok {
+		value = &histogramValue{
+			labelValues:  labelValues,
+			bucketCounts: make([]uint64, len(histogram.buckets)),
+		}
+		histogram.values[key] = value
+	}
+
+	// The values above the last bucket are only counted in +Inf, that is the total count
+	index := sort.SearchFloat64s(histogram.buckets, observed)
+	if index < len(histogram.buckets) {
+		value.bucketCounts[index]++
+	}
+	value.sum += observed
+	value.count++
+}
+
+// Write writes the histograms, sorted by the values of their labels, with cumulative buckets
+func (histogram *histogramVec) Write(writer io.Writer) {
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", histogram.name, histogram.help)
+	fmt.Fprintf(writer, "# TYPE %s histogram\n", histogram.name)
+
+	// The buckets have the additional label le, their upper bound
+	bucketLabelNames := append(append([]string{}, histogram.labelNames...), "le")
+
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := histogram.values[key]
+
+		bucketLabelValues := append(append([]string{}, value.labelValues...), "")
+		cumulativeCount := uint64(0)
+		for index, bucket := range histogram.buckets {
+			cumulativeCount += value.bucketCounts[index]
+			bucketLabelValues[len(value.labelValues)] = formatFloat(bucket)
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, formatLabels(bucketLabelNames, bucketLabelValues), cumulativeCount)
+		}
+		bucketLabelValues[len(value.labelValues)] = "+Inf"
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, formatLabels(bucketLabelNames, bucketLabelValues), value.count)
+
+		labels := formatLabels(histogram.labelNames, value.labelValues)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", histogram.name, labels, formatFloat(value.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", histogram.name, labels, value.count)
+	}
+}
+
+// writeGauge writes a single gauge without label
+func writeGauge(writer io.Writer, name string, help string, value int64) {
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(writer, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(writer, "%s %d\n", name, value)
+}
+
+// formatLabels returns the labels with their values, as {name="value",...}, or an empty string without label
+func formatLabels(labelNames []string, labelValues []string) string {
+
+	if len(labelNames) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, len(labelNames))
+	for index, labelName := range labelNames {
+		labels[index] = fmt.Sprintf(`%s="%s"`, labelName, escaper.Replace(labelValues[index]))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// formatFloat returns the shortest representation of the given value
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -11,12 +11,71 @@ type authenticationProvider interface {
 	// (string slice) if the call succeeds. Auth should return the ErrUnAuthorized or ErrUserNotFound error if
 	// auth fails or if the user is not found respectively.
 	Authenticate(userName string, password string) (*authenticatedUser, error)
+	// Lookup returns the user, with its roles and attributes, without verifying its password. It is used for
+	// adding the roles given by a provider to a user authenticated by another one. Lookup should return the
+	// ErrUserNotFound error if the user is not found.
+	Lookup(userName string) (*authenticatedUser, error)
+	// Name returns the name of the type of the provider, as given in the configuration
+	Name() string
+	// Instance returns the name of this instance of the provider (e.g. the address of its server)
+	Instance() string
+	// CheckHealth returns an error if the provider can not authenticate the users (e.g. its server is not
+	// reachable)
+	CheckHealth() error
 }
 
 // authenticatedUser is the structure keeping all the information about a user that has been successfully authenticated
 type authenticatedUser struct {
 	UserName string
 	Roles    []string
+	// The attributes of the user given by the provider (email, display name, ...), each one with its values
+	Attributes map[string][]string
+	// The provider that authenticated the user ("basic", "ldap" or "client" for a registered client)
+	Provider string
+}
+
+// authenticatedUserProviderClient is the provider of the registered clients obtaining tokens for themselves
+const authenticatedUserProviderClient = "client"
+
+// Policies for authenticating the users when several providers are configured
+const (
+	// The providers are tried in order until one authenticates the user. A wrong password stops the chain.
+	providerPolicyFirstMatch = "firstMatch"
+	// All the providers are tried, the roles of all the providers authenticating the user being merged. A wrong
+	// password stops the chain.
+	providerPolicyMergeAll = "mergeAll"
+	// Only the first provider authenticates the user, the other ones only giving additional roles
+	providerPolicyPrimary = "primary"
+)
+
+// providerPolicies are the policies that can be configured for authenticating the users
+var providerPolicies = []string{providerPolicyFirstMatch, providerPolicyMergeAll, providerPolicyPrimary}
+
+// mergeAuthenticatedUsers returns a new user with the roles of both users, without duplicate. The attributes of
+// the first user are kept, the other user only adding the attributes that the first one does not have.
+func mergeAuthenticatedUsers(user *authenticatedUser, otherUser *authenticatedUser) *authenticatedUser {
+
+	merged := &authenticatedUser{
+		UserName:   user.UserName,
+		Roles:      make([]string, 0, len(user.Roles)+len(otherUser.Roles)),
+		Attributes: make(map[string][]string),
+		Provider:   user.Provider,
+	}
+
+	for _, role := range append(append([]string{}, user.Roles...), otherUser.Roles...) {
+		merged.Roles = appendMissingString(merged.Roles, role)
+	}
+
+	for name, values := range user.Attributes {
+		merged.Attributes[name] = values
+	}
+	for name, values := range otherUser.Attributes {
+		if _, ok := merged.Attributes[name]; !ok {
+			merged.Attributes[name] = values
+		}
+	}
+
+	return merged
 }
 
 // newAuthenticationProvider takes a configuration and try to build the list of providers that are configured
@@ -51,12 +110,12 @@ func newAuthenticationProvider(configuration *Configuration) ([]authenticationPr
 		} else if *providerName == "ldap" {
 
 			// If no configuration
-			if configuration.Basic == nil {
+			if configuration.Ldap == nil {
 				log.Error("Configuration for SSO, attribute providers is set to use the \"ldap\" provider, but this provider is not defined in the configuration")
 				return nil, common.ErrBadConfiguration
 			}
 
-			// Create a new Basic Provider
+			// Create a new LDAP Provider
 			ldapProvider, err := buildLdapProvider(*configuration.Ldap)
 			if err != nil {
 				log.Error("Configuration for SSO, attribute providers is set to use the \"ldap\" provider, but this provider can not be configured")
@@ -12,8 +12,9 @@ type basicProvider struct {
 
 // basicUserInfo is the structure holding all the information about a single user
 type basicUserInfo struct {
-	password string
-	roles    []string
+	password   string
+	roles      []string
+	attributes map[string][]string
 }
 
 func (provider basicProvider) Authenticate(userName string, password string) (*authenticatedUser, error) {
@@ -23,16 +24,48 @@ func (provider basicProvider) Authenticate(userName string, password string) (*a
 		return nil, common.ErrUserNotFound
 	}
 
-	if password != userInfo.password {
+	// The users without password can not authenticate
+	if len(password) == 0 || password != userInfo.password {
 		return nil, common.ErrUnauthorized
 	}
 
 	return &authenticatedUser{
-		UserName: userName,
-		Roles:    userInfo.roles,
+		UserName:   userName,
+		Roles:      userInfo.roles,
+		Attributes: userInfo.attributes,
+		Provider:   "basic",
 	}, nil
 }
 
+// Lookup returns the user, without verifying its password
+func (provider basicProvider) Lookup(userName string) (*authenticatedUser, error) {
+
+	userInfo := provider.users[userName]
+	if userInfo == nil {
+		return nil, common.ErrUserNotFound
+	}
+
+	return &authenticatedUser{
+		UserName:   userName,
+		Roles:      userInfo.roles,
+		Attributes: userInfo.attributes,
+		Provider:   "basic",
+	}, nil
+}
+
+// CheckHealth does nothing, as the users are in memory
+func (provider basicProvider) CheckHealth() error {
+	return nil
+}
+
+func (provider basicProvider) Name() string {
+	return "basic"
+}
+
+func (provider basicProvider) Instance() string {
+	return "basic"
+}
+
 func buildBasicProvider(configuration *BasicProviderConfiguration) (authenticationProvider, error) {
 
 	if configuration == nil {
@@ -53,7 +86,7 @@ func buildBasicProvider(configuration *BasicProviderConfiguration) (authenticati
 			continue
 		}
 
-		// Filter null password to blank string
+		// Filter null password to blank string, the user being then unable to authenticate
 		var passwordToUse = ""
 		if basicProviderUserConfig.Password != nil {
 			passwordToUse = *basicProviderUserConfig.Password
@@ -74,9 +107,21 @@ func buildBasicProvider(configuration *BasicProviderConfiguration) (authenticati
 			}
 		}
 
+		attributes := make(map[string][]string)
+		if basicProviderUserConfig.Attributes != nil {
+			for name, value := range *basicProviderUserConfig.Attributes {
+				if value == nil {
+					log.Warn("Configuration for Basic, attribute users has an entry with a null value for attribute ", name, ". Skipping attribute.")
+					continue
+				}
+				attributes[name] = []string{*value}
+			}
+		}
+
 		users[*basicProviderUserConfig.UserName] = &basicUserInfo{
-			password: passwordToUse,
-			roles:    roles,
+			password:   passwordToUse,
+			roles:      roles,
+			attributes: attributes,
 		}
 	}
 
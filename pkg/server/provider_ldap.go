@@ -3,6 +3,7 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/twuillemin/easy-sso-common/pkg/common"
@@ -10,6 +11,9 @@ import (
 	"gopkg.in/ldap.v2"
 )
 
+// ldapDialTimeout is the longest time for connecting to the LDAP
+const ldapDialTimeout = 20 * time.Second
+
 // ldapProvider is the structure holding all the information for a LDAP authentication provider
 type ldapProvider struct {
 	host         string
@@ -18,36 +22,77 @@ type ldapProvider struct {
 	baseDN       string
 	bindDN       string
 	bindPassword string
+	// The attributes of the users read when searching them
+	attributes []string
 }
 
 func (provider *ldapProvider) Authenticate(userName string, password string) (*authenticatedUser, error) {
 
-	// Applies to Dial and DialTLS methods.
-	ldap.DefaultTimeout = 20 * time.Second
+	// A bind without password is an unauthenticated bind (RFC 4513, section 5.1.2), that the LDAP may accept
+	if len(userName) == 0 || len(password) == 0 {
+		return nil, common.ErrUnauthorized
+	}
 
-	// Connect to the Ldap
-	ldapConnection, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", provider.host, provider.port))
+	ldapConnection, err := provider.connect()
 	if err != nil {
 		return nil, err
 	}
 	defer ldapConnection.Close()
 
-	// Reconnect with TLS if ssl is requested.
-	if provider.ssl {
-		err = ldapConnection.StartTLS(&tls.Config{InsecureSkipVerify: true})
-		if err != nil {
-			return nil, err
-		}
+	userDN, attributes, err := provider.searchUser(ldapConnection, userName)
+	if err != nil {
+		return nil, err
 	}
 
-	// First bind with a read only user
-	if provider.bindDN != "" {
-		err = ldapConnection.Bind(provider.bindDN, provider.bindPassword)
-		if err != nil {
-			return nil, err
-		}
+	// Bind as the user to verify the password
+	err = ldapConnection.Bind(userDN, password)
+	if err != nil {
+		return nil, common.ErrUnauthorized
+	}
+
+	groups, err := provider.searchGroups(ldapConnection, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authenticatedUser{
+		UserName:   userName,
+		Roles:      groups,
+		Attributes: attributes,
+		Provider:   "ldap",
+	}, nil
+}
+
+// Lookup searches the user and its groups with the read only user, if any, without verifying its password
+func (provider *ldapProvider) Lookup(userName string) (*authenticatedUser, error) {
+
+	ldapConnection, err := provider.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer ldapConnection.Close()
+
+	_, attributes, err := provider.searchUser(ldapConnection, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := provider.searchGroups(ldapConnection, userName)
+	if err != nil {
+		return nil, err
 	}
 
+	return &authenticatedUser{
+		UserName:   userName,
+		Roles:      groups,
+		Attributes: attributes,
+		Provider:   "ldap",
+	}, nil
+}
+
+// searchUser returns the DN and the attributes of the user, the attributes without value being ignored
+func (provider *ldapProvider) searchUser(ldapConnection *ldap.Conn, userName string) (string, map[string][]string, error) {
+
 	// Prepare a request with the given username (max: 30s)
 	userSearchRequest := ldap.NewSearchRequest(
 		provider.baseDN,
@@ -57,31 +102,36 @@ func (provider *ldapProvider) Authenticate(userName string, password string) (*a
 		0,
 		30,
 		false,
-		fmt.Sprintf("(&(objectClass=inetOrgPerson)(uid=%s))", userName),
-		[]string{"dn"},
+		fmt.Sprintf("(&(objectClass=inetOrgPerson)(uid=%s))", ldap.EscapeFilter(userName)),
+		append([]string{"dn"}, provider.attributes...),
 		nil,
 	)
 
 	// Search the user
 	userSearchResult, err := ldapConnection.Search(userSearchRequest)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	// If not a single entry, give up
 	if len(userSearchResult.Entries) != 1 {
-		return nil, common.ErrUserNotFound
+		return "", nil, common.ErrUserNotFound
 	}
 
-	userDN := userSearchResult.Entries[0].DN
-
-	// Bind as the user to verify the password
-	err = ldapConnection.Bind(userDN, password)
-	if err != nil {
-		return nil, common.ErrUnauthorized
+	attributes := make(map[string][]string)
+	for _, attribute := range provider.attributes {
+		if values := userSearchResult.Entries[0].GetAttributeValues(attribute); len(values) > 0 {
+			attributes[attribute] = values
+		}
 	}
 
-	// Now find the group membership (max: 30s)
+	return userSearchResult.Entries[0].DN, attributes, nil
+}
+
+// searchGroups returns the names (cn) of all the groups of the user
+func (provider *ldapProvider) searchGroups(ldapConnection *ldap.Conn, userName string) ([]string, error) {
+
+	// Find the group membership (max: 30s)
 	groupsSearchRequest := ldap.NewSearchRequest(
 		provider.baseDN,
 		ldap.ScopeWholeSubtree,
@@ -89,7 +139,7 @@ func (provider *ldapProvider) Authenticate(userName string, password string) (*a
 		0,
 		30,
 		false, // sets a time limit of 30 secs
-		fmt.Sprintf("(&(objectClass=posixGroup)(memberUid=%s))", userName),
+		fmt.Sprintf("(&(objectClass=posixGroup)(memberUid=%s))", ldap.EscapeFilter(userName)),
 		[]string{"cn"},
 		nil,
 	)
@@ -98,16 +148,76 @@ func (provider *ldapProvider) Authenticate(userName string, password string) (*a
 		return nil, err
 	}
 
-	groups := groupsSearchResult.Entries[0].GetAttributeValues("cn")
+	groups := make([]string, 0, len(groupsSearchResult.Entries))
+	for _, entry := range groupsSearchResult.Entries {
+		groups = append(groups, entry.GetAttributeValues("cn")...)
+	}
 
-	return &authenticatedUser{
-		UserName: userName,
-		Roles:    groups,
-	}, nil
+	return groups, nil
+}
+
+// CheckHealth connects to the LDAP and binds with the read only user, if any
+func (provider *ldapProvider) CheckHealth() error {
+
+	ldapConnection, err := provider.connect()
+	if err != nil {
+		return err
+	}
+	ldapConnection.Close()
+
+	return nil
+}
+
+// connect opens a connection to the LDAP, bound with the read only user if any
+func (provider *ldapProvider) connect() (*ldap.Conn, error) {
+
+	// Connect to the Ldap. The connection is opened here rather than with ldap.Dial, so that the timeout is not
+	// given by a global variable of the package, that would be shared by the concurrent connections.
+	connection, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", provider.host, provider.port), ldapDialTimeout)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	ldapConnection := ldap.NewConn(connection, false)
+	ldapConnection.Start()
+
+	// Reconnect with TLS if ssl is requested.
+	if provider.ssl {
+		err = ldapConnection.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			ldapConnection.Close()
+			return nil, err
+		}
+	}
+
+	// First bind with a read only user
+	if provider.bindDN != "" {
+		err = ldapConnection.Bind(provider.bindDN, provider.bindPassword)
+		if err != nil {
+			ldapConnection.Close()
+			return nil, err
+		}
+	}
+
+	return ldapConnection, nil
+}
+
+func (provider *ldapProvider) Name() string {
+	return "ldap"
+}
+
+func (provider *ldapProvider) Instance() string {
+	return fmt.Sprintf("%s:%d", provider.host, provider.port)
 }
 
 func buildLdapProvider(configuration LdapProviderConfiguration) (*ldapProvider, error) {
 
+	attributes := make([]string, 0)
+	if configuration.Attributes != nil {
+		for _, attribute := range *configuration.Attributes {
+			attributes = append(attributes, *attribute)
+		}
+	}
+
 	return &ldapProvider{
 		host:         *configuration.Host,
 		port:         *configuration.Port,
@@ -115,5 +225,6 @@ func buildLdapProvider(configuration LdapProviderConfiguration) (*ldapProvider,
 		baseDN:       *configuration.BaseDN,
 		bindDN:       *configuration.BindDN,
 		bindPassword: *configuration.BindPassword,
+		attributes:   attributes,
 	}, nil
 }
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxy reads a trusted proxy given as an address (e.g.: 10.0.0.1) or as a network (e.g.: 10.0.0.0/8)
+func parseTrustedProxy(value string) (*net.IPNet, error) {
+
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: value}
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseTrustedProxies returns the trusted proxies of the configuration. The configuration must have been validated.
+func parseTrustedProxies(configuration SsoConfiguration) []*net.IPNet {
+
+	trustedProxies := make([]*net.IPNet, 0)
+	if configuration.TrustedProxies != nil {
+		for _, value := range *configuration.TrustedProxies {
+			if network, err := parseTrustedProxy(*value); err == nil {
+				trustedProxies = append(trustedProxies, network)
+			}
+		}
+	}
+
+	return trustedProxies
+}
+
+// isTrustedProxy returns true if the given address is one of the trusted proxies
+func (state *authServerState) isTrustedProxy(ip net.IP) bool {
+
+	for _, network := range state.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getRemoteAddress returns the address of the caller of the request, without its port. When the request comes from
+// a trusted proxy, the addresses of the X-Forwarded-For header are read from the right, skipping the trusted
+// proxies, so that the caller can not choose its address by adding its own entries at the left of the header.
+func (state *authServerState) getRemoteAddress(request *http.Request) string {
+
+	remoteAddress, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		remoteAddress = request.RemoteAddr
+	}
+
+	ip := net.ParseIP(remoteAddress)
+	if (ip == nil) || !state.isTrustedProxy(ip) {
+		return remoteAddress
+	}
+
+	hops := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+
+		// A malformed entry was not added by a trusted proxy, the last proxy is then considered as the caller
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return remoteAddress
+		}
+
+		remoteAddress = hop.String()
+		if !state.isTrustedProxy(hop) {
+			return remoteAddress
+		}
+	}
+
+	return remoteAddress
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteAddressIsReadFromTheTrustedProxies(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	configuration.Sso.TrustedProxies = &[]*string{stringPointer("10.0.0.1"), stringPointer("192.168.0.0/16")}
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal("Unable to validate the configuration: ", err)
+	}
+	state := newAuthServerState(newTestEngine(t, configuration), *configuration)
+
+	tests := []struct {
+		name          string
+		remoteAddress string
+		forwardedFor  []string
+		expected      string
+	}{
+		{"no proxy", "203.0.113.1:1234", nil, "203.0.113.1"},
+		{"untrusted proxy", "203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"198.51.100.1", "192.168.1.1"}, "198.51.100.1"},
+		{"spoofed entries", "10.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1"}, "198.51.100.1"},
+		{"malformed entry", "10.0.0.1:1234", []string{"198.51.100.1, unknown, 192.168.1.1"}, "192.168.1.1"},
+		{"only trusted proxies", "10.0.0.1:1234", []string{"192.168.1.2, 192.168.1.1"}, "192.168.1.2"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/token", nil)
+		request.RemoteAddr = test.remoteAddress
+		for _, value := range test.forwardedFor {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+		if remoteAddress := state.getRemoteAddress(request); remoteAddress != test.expected {
+			t.Errorf("%s: the remote address is %s, expected %s", test.name, remoteAddress, test.expected)
+		}
+	}
+}
+
+func TestInvalidTrustedProxiesAreRefused(t *testing.T) {
+
+	for _, trustedProxy := range []string{"", "10.0.0", "10.0.0.0/33", "proxy.example.com"} {
+		configuration := newTestConfiguration(t)
+		configuration.Sso.TrustedProxies = &[]*string{stringPointer(trustedProxy)}
+		if err := ValidateConfiguration(configuration); err == nil {
+			t.Errorf("The trusted proxy %q was accepted", trustedProxy)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+// refreshTokenStore is what it needs to be implemented for keeping the refresh tokens issued by the SSO engine,
+// along with the ids of the access tokens that were revoked before their expiration.
+// As the store is shared by all the requests (and by the engines created when the configuration is reloaded),
+// the implementations must be safe for concurrent use. The refresh information given to or returned by the
+// store must not be modified.
+type refreshTokenStore interface {
+	// Get returns the information associated with the given refresh token. If the refresh token is not
+	// known, nil is returned without error.
+	Get(refreshId string) (*refreshInformation, error)
+	// Add stores the information associated with a new refresh token. If the store already holds limit refresh
+	// tokens (0 for no limit), the timed out refresh tokens are removed first, then the oldest ones if evictOldest
+	// is true, otherwise errTooManyRefreshTokens is returned. The check of the limit and the insertion are atomic.
+	// The number of refresh tokens removed is returned.
+	Add(refreshId string, information *refreshInformation, limit int, evictOldest bool) (int, error)
+	// Delete removes the given refresh token. Removing a refresh token that is not known is not an error.
+	Delete(refreshId string) error
+	// DeleteMany removes the given refresh tokens at once, so that removing a lot of them is not much more costly
+	// than removing a single one. Removing refresh tokens that are not known is not an error.
+	DeleteMany(refreshIds []string) error
+	// Consume marks atomically the given refresh token as consumed and returns its information as it was
+	// before. If the refresh token is not known, nil is returned without error.
+	Consume(refreshId string) (*refreshInformation, error)
+	// GetAll returns a snapshot of all the refresh tokens in the store
+	GetAll() (map[string]*refreshInformation, error)
+	// Count returns the number of refresh tokens in the store
+	Count() (int, error)
+	// RevokeAccessToken keeps the id of an access token revoked before its expiration
+	RevokeAccessToken(tokenId string, expiresAt int64) error
+	// IsAccessTokenRevoked returns true if the access token with the given id was revoked
+	IsAccessTokenRevoked(tokenId string) (bool, error)
+	// PurgeRevokedAccessTokens forgets the revoked access tokens that are expired at the given time and returns
+	// the number of ids removed
+	PurgeRevokedAccessTokens(now int64) (int, error)
+	// Compact reclaims the space still used by the refresh tokens and the revoked access tokens removed, if the
+	// store needs it
+	Compact() error
+}
+
+// newRefreshTokenStore takes a configuration and builds the refresh token store that is configured
+func newRefreshTokenStore(configuration SsoConfiguration) (refreshTokenStore, error) {
+
+	// By default, keep the refresh tokens in memory
+	if configuration.RefreshTokenStore == nil || *configuration.RefreshTokenStore == "memory" {
+		return buildMemoryRefreshTokenStore(), nil
+	}
+
+	if *configuration.RefreshTokenStore == "file" {
+
+		// The presence of the path is checked while loading config
+		fileStore, err := buildFileRefreshTokenStore(*configuration.RefreshTokenStorePath)
+		if err != nil {
+			log.Error("Configuration for SSO, attribute refreshTokenStore is set to use the \"file\" store, but this store can not be opened")
+			return nil, common.ErrBadConfiguration
+		}
+
+		return fileStore, nil
+	}
+
+	log.Error("Configuration for SSO, attribute refreshTokenStore can only be \"memory\" or \"file\"")
+	return nil, common.ErrBadConfiguration
+}
@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errRefreshTokenLogCorrupted is returned when the log of a refresh token store has a malformed record that was not
+// left by a crash
+var errRefreshTokenLogCorrupted = errors.New("the refresh token store is corrupted")
+
+// fileRefreshTokenStore is the structure holding all the information for a refresh token store backed by a
+// file. The file is an append-only log of JSON records (one per line) that is replayed and compacted when the
+// store is opened, so that the refresh tokens survive a restart of the server, and compacted again when it has
+// grown. The refresh tokens are also kept in memory for the reads. The writes are serialized so that the log and
+// the memory stay in the same order.
+type fileRefreshTokenStore struct {
+	memoryStore *memoryRefreshTokenStore
+	path        string
+	file        *os.File
+	// The number of records in the log
+	records int
+	// The error left by a failed write that could not be removed from the log, refusing the next writes until the
+	// log is compacted
+	writeFailure error
+	writeMutex   sync.Mutex
+}
+
+// refreshTokenRecord is a single line of the log file
+type refreshTokenRecord struct {
+	Operation       string              `json:"op"`
+	RefreshId       string              `json:"id"`
+	UserName        string              `json:"userName,omitempty"`
+	Roles           []string            `json:"roles,omitempty"`
+	Attributes      map[string][]string `json:"attributes,omitempty"`
+	Provider        string              `json:"provider,omitempty"`
+	RefreshTimeOut  int64               `json:"refreshTimeOut,omitempty"`
+	CreatedAt       int64               `json:"createdAt,omitempty"`
+	FamilyId        string              `json:"familyId,omitempty"`
+	Consumed        bool                `json:"consumed,omitempty"`
+	ExpiresAt       int64               `json:"expiresAt,omitempty"`
+	ClientId        string              `json:"clientId,omitempty"`
+	Audiences       []string            `json:"audiences,omitempty"`
+	Scopes          []string            `json:"scopes,omitempty"`
+	FamilyCreatedAt int64               `json:"familyCreatedAt,omitempty"`
+	RemoteAddress   string              `json:"remoteAddress,omitempty"`
+}
+
+const (
+	refreshTokenRecordPut               = "put"
+	refreshTokenRecordDelete            = "delete"
+	refreshTokenRecordRevokeAccessToken = "revokeAccessToken"
+)
+
+func (store *fileRefreshTokenStore) Get(refreshId string) (*refreshInformation, error) {
+
+	return store.memoryStore.Get(refreshId)
+}
+
+// Add checks the limit with the refresh tokens in memory. As all the writes hold the write mutex, the number of
+// refresh tokens can not change before the new one is stored.
+func (store *fileRefreshTokenStore) Add(refreshId string, information *refreshInformation, limit int, evictOldest bool) (int, error) {
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	store.memoryStore.mutex.RLock()
+	removedIds, err := store.memoryStore.findRefreshTokensToRemove(limit, evictOldest, time.Now().Unix())
+	store.memoryStore.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// The removals and the new refresh token are flushed at once
+	records := append(newDeleteRefreshTokenRecords(removedIds), newPutRefreshTokenRecord(refreshId, information))
+	if err := store.appendRecords(records); err != nil {
+		return 0, err
+	}
+
+	store.memoryStore.DeleteMany(removedIds)
+	store.memoryStore.put(refreshId, information)
+	return len(removedIds), nil
+}
+
+func (store *fileRefreshTokenStore) Delete(refreshId string) error {
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	err := store.appendRecord(&refreshTokenRecord{
+		Operation: refreshTokenRecordDelete,
+		RefreshId: refreshId,
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.memoryStore.Delete(refreshId)
+}
+
+// DeleteMany writes all the records before flushing the log, so that the disk is only synchronized once
+func (store *fileRefreshTokenStore) DeleteMany(refreshIds []string) error {
+
+	if len(refreshIds) == 0 {
+		return nil
+	}
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	if err := store.appendRecords(newDeleteRefreshTokenRecords(refreshIds)); err != nil {
+		return err
+	}
+
+	return store.memoryStore.DeleteMany(refreshIds)
+}
+
+func (store *fileRefreshTokenStore) Consume(refreshId string) (*refreshInformation, error) {
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	information, err := store.memoryStore.Get(refreshId)
+	if err != nil || information == nil || information.consumed {
+		return information, err
+	}
+
+	consumedInformation := *information
+	consumedInformation.consumed = true
+	err = store.appendRecord(newPutRefreshTokenRecord(refreshId, &consumedInformation))
+	if err != nil {
+		return nil, err
+	}
+
+	store.memoryStore.put(refreshId, &consumedInformation)
+
+	return information, nil
+}
+
+func (store *fileRefreshTokenStore) GetAll() (map[string]*refreshInformation, error) {
+
+	return store.memoryStore.GetAll()
+}
+
+func (store *fileRefreshTokenStore) Count() (int, error) {
+
+	return store.memoryStore.Count()
+}
+
+func (store *fileRefreshTokenStore) RevokeAccessToken(tokenId string, expiresAt int64) error {
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	err := store.appendRecord(&refreshTokenRecord{
+		Operation: refreshTokenRecordRevokeAccessToken,
+		RefreshId: tokenId,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.memoryStore.RevokeAccessToken(tokenId, expiresAt)
+}
+
+func (store *fileRefreshTokenStore) IsAccessTokenRevoked(tokenId string) (bool, error) {
+
+	return store.memoryStore.IsAccessTokenRevoked(tokenId)
+}
+
+// PurgeRevokedAccessTokens only forgets the revoked access tokens in memory, the expired ones being removed from
+// the log when it is compacted
+func (store *fileRefreshTokenStore) PurgeRevokedAccessTokens(now int64) (int, error) {
+
+	return store.memoryStore.PurgeRevokedAccessTokens(now)
+}
+
+// Compact rewrites the log with only the live refresh tokens and revoked access tokens, when it holds more than
+// twice as many records as needed, so that the log does not grow forever on a server that is not restarted
+func (store *fileRefreshTokenStore) Compact() error {
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	liveRecords, _ := store.memoryStore.Count()
+	liveRecords += len(store.memoryStore.getRevokedAccessTokens())
+	if (store.writeFailure == nil) && (store.records <= 2*liveRecords) {
+		return nil
+	}
+
+	file, records, err := compactRefreshTokenLog(store.path, store.memoryStore)
+	if err != nil {
+		return err
+	}
+
+	if err := store.file.Close(); err != nil {
+		log.Warn("Unable to close the previous refresh token store ", store.path, err)
+	}
+	store.file = file
+	store.records = records
+	store.writeFailure = nil
+
+	return nil
+}
+
+// appendRecord writes a single record at the end of the log and flushes it to the disk. The caller must hold
+// the write mutex.
+func (store *fileRefreshTokenStore) appendRecord(record *refreshTokenRecord) error {
+
+	return store.appendRecords([]*refreshTokenRecord{record})
+}
+
+// appendRecords writes the given records at the end of the log, in a single write, and flushes them to the disk.
+// If the records can not be written or flushed, the log is truncated back to its previous end, so that a partial
+// record is not followed by the next ones. The caller must hold the write mutex.
+func (store *fileRefreshTokenStore) appendRecords(records []*refreshTokenRecord) error {
+
+	if store.writeFailure != nil {
+		return store.writeFailure
+	}
+
+	lines := make([]byte, 0)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Error("Unable to serialize a refresh token record", err)
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	offset, err := store.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		log.Error("Unable to find the end of the refresh token store ", store.path, err)
+		store.writeFailure = err
+		return err
+	}
+
+	if _, err := store.file.Write(lines); err != nil {
+		log.Error("Unable to write the refresh token records to ", store.path, err)
+		store.truncateRecords(offset, err)
+		return err
+	}
+
+	if err := store.file.Sync(); err != nil {
+		log.Error("Unable to flush the refresh token store ", store.path, err)
+		store.truncateRecords(offset, err)
+		return err
+	}
+
+	store.records += len(records)
+
+	return nil
+}
+
+// truncateRecords removes from the log the records written after the given offset. If they can not be removed,
+// the next writes are refused until the log is compacted. The caller must hold the write mutex.
+func (store *fileRefreshTokenStore) truncateRecords(offset int64, writeError error) {
+
+	if err := store.file.Truncate(offset); err != nil {
+		log.Error("Unable to remove the failed refresh token records from ", store.path, err)
+		store.writeFailure = writeError
+		return
+	}
+
+	if _, err := store.file.Seek(offset, io.SeekStart); err != nil {
+		log.Error("Unable to move back to the end of the refresh token store ", store.path, err)
+		store.writeFailure = writeError
+	}
+}
+
+// buildFileRefreshTokenStore opens (or creates) the log file at the given path, reloads the refresh tokens
+// it contains and compacts it.
+func buildFileRefreshTokenStore(path string) (*fileRefreshTokenStore, error) {
+
+	memoryStore := buildMemoryRefreshTokenStore()
+
+	// Replay the existing log if any
+	err := replayRefreshTokenLog(path, memoryStore)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the log with only the live refresh tokens, the new log being kept open for the next records
+	file, records, err := compactRefreshTokenLog(path, memoryStore)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Refresh token store %s loaded with %d refresh tokens", path, len(memoryStore.refreshTokens))
+
+	return &fileRefreshTokenStore{
+		memoryStore: memoryStore,
+		path:        path,
+		file:        file,
+		records:     records,
+	}, nil
+}
+
+// replayRefreshTokenLog reads all the records of the log and applies them in order to the given store. Only the
+// last record can be malformed, if the process crashed while writing it: any other malformed record is an error, as
+// skipping it could for example forget a revocation.
+func replayRefreshTokenLog(path string, memoryStore *memoryRefreshTokenStore) error {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error("Unable to read the refresh token store ", path, err)
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lineNumber := 0
+	truncated := false
+	for scanner.Scan() {
+		lineNumber++
+
+		// A malformed record followed by another one was not left by a crash
+		if truncated {
+			log.Error("Refresh token store ", path, " has a malformed record at line ", lineNumber-1)
+			return errRefreshTokenLogCorrupted
+		}
+
+		var record refreshTokenRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			truncated = true
+			continue
+		}
+
+		switch record.Operation {
+		case refreshTokenRecordPut:
+			memoryStore.put(record.RefreshId, record.toRefreshInformation())
+		case refreshTokenRecordDelete:
+			memoryStore.Delete(record.RefreshId)
+		case refreshTokenRecordRevokeAccessToken:
+			memoryStore.RevokeAccessToken(record.RefreshId, record.ExpiresAt)
+		default:
+			log.Error("Refresh token store ", path, " has a record with an unknown operation at line ", lineNumber)
+			return errRefreshTokenLogCorrupted
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Error("Unable to read the refresh token store ", path, err)
+		return err
+	}
+
+	if truncated {
+		log.Warn("Refresh token store ", path, " has a truncated last record. Skipping record.")
+	}
+
+	return nil
+}
+
+// compactRefreshTokenLog replaces the log by a new one holding only the refresh tokens that are not timed out
+// and the revoked access tokens that are not expired. The new log is returned open for writing the next records,
+// along with its number of records.
+func compactRefreshTokenLog(path string, memoryStore *memoryRefreshTokenStore) (*os.File, int, error) {
+
+	temporaryPath := path + ".tmp"
+
+	file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("Unable to create the refresh token store ", temporaryPath, err)
+		return nil, 0, err
+	}
+
+	now := time.Now().Unix()
+	records := make([]*refreshTokenRecord, 0)
+
+	refreshTokens, _ := memoryStore.GetAll()
+	for refreshId, information := range refreshTokens {
+
+		// Drop the timed out entries
+		if information.refreshTimeOut < now {
+			memoryStore.Delete(refreshId)
+			continue
+		}
+
+		records = append(records, newPutRefreshTokenRecord(refreshId, information))
+	}
+
+	memoryStore.PurgeRevokedAccessTokens(now)
+	for tokenId, expiresAt := range memoryStore.getRevokedAccessTokens() {
+		records = append(records, &refreshTokenRecord{
+			Operation: refreshTokenRecordRevokeAccessToken,
+			RefreshId: tokenId,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		log.Error("Unable to write the refresh token store ", temporaryPath, err)
+		return nil, 0, err
+	}
+
+	if err = file.Sync(); err != nil {
+		file.Close()
+		log.Error("Unable to flush the refresh token store ", temporaryPath, err)
+		return nil, 0, err
+	}
+
+	// The file stays open, so that the next records are written in the new log once it is renamed
+	if err = os.Rename(temporaryPath, path); err != nil {
+		file.Close()
+		log.Error("Unable to replace the refresh token store ", path, err)
+		return nil, 0, err
+	}
+
+	// Flush the directory so that the rename itself survives a crash. As the rename is already done, a failure is
+	// only reported.
+	if err = syncDirectory(filepath.Dir(path)); err != nil {
+		log.Error("Unable to flush the directory of the refresh token store ", path, err)
+	}
+
+	return file, len(records), nil
+}
+
+// syncDirectory flushes the entries of the given directory to the disk
+func syncDirectory(path string) error {
+
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	return directory.Sync()
+}
+
+// newDeleteRefreshTokenRecords returns the records removing the given refresh tokens
+func newDeleteRefreshTokenRecords(refreshIds []string) []*refreshTokenRecord {
+
+	records := make([]*refreshTokenRecord, 0, len(refreshIds))
+	for _, refreshId := range refreshIds {
+		records = append(records, &refreshTokenRecord{
+			Operation: refreshTokenRecordDelete,
+			RefreshId: refreshId,
+		})
+	}
+	return records
+}
+
+// newPutRefreshTokenRecord converts a refresh information to a record that can be written in the log
+func newPutRefreshTokenRecord(refreshId string, information *refreshInformation) *refreshTokenRecord {
+
+	return &refreshTokenRecord{
+		Operation:       refreshTokenRecordPut,
+		RefreshId:       refreshId,
+		UserName:        information.authenticatedUser.UserName,
+		Roles:           information.authenticatedUser.Roles,
+		Attributes:      information.authenticatedUser.Attributes,
+		Provider:        information.authenticatedUser.Provider,
+		RefreshTimeOut:  information.refreshTimeOut,
+		CreatedAt:       information.createdAt,
+		FamilyId:        information.familyId,
+		Consumed:        information.consumed,
+		ClientId:        information.grant.clientId,
+		Audiences:       information.grant.audiences,
+		Scopes:          information.grant.scopes,
+		FamilyCreatedAt: information.familyCreatedAt,
+		RemoteAddress:   information.grant.remoteAddress,
+	}
+}
+
+// toRefreshInformation converts a record read from the log to a refresh information
+func (record refreshTokenRecord) toRefreshInformation() *refreshInformation {
+
+	return &refreshInformation{
+		authenticatedUser: &authenticatedUser{
+			UserName:   record.UserName,
+			Roles:      record.Roles,
+			Attributes: record.Attributes,
+			Provider:   record.Provider,
+		},
+		refreshTimeOut: record.RefreshTimeOut,
+		createdAt:      record.CreatedAt,
+		familyId:       record.FamilyId,
+		consumed:       record.Consumed,
+		grant: tokenGrant{
+			clientId:      record.ClientId,
+			audiences:     record.Audiences,
+			scopes:        record.Scopes,
+			remoteAddress: record.RemoteAddress,
+		},
+		familyCreatedAt: record.FamilyCreatedAt,
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"container/heap"
+)
+
+// refreshTokenIndexEntry is a refresh token kept in a refreshTokenIndex
+type refreshTokenIndexEntry struct {
+	refreshId string
+	time      int64
+	// The position of the entry in the heap
+	position int
+}
+
+// refreshTokenIndex orders the refresh tokens by a time (their timeout or their creation), so that the first ones can
+// be found without looking at all the refresh tokens. It is a binary heap (the earliest time first) implementing
+// heap.Interface, that must only be used through its methods set, remove and visitInOrder.
+type refreshTokenIndex struct {
+	entries []*refreshTokenIndexEntry
+	byId    map[string]*refreshTokenIndexEntry
+}
+
+func (index *refreshTokenIndex) Len() int {
+	return len(index.entries)
+}
+
+func (index *refreshTokenIndex) Less(i, j int) bool {
+	return index.entries[i].time < index.entries[j].time
+}
+
+func (index *refreshTokenIndex) Swap(i, j int) {
+	index.entries[i], index.entries[j] = index.entries[j], index.entries[i]
+	index.entries[i].position = i
+	index.entries[j].position = j
+}
+
+func (index *refreshTokenIndex) Push(value interface{}) {
+	entry := value.(*refreshTokenIndexEntry)
+	entry.position = len(index.entries)
+	index.entries = append(index.entries, entry)
+}
+
+func (index *refreshTokenIndex) Pop() interface{} {
+	last := len(index.entries) - 1
+	entry := index.entries[last]
+	index.entries[last] = nil
+	index.entries = index.entries[:last]
+	return entry
+}
+
+// set adds the given refresh token to the index, or moves it if it is already indexed
+func (index *refreshTokenIndex) set(refreshId string, time int64) {
+
+	if entry := index.byId[refreshId]; entry != nil {
+		entry.time = time
+		heap.Fix(index, entry.position)
+		return
+	}
+
+	entry := &refreshTokenIndexEntry{refreshId: refreshId, time: time}
+	index.byId[refreshId] = entry
+	heap.Push(index, entry)
+}
+
+// remove removes the given refresh token from the index. Removing a refresh token that is not indexed does nothing.
+func (index *refreshTokenIndex) remove(refreshId string) {
+
+	if entry := index.byId[refreshId]; entry != nil {
+		heap.Remove(index, entry.position)
+		delete(index.byId, refreshId)
+	}
+}
+
+// visitInOrder calls the given function with the refresh tokens in the order of their time, until it returns false.
+// The index is not modified, so a read lock is enough. Visiting the first k refresh tokens costs O(k log k), whatever
+// the number of refresh tokens indexed.
+func (index *refreshTokenIndex) visitInOrder(visit func(refreshId string, time int64) bool) {
+
+	if len(index.entries) == 0 {
+		return
+	}
+
+	// The next entry in order is always one of the children of the entries already visited
+	candidates := &refreshTokenIndexCandidates{index: index, positions: []int{0}}
+	for candidates.Len() > 0 {
+		position := heap.Pop(candidates).(int)
+		entry := index.entries[position]
+		if !visit(entry.refreshId, entry.time) {
+			return
+		}
+		for _, child := range []int{2*position + 1, 2*position + 2} {
+			if child < len(index.entries) {
+				heap.Push(candidates, child)
+			}
+		}
+	}
+}
+
+// refreshTokenIndexCandidates is a heap of positions in a refreshTokenIndex, the earliest time first, holding the
+// entries that can be visited next by visitInOrder
+type refreshTokenIndexCandidates struct {
+	index     *refreshTokenIndex
+	positions []int
+}
+
+func (candidates *refreshTokenIndexCandidates) Len() int {
+	return len(candidates.positions)
+}
+
+func (candidates *refreshTokenIndexCandidates) Less(i, j int) bool {
+	return candidates.index.Less(candidates.positions[i], candidates.positions[j])
+}
+
+func (candidates *refreshTokenIndexCandidates) Swap(i, j int) {
+	candidates.positions[i], candidates.positions[j] = candidates.positions[j], candidates.positions[i]
+}
+
+func (candidates *refreshTokenIndexCandidates) Push(value interface{}) {
+	candidates.positions = append(candidates.positions, value.(int))
+}
+
+func (candidates *refreshTokenIndexCandidates) Pop() interface{} {
+	last := len(candidates.positions) - 1
+	position := candidates.positions[last]
+	candidates.positions = candidates.positions[:last]
+	return position
+}
+
+func newRefreshTokenIndex() *refreshTokenIndex {
+
+	return &refreshTokenIndex{
+		entries: make([]*refreshTokenIndexEntry, 0),
+		byId:    make(map[string]*refreshTokenIndexEntry),
+	}
+}
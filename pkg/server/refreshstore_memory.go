@@ -0,0 +1,228 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryRefreshTokenStore is the structure holding all the refresh tokens in memory. The refresh tokens are
+// lost when the process is stopped
+type memoryRefreshTokenStore struct {
+	refreshTokens map[string]*refreshInformation
+	// The refresh tokens ordered by their timeout and by their creation, for finding the ones to remove at the limit
+	byTimeOut           *refreshTokenIndex
+	byCreation          *refreshTokenIndex
+	revokedAccessTokens map[string]int64
+	mutex               sync.RWMutex
+}
+
+func (store *memoryRefreshTokenStore) Get(refreshId string) (*refreshInformation, error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.refreshTokens[refreshId], nil
+}
+
+func (store *memoryRefreshTokenStore) Add(refreshId string, information *refreshInformation, limit int, evictOldest bool) (int, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removedIds, err := store.findRefreshTokensToRemove(limit, evictOldest, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	for _, removedId := range removedIds {
+		store.remove(removedId)
+	}
+
+	store.set(refreshId, information)
+	return len(removedIds), nil
+}
+
+func (store *memoryRefreshTokenStore) Delete(refreshId string) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.remove(refreshId)
+	return nil
+}
+
+func (store *memoryRefreshTokenStore) DeleteMany(refreshIds []string) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, refreshId := range refreshIds {
+		store.remove(refreshId)
+	}
+	return nil
+}
+
+func (store *memoryRefreshTokenStore) Consume(refreshId string) (*refreshInformation, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	information := store.refreshTokens[refreshId]
+	if information == nil || information.consumed {
+		return information, nil
+	}
+
+	consumedInformation := *information
+	consumedInformation.consumed = true
+	store.set(refreshId, &consumedInformation)
+
+	return information, nil
+}
+
+func (store *memoryRefreshTokenStore) GetAll() (map[string]*refreshInformation, error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	refreshTokens := make(map[string]*refreshInformation, len(store.refreshTokens))
+	for refreshId, information := range store.refreshTokens {
+		refreshTokens[refreshId] = information
+	}
+	return refreshTokens, nil
+}
+
+func (store *memoryRefreshTokenStore) Count() (int, error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return len(store.refreshTokens), nil
+}
+
+func (store *memoryRefreshTokenStore) RevokeAccessToken(tokenId string, expiresAt int64) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.revokedAccessTokens[tokenId] = expiresAt
+	return nil
+}
+
+func (store *memoryRefreshTokenStore) IsAccessTokenRevoked(tokenId string) (bool, error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	_, revoked := store.revokedAccessTokens[tokenId]
+	return revoked, nil
+}
+
+func (store *memoryRefreshTokenStore) PurgeRevokedAccessTokens(now int64) (int, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	purged := 0
+	for tokenId, expiresAt := range store.revokedAccessTokens {
+		if expiresAt < now {
+			delete(store.revokedAccessTokens, tokenId)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Compact does nothing, as the memory is reclaimed when the entries are removed
+func (store *memoryRefreshTokenStore) Compact() error {
+
+	return nil
+}
+
+// put stores the information associated with the given refresh token, replacing any previous value. It is
+// not part of the refreshTokenStore interface, as the refresh tokens are added with their limit: it is only used by
+// the file store, for keeping in memory the records already written in its log.
+func (store *memoryRefreshTokenStore) put(refreshId string, information *refreshInformation) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.set(refreshId, information)
+}
+
+// set stores the given refresh token and indexes it. The mutex must be held for writing.
+func (store *memoryRefreshTokenStore) set(refreshId string, information *refreshInformation) {
+
+	store.refreshTokens[refreshId] = information
+	store.byTimeOut.set(refreshId, information.refreshTimeOut)
+	store.byCreation.set(refreshId, information.createdAt)
+}
+
+// remove removes the given refresh token and its indexes. The mutex must be held for writing.
+func (store *memoryRefreshTokenStore) remove(refreshId string) {
+
+	delete(store.refreshTokens, refreshId)
+	store.byTimeOut.remove(refreshId)
+	store.byCreation.remove(refreshId)
+}
+
+// findRefreshTokensToRemove returns the ids of the refresh tokens to remove for adding a new one when the store
+// holds limit refresh tokens or more (0 for no limit). The refresh tokens timed out at the given time are removed
+// first, then the oldest ones if evictOldest is true. If there is still no room, errTooManyRefreshTokens is returned.
+// Only the refresh tokens removed are looked at, thanks to the indexes. The mutex must be held, at least for reading.
+func (store *memoryRefreshTokenStore) findRefreshTokensToRemove(limit int, evictOldest bool, now int64) ([]string, error) {
+
+	if (limit <= 0) || (len(store.refreshTokens) < limit) {
+		return nil, nil
+	}
+
+	removedIds := make([]string, 0)
+	timedOutIds := make(map[string]bool)
+	store.byTimeOut.visitInOrder(func(refreshId string, refreshTimeOut int64) bool {
+		if refreshTimeOut >= now {
+			return false
+		}
+		removedIds = append(removedIds, refreshId)
+		timedOutIds[refreshId] = true
+		return true
+	})
+
+	number := len(store.refreshTokens) - len(removedIds) - limit + 1
+	if number <= 0 {
+		return removedIds, nil
+	}
+	if !evictOldest {
+		return nil, errTooManyRefreshTokens
+	}
+
+	store.byCreation.visitInOrder(func(refreshId string, createdAt int64) bool {
+		if !timedOutIds[refreshId] {
+			removedIds = append(removedIds, refreshId)
+			number--
+		}
+		return number > 0
+	})
+
+	return removedIds, nil
+}
+
+// getRevokedAccessTokens returns a snapshot of the revoked access tokens, with their expiration
+func (store *memoryRefreshTokenStore) getRevokedAccessTokens() map[string]int64 {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	revokedAccessTokens := make(map[string]int64, len(store.revokedAccessTokens))
+	for tokenId, expiresAt := range store.revokedAccessTokens {
+		revokedAccessTokens[tokenId] = expiresAt
+	}
+	return revokedAccessTokens
+}
+
+func buildMemoryRefreshTokenStore() *memoryRefreshTokenStore {
+
+	return &memoryRefreshTokenStore{
+		refreshTokens:       make(map[string]*refreshInformation),
+		byTimeOut:           newRefreshTokenIndex(),
+		byCreation:          newRefreshTokenIndex(),
+		revokedAccessTokens: make(map[string]int64),
+	}
+}
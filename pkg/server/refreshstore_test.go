@@ -0,0 +1,315 @@
+package server
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddRemovesTheTimedOutRefreshTokensFirst(t *testing.T) {
+
+	now := time.Now().Unix()
+	store := buildMemoryRefreshTokenStore()
+	store.Add("timed-out", &refreshInformation{refreshTimeOut: now - 10, createdAt: now - 20}, 2, false)
+	store.Add("live", &refreshInformation{refreshTimeOut: now + 10, createdAt: now - 30}, 2, false)
+
+	removed, err := store.Add("new", &refreshInformation{refreshTimeOut: now + 10, createdAt: now}, 2, false)
+	if err != nil || removed != 1 {
+		t.Fatal("The timed out refresh token was not removed for making room: ", removed, err)
+	}
+	if information, _ := store.Get("timed-out"); information != nil {
+		t.Error("The timed out refresh token is still stored")
+	}
+	if information, _ := store.Get("live"); information == nil {
+		t.Error("The live refresh token was removed")
+	}
+}
+
+func TestAddAppliesTheEvictionPolicyAtTheLimit(t *testing.T) {
+
+	now := time.Now().Unix()
+	store := buildMemoryRefreshTokenStore()
+	store.Add("oldest", &refreshInformation{refreshTimeOut: now + 10, createdAt: now - 20}, 2, true)
+	store.Add("newest", &refreshInformation{refreshTimeOut: now + 10, createdAt: now - 10}, 2, true)
+
+	if _, err := store.Add("rejected", &refreshInformation{refreshTimeOut: now + 10, createdAt: now}, 2, false); err != errTooManyRefreshTokens {
+		t.Error("The new refresh token was not rejected at the limit: ", err)
+	}
+
+	removed, err := store.Add("new", &refreshInformation{refreshTimeOut: now + 10, createdAt: now}, 2, true)
+	if err != nil || removed != 1 {
+		t.Fatal("The oldest refresh token was not evicted: ", removed, err)
+	}
+	if information, _ := store.Get("oldest"); information != nil {
+		t.Error("The oldest refresh token is still stored")
+	}
+	if count, _ := store.Count(); count != 2 {
+		t.Error("The store holds ", count, " refresh tokens instead of 2")
+	}
+}
+
+// testConcurrentUseOfRefreshTokenStore adds, consumes, deletes and reads refresh tokens concurrently, checking that
+// each refresh token is consumed only once
+func testConcurrentUseOfRefreshTokenStore(t *testing.T, store refreshTokenStore) {
+
+	const refreshTokens = 50
+	now := time.Now().Unix()
+
+	var wait sync.WaitGroup
+	for index := 0; index < refreshTokens; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			information := &refreshInformation{
+				authenticatedUser: &authenticatedUser{UserName: testUserName},
+				refreshTimeOut:    now + 60,
+				createdAt:         now,
+				familyId:          "family-" + strconv.Itoa(index),
+			}
+			if _, err := store.Add("refresh-"+strconv.Itoa(index), information, 0, true); err != nil {
+				t.Error("Unable to add a refresh token: ", err)
+			}
+			if err := store.Delete("deleted-" + strconv.Itoa(index)); err != nil {
+				t.Error("Unable to delete a refresh token: ", err)
+			}
+		}(index)
+	}
+
+	// Read while the refresh tokens are added
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for index := 0; index < refreshTokens; index++ {
+			if _, err := store.GetAll(); err != nil {
+				t.Error("Unable to read the refresh tokens: ", err)
+			}
+		}
+	}()
+	wait.Wait()
+
+	// Each refresh token is consumed by two concurrent queries, and only one of them can use it
+	consumed := int64(0)
+	for index := 0; index < 2*refreshTokens; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			information, err := store.Consume("refresh-" + strconv.Itoa(index/2))
+			if err != nil || information == nil {
+				t.Error("Unable to consume a refresh token: ", err)
+				return
+			}
+			if !information.consumed {
+				atomic.AddInt64(&consumed, 1)
+			}
+		}(index)
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for index := 0; index < refreshTokens; index++ {
+			snapshot, err := store.GetAll()
+			if err != nil {
+				t.Error("Unable to read the refresh tokens: ", err)
+				return
+			}
+			// The information returned must not be modified by the consumptions
+			for _, information := range snapshot {
+				_ = information.consumed
+			}
+		}
+	}()
+	wait.Wait()
+
+	if consumed != refreshTokens {
+		t.Error(consumed, " refresh tokens were consumed instead of ", refreshTokens)
+	}
+
+	// Remove the refresh tokens concurrently, one by one and in batches
+	for index := 0; index < refreshTokens; index += 2 {
+		wait.Add(2)
+		go func(index int) {
+			defer wait.Done()
+			if err := store.Delete("refresh-" + strconv.Itoa(index)); err != nil {
+				t.Error("Unable to delete a refresh token: ", err)
+			}
+		}(index)
+		go func(index int) {
+			defer wait.Done()
+			if err := store.DeleteMany([]string{"refresh-" + strconv.Itoa(index+1)}); err != nil {
+				t.Error("Unable to delete a refresh token: ", err)
+			}
+		}(index)
+	}
+	wait.Wait()
+
+	if count, _ := store.Count(); count != 0 {
+		t.Error(count, " refresh tokens are left after removing all of them")
+	}
+}
+
+func TestConcurrentUseOfMemoryRefreshTokenStore(t *testing.T) {
+
+	testConcurrentUseOfRefreshTokenStore(t, buildMemoryRefreshTokenStore())
+}
+
+func TestConcurrentUseOfFileRefreshTokenStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "refresh-tokens.log")
+	store, err := buildFileRefreshTokenStore(path)
+	if err != nil {
+		t.Fatal("Unable to open the store: ", err)
+	}
+	testConcurrentUseOfRefreshTokenStore(t, store)
+	store.file.Close()
+
+	// The log replayed gives the same refresh tokens
+	reopenedStore, err := buildFileRefreshTokenStore(path)
+	if err != nil {
+		t.Fatal("Unable to reopen the store: ", err)
+	}
+	defer reopenedStore.file.Close()
+	if count, _ := reopenedStore.Count(); count != 0 {
+		t.Error(count, " refresh tokens are left in the log after removing all of them")
+	}
+}
+
+func TestFailedWritesAreNotLeftInTheRefreshTokenLog(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "refresh.log")
+	store, err := buildFileRefreshTokenStore(path)
+	if err != nil {
+		t.Fatal("Unable to open the store: ", err)
+	}
+
+	now := time.Now().Unix()
+	newInformation := func() *refreshInformation {
+		return &refreshInformation{authenticatedUser: &authenticatedUser{UserName: testUserName}, refreshTimeOut: now + 60, createdAt: now}
+	}
+	if _, err := store.Add("written", newInformation(), 0, false); err != nil {
+		t.Fatal("Unable to add a refresh token: ", err)
+	}
+
+	// The log can no longer be written nor truncated
+	store.file.Close()
+	if store.file, err = os.Open(path); err != nil {
+		t.Fatal("Unable to reopen the log as read only: ", err)
+	}
+	if _, err := store.Add("failed", newInformation(), 0, false); err == nil {
+		t.Fatal("The refresh token was added although the log could not be written")
+	}
+	if store.records != 1 {
+		t.Fatalf("The log counts %d records after a failed write, expected 1", store.records)
+	}
+	if err := store.Delete("written"); err == nil {
+		t.Fatal("The log accepted a write after a failure that could not be removed")
+	}
+
+	// The compaction replaces the broken log
+	if err := store.Compact(); err != nil {
+		t.Fatal("Unable to compact the log: ", err)
+	}
+	if _, err := store.Add("after-compaction", newInformation(), 0, false); err != nil {
+		t.Fatal("Unable to add a refresh token after the compaction: ", err)
+	}
+	store.file.Close()
+
+	reopenedStore, err := buildFileRefreshTokenStore(path)
+	if err != nil {
+		t.Fatal("Unable to reopen the store: ", err)
+	}
+	defer reopenedStore.file.Close()
+	for refreshId, expected := range map[string]bool{"written": true, "failed": false, "after-compaction": true} {
+		if information, _ := reopenedStore.Get(refreshId); (information != nil) != expected {
+			t.Errorf("The refresh token %s is stored: %v, expected %v", refreshId, information != nil, expected)
+		}
+	}
+}
+
+func TestRefreshTokenIndexVisitsInOrder(t *testing.T) {
+
+	index := newRefreshTokenIndex()
+	times := make(map[string]int64)
+	for i := 0; i < 200; i++ {
+		refreshId := strconv.Itoa(i)
+		times[refreshId] = rand.Int63n(100)
+		index.set(refreshId, times[refreshId])
+	}
+	for i := 0; i < 200; i += 3 {
+		refreshId := strconv.Itoa(i)
+		delete(times, refreshId)
+		index.remove(refreshId)
+	}
+	for i := 1; i < 200; i += 6 {
+		refreshId := strconv.Itoa(i)
+		times[refreshId] = rand.Int63n(100)
+		index.set(refreshId, times[refreshId])
+	}
+	index.remove("unknown")
+
+	expected := make([]int64, 0, len(times))
+	for _, time := range times {
+		expected = append(expected, time)
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+	visited := make([]int64, 0, len(times))
+	index.visitInOrder(func(refreshId string, time int64) bool {
+		if times[refreshId] != time {
+			t.Errorf("The refresh token %s is indexed at %d, expected %d", refreshId, time, times[refreshId])
+		}
+		visited = append(visited, time)
+		return true
+	})
+	if !reflect.DeepEqual(visited, expected) {
+		t.Error("The refresh tokens are not visited in order: ", visited)
+	}
+
+	// The visit stops as soon as asked
+	count := 0
+	index.visitInOrder(func(refreshId string, time int64) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Errorf("%d refresh tokens were visited, expected 5", count)
+	}
+}
+
+func TestAddEvictsTheOldestLiveRefreshTokens(t *testing.T) {
+
+	now := time.Now().Unix()
+	store := buildMemoryRefreshTokenStore()
+	store.Add("timed-out-oldest", &refreshInformation{refreshTimeOut: now - 10, createdAt: now - 100}, 0, true)
+	store.Add("timed-out", &refreshInformation{refreshTimeOut: now - 10, createdAt: now - 50}, 0, true)
+	for i := 0; i < 6; i++ {
+		store.Add("live-"+strconv.Itoa(i), &refreshInformation{refreshTimeOut: now + 10, createdAt: now - 40 + int64(i)}, 0, true)
+	}
+	store.Consume("live-0")
+	store.Delete("live-1")
+
+	// At the limit of 4, both the timed out refresh tokens and the 2 oldest live ones must go
+	removed, err := store.Add("new", &refreshInformation{refreshTimeOut: now + 10, createdAt: now}, 4, true)
+	if err != nil || removed != 4 {
+		t.Fatal("The refresh tokens were not removed for making room: ", removed, err)
+	}
+	for _, refreshId := range []string{"timed-out-oldest", "timed-out", "live-0", "live-2"} {
+		if information, _ := store.Get(refreshId); information != nil {
+			t.Errorf("The refresh token %s is still stored", refreshId)
+		}
+	}
+	for _, refreshId := range []string{"live-3", "live-4", "live-5", "new"} {
+		if information, _ := store.Get(refreshId); information == nil {
+			t.Errorf("The refresh token %s was removed", refreshId)
+		}
+	}
+	if (store.byTimeOut.Len() != len(store.refreshTokens)) || (store.byCreation.Len() != len(store.refreshTokens)) {
+		t.Error("The indexes do not have the refresh tokens of the store")
+	}
+}
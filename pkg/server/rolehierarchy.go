@@ -0,0 +1,149 @@
+package server
+
+import "sort"
+
+// Roles given in the tokens when a role hierarchy is configured
+const (
+	tokenRolesExpanded = "expanded"
+	tokenRolesTopLevel = "topLevel"
+)
+
+// roleHierarchy holds the roles implied by other roles (e.g. admin implies editor, that implies viewer). The
+// hierarchy has no cycle, as checked while loading config.
+type roleHierarchy struct {
+	impliedRoles map[string][]string
+	// If true, only the roles not implied by another role of the user are given in the tokens, otherwise all the
+	// roles of the user, including the implied ones
+	topLevelOnly bool
+}
+
+// newRoleHierarchy builds the role hierarchy from the configuration, or returns nil if there is none. The
+// configuration is checked while loading config.
+func newRoleHierarchy(configuration *SsoConfiguration) *roleHierarchy {
+
+	if configuration.RoleHierarchy == nil {
+		return nil
+	}
+
+	hierarchy := &roleHierarchy{
+		impliedRoles: make(map[string][]string),
+	}
+
+	if configuration.RoleHierarchy.Roles != nil {
+		for role, impliedRoles := range *configuration.RoleHierarchy.Roles {
+			hierarchy.impliedRoles[role] = make([]string, 0, len(*impliedRoles))
+			for _, impliedRole := range *impliedRoles {
+				hierarchy.impliedRoles[role] = append(hierarchy.impliedRoles[role], *impliedRole)
+			}
+		}
+	}
+
+	if configuration.RoleHierarchy.TokenRoles != nil {
+		hierarchy.topLevelOnly = *configuration.RoleHierarchy.TokenRoles == tokenRolesTopLevel
+	}
+
+	return hierarchy
+}
+
+// ExpandRoles returns the given roles followed by all the roles they imply, transitively, without duplicate
+func (hierarchy *roleHierarchy) ExpandRoles(roles []string) []string {
+
+	expandedRoles := make([]string, 0, len(roles))
+	for _, role := range roles {
+		expandedRoles = appendMissingString(expandedRoles, role)
+	}
+
+	// The roles appended are expanded in turn. As there is no cycle, this ends.
+	for index := 0; index < len(expandedRoles); index++ {
+		for _, impliedRole := range hierarchy.impliedRoles[expandedRoles[index]] {
+			expandedRoles = appendMissingString(expandedRoles, impliedRole)
+		}
+	}
+
+	return expandedRoles
+}
+
+// TopLevelRoles returns the given roles that are not implied by another of the given roles, without duplicate
+func (hierarchy *roleHierarchy) TopLevelRoles(roles []string) []string {
+
+	topLevelRoles := make([]string, 0, len(roles))
+	for _, role := range roles {
+		implied := false
+		for _, otherRole := range roles {
+			if (otherRole != role) && containsString(hierarchy.ExpandRoles(hierarchy.impliedRoles[otherRole]), role) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			topLevelRoles = appendMissingString(topLevelRoles, role)
+		}
+	}
+
+	return topLevelRoles
+}
+
+// TokenRoles returns the roles given in the tokens for the given roles of a user, that are already expanded
+func (hierarchy *roleHierarchy) TokenRoles(roles []string) []string {
+
+	if hierarchy.topLevelOnly {
+		return hierarchy.TopLevelRoles(roles)
+	}
+
+	return roles
+}
+
+// findRoleHierarchyCycle returns the roles forming a cycle in the given hierarchy (the first role being repeated at
+// the end), or nil if there is no cycle
+func findRoleHierarchyCycle(impliedRoles map[string][]string) []string {
+
+	// The roles are visited in order, so that the same cycle is always reported
+	roles := make([]string, 0, len(impliedRoles))
+	for role := range impliedRoles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	// A role is being visited while its implied roles are, and visited afterwards
+	const (
+		beingVisited = 1
+		visited      = 2
+	)
+	states := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(role string) []string
+	visit = func(role string) []string {
+		switch states[role] {
+		case visited:
+			return nil
+		case beingVisited:
+			// The cycle starts at the first occurrence of the role in the path
+			for index, pathRole := range path {
+				if pathRole == role {
+					return append(append([]string{}, path[index:]...), role)
+				}
+			}
+		}
+
+		states[role] = beingVisited
+		path = append(path, role)
+		for _, impliedRole := range impliedRoles[role] {
+			if cycle := visit(impliedRole); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		states[role] = visited
+
+		return nil
+	}
+
+	for _, role := range roles {
+		if cycle := visit(role); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// newTestRoleHierarchy returns the hierarchy admin -> editor -> viewer, auditor -> viewer
+func newTestRoleHierarchy() *roleHierarchy {
+
+	return &roleHierarchy{
+		impliedRoles: map[string][]string{
+			"admin":   {"editor"},
+			"editor":  {"viewer"},
+			"auditor": {"viewer"},
+		},
+	}
+}
+
+func TestFindRoleHierarchyCycle(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		impliedRoles map[string][]string
+		expected     string
+	}{
+		{"no role", map[string][]string{}, ""},
+		{"no cycle", newTestRoleHierarchy().impliedRoles, ""},
+		{"shared implied role", map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}}, ""},
+		{"role implying itself", map[string][]string{"a": {"a"}}, "a -> a"},
+		{"two roles", map[string][]string{"a": {"b"}, "b": {"a"}}, "a -> b -> a"},
+		{"cycle after a path", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"d"}, "d": {"b"}}, "b -> c -> d -> b"},
+		{"cycle not reachable from the first role", map[string][]string{"a": {"b"}, "x": {"y"}, "y": {"x"}}, "x -> y -> x"},
+	}
+
+	for _, test := range tests {
+		if cycle := strings.Join(findRoleHierarchyCycle(test.impliedRoles), " -> "); cycle != test.expected {
+			t.Errorf("%s: found the cycle %q, expected %q", test.name, cycle, test.expected)
+		}
+	}
+}
+
+func TestExpandRoles(t *testing.T) {
+
+	hierarchy := newTestRoleHierarchy()
+
+	tests := []struct {
+		roles    []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"viewer"}, "viewer"},
+		{[]string{"admin"}, "admin,editor,viewer"},
+		{[]string{"admin", "auditor"}, "admin,auditor,editor,viewer"},
+		{[]string{"editor", "admin", "editor"}, "editor,admin,viewer"},
+		{[]string{"unknown", "auditor"}, "unknown,auditor,viewer"},
+	}
+
+	for _, test := range tests {
+		if roles := strings.Join(hierarchy.ExpandRoles(test.roles), ","); roles != test.expected {
+			t.Errorf("The roles %v are expanded to %s, expected %s", test.roles, roles, test.expected)
+		}
+	}
+}
+
+func TestTopLevelRoles(t *testing.T) {
+
+	hierarchy := newTestRoleHierarchy()
+
+	tests := []struct {
+		roles    []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"viewer"}, "viewer"},
+		{[]string{"admin", "editor", "viewer"}, "admin"},
+		{[]string{"viewer", "admin"}, "admin"},
+		{[]string{"admin", "auditor", "editor", "viewer"}, "admin,auditor"},
+		{[]string{"editor", "auditor"}, "editor,auditor"},
+		{[]string{"unknown", "editor", "unknown", "viewer"}, "unknown,editor"},
+	}
+
+	for _, test := range tests {
+		if roles := strings.Join(hierarchy.TopLevelRoles(test.roles), ","); roles != test.expected {
+			t.Errorf("The top level roles of %v are %s, expected %s", test.roles, roles, test.expected)
+		}
+	}
+}
+
+// newTestRoleResolutionConfiguration returns a configuration where the provider gives the group "group-admin",
+// mapped to the role admin, that implies the roles editor and viewer
+func newTestRoleResolutionConfiguration(t *testing.T, tokenRoles string) *Configuration {
+
+	configuration := newTestConfiguration(t)
+	(*configuration.Basic.Users)[0].Roles = &[]*string{stringPointer("group-admin")}
+	configuration.Sso.RoleMapping = &RoleMappingConfiguration{
+		RoleMappingTableConfiguration: RoleMappingTableConfiguration{
+			Rules: &[]*RoleMappingRuleConfiguration{
+				{Match: stringPointer("prefix"), Group: stringPointer("group-")},
+			},
+		},
+	}
+	configuration.Sso.RoleHierarchy = &RoleHierarchyConfiguration{
+		Roles: &map[string]*[]*string{
+			"admin":  {stringPointer("editor")},
+			"editor": {stringPointer("viewer")},
+			// Only the mapped roles are expanded, never the groups of the providers
+			"group-admin": {stringPointer("auditor")},
+		},
+		TokenRoles: stringPointer(tokenRoles),
+	}
+	configuration.Sso.Scopes = &[]*ScopeConfiguration{
+		{Name: stringPointer("read"), Roles: &[]*string{stringPointer("viewer")}},
+	}
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal("Unable to validate the configuration: ", err)
+	}
+
+	return configuration
+}
+
+func TestRolesAreMappedThenExpanded(t *testing.T) {
+
+	tests := []struct {
+		tokenRoles string
+		expected   string
+	}{
+		{tokenRolesExpanded, "admin,editor,viewer"},
+		{tokenRolesTopLevel, "admin"},
+	}
+
+	for _, test := range tests {
+		engine := newTestEngine(t, newTestRoleResolutionConfiguration(t, test.tokenRoles))
+
+		user, err := engine.Authenticate(testUserName, testPassword, "")
+		if err != nil {
+			t.Fatal("Unable to authenticate the user: ", err)
+		}
+		if roles := strings.Join(user.Roles, ","); roles != "admin,editor,viewer" {
+			t.Errorf("%s: the user has the roles %s, expected the mapped roles expanded", test.tokenRoles, roles)
+		}
+
+		// The scope given to an implied role is granted
+		scopes, err := engine.GrantScopes(user, "", []string{"read"})
+		if (err != nil) || (len(scopes) != 1) {
+			t.Errorf("%s: the scope of an implied role was not granted: %v %v", test.tokenRoles, scopes, err)
+		}
+
+		accessToken, refreshToken := enrollTestUser(t, engine, tokenGrant{})
+		introspection, err := engine.Introspect(accessToken, protocol.TokenTypeHintAccessToken)
+		if err != nil {
+			t.Fatal("Unable to introspect the access token: ", err)
+		}
+		if roles := strings.Join(introspection.Roles, ","); roles != test.expected {
+			t.Errorf("%s: the access token has the roles %s, expected %s", test.tokenRoles, roles, test.expected)
+		}
+
+		// The refreshed token has the same roles
+		response, _, err := engine.Refresh(refreshToken, "", nil)
+		if err != nil {
+			t.Fatal("Unable to refresh the token: ", err)
+		}
+		introspection, err = engine.Introspect(response.AccessToken, protocol.TokenTypeHintAccessToken)
+		if err != nil {
+			t.Fatal("Unable to introspect the refreshed token: ", err)
+		}
+		if roles := strings.Join(introspection.Roles, ","); roles != test.expected {
+			t.Errorf("%s: the refreshed token has the roles %s, expected %s", test.tokenRoles, roles, test.expected)
+		}
+	}
+}
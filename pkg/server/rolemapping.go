@@ -0,0 +1,173 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of match of the rules of the role mapping
+const (
+	roleMatchExact  = "exact"
+	roleMatchPrefix = "prefix"
+	roleMatchRegex  = "regex"
+)
+
+// roleMatches are the kinds of match that can be configured for the rules of the role mapping
+var roleMatches = []string{roleMatchExact, roleMatchPrefix, roleMatchRegex}
+
+// roleMapping holds the tables rewriting the groups given by the providers into the roles of the tokens. A
+// provider uses its own table if it has one, the default table otherwise.
+type roleMapping struct {
+	defaultTable   *roleMappingTable
+	providerTables map[string]*roleMappingTable
+}
+
+// roleMappingTable holds the rules of a table of the role mapping. A group is mapped by all the rules it
+// matches. The default roles are always given.
+type roleMappingTable struct {
+	rules        []*roleMappingRule
+	defaultRoles []string
+	// If true, the groups not matched by any rule are kept as roles, otherwise they are dropped
+	keepUnmapped bool
+}
+
+// roleMappingRule holds a single rule of the role mapping
+type roleMappingRule struct {
+	match string
+	group string
+	// The expression of a regex rule, matching the whole group
+	pattern *regexp.Regexp
+	// The role given, that can use the submatches of a regex rule ($1, ${name}). Empty for a prefix rule giving the
+	// group without its prefix.
+	role string
+}
+
+// newRoleMapping builds the role mapping from the configuration, or returns nil if the groups are not mapped. The
+// configuration is checked while loading config.
+func newRoleMapping(configuration *SsoConfiguration) *roleMapping {
+
+	if configuration.RoleMapping == nil {
+		return nil
+	}
+
+	mapping := &roleMapping{
+		defaultTable:   newRoleMappingTable(configuration.RoleMapping.RoleMappingTableConfiguration),
+		providerTables: make(map[string]*roleMappingTable),
+	}
+
+	if configuration.RoleMapping.Providers != nil {
+		for provider, tableConfiguration := range *configuration.RoleMapping.Providers {
+			mapping.providerTables[provider] = newRoleMappingTable(*tableConfiguration)
+		}
+	}
+
+	return mapping
+}
+
+// newRoleMappingTable builds a table of the role mapping from its configuration
+func newRoleMappingTable(configuration RoleMappingTableConfiguration) *roleMappingTable {
+
+	table := &roleMappingTable{
+		rules:        make([]*roleMappingRule, 0),
+		defaultRoles: make([]string, 0),
+	}
+
+	if configuration.Rules != nil {
+		for _, ruleConfiguration := range *configuration.Rules {
+
+			rule := &roleMappingRule{
+				match: roleMatchExact,
+				group: *ruleConfiguration.Group,
+			}
+			if ruleConfiguration.Match != nil {
+				rule.match = *ruleConfiguration.Match
+			}
+			if ruleConfiguration.Role != nil {
+				rule.role = *ruleConfiguration.Role
+			}
+			if rule.match == roleMatchRegex {
+				rule.pattern = regexp.MustCompile("^(?:" + rule.group + ")$")
+			}
+
+			table.rules = append(table.rules, rule)
+		}
+	}
+
+	if configuration.DefaultRoles != nil {
+		for _, role := range *configuration.DefaultRoles {
+			table.defaultRoles = append(table.defaultRoles, *role)
+		}
+	}
+
+	if configuration.KeepUnmapped != nil {
+		table.keepUnmapped = *configuration.KeepUnmapped
+	}
+
+	return table
+}
+
+// MapRoles returns the roles for the groups given by the provider, without duplicate
+func (mapping *roleMapping) MapRoles(provider string, groups []string) []string {
+
+	table := mapping.providerTables[provider]
+	if table == nil {
+		table = mapping.defaultTable
+	}
+
+	roles := make([]string, 0, len(groups)+len(table.defaultRoles))
+	for _, group := range groups {
+		mapped := false
+		for _, rule := range table.rules {
+			if role, ok := rule.mapGroup(group); ok {
+				roles = appendMissingString(roles, role)
+				mapped = true
+			}
+		}
+		if !mapped && table.keepUnmapped {
+			roles = appendMissingString(roles, group)
+		}
+	}
+
+	for _, role := range table.defaultRoles {
+		roles = appendMissingString(roles, role)
+	}
+
+	return roles
+}
+
+// mapGroup returns the role given by the rule for the group, and false if the rule does not match the group
+func (rule *roleMappingRule) mapGroup(group string) (string, bool) {
+
+	switch rule.match {
+	case roleMatchPrefix:
+		if !strings.HasPrefix(group, rule.group) || len(group) == len(rule.group) {
+			return "", false
+		}
+		if len(rule.role) == 0 {
+			return group[len(rule.group):], true
+		}
+		return rule.role, true
+	case roleMatchRegex:
+		submatches := rule.pattern.FindStringSubmatchIndex(group)
+		if submatches == nil {
+			return "", false
+		}
+		role := string(rule.pattern.ExpandString(nil, rule.role, group, submatches))
+		return role, len(role) > 0
+	default:
+		if group != rule.group {
+			return "", false
+		}
+		return rule.role, true
+	}
+}
+
+// appendMissingString appends the value to the slice if it is not already in it
+func appendMissingString(values []string, value string) []string {
+
+	if containsString(values, value) {
+		return values
+	}
+
+	return append(values, value)
+}
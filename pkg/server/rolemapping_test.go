@@ -0,0 +1,89 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newTestRoleMappingRule returns a rule built as from the configuration
+func newTestRoleMappingRule(match string, group string, role string) *roleMappingRule {
+
+	rule := &roleMappingRule{match: match, group: group, role: role}
+	if match == roleMatchRegex {
+		rule.pattern = regexp.MustCompile("^(?:" + group + ")$")
+	}
+
+	return rule
+}
+
+func TestMapGroup(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		rule     *roleMappingRule
+		group    string
+		expected string
+		matched  bool
+	}{
+		{"exact match", newTestRoleMappingRule(roleMatchExact, "cn-admins", "admin"), "cn-admins", "admin", true},
+		{"exact match is case sensitive", newTestRoleMappingRule(roleMatchExact, "cn-admins", "admin"), "CN-admins", "", false},
+		{"exact match of a longer group", newTestRoleMappingRule(roleMatchExact, "cn-admins", "admin"), "cn-admins-old", "", false},
+		{"prefix without role", newTestRoleMappingRule(roleMatchPrefix, "app-", ""), "app-editor", "editor", true},
+		{"prefix with role", newTestRoleMappingRule(roleMatchPrefix, "app-", "user"), "app-editor", "user", true},
+		{"prefix alone", newTestRoleMappingRule(roleMatchPrefix, "app-", ""), "app-", "", false},
+		{"prefix not at the start", newTestRoleMappingRule(roleMatchPrefix, "app-", ""), "my-app-editor", "", false},
+		{"regex with submatch", newTestRoleMappingRule(roleMatchRegex, "team-(.+)-lead", "lead-$1"), "team-core-lead", "lead-core", true},
+		{"regex with named submatch", newTestRoleMappingRule(roleMatchRegex, "(?P<env>dev|prod)-ops", "ops-${env}"), "prod-ops", "ops-prod", true},
+		{"regex matches the whole group", newTestRoleMappingRule(roleMatchRegex, "team-(.+)-lead", "lead-$1"), "team-core-lead-old", "", false},
+		{"regex with alternatives matches the whole group", newTestRoleMappingRule(roleMatchRegex, "a|b", "letter"), "ab", "", false},
+		{"regex giving an empty role", newTestRoleMappingRule(roleMatchRegex, "team-(.*)", "$1"), "team-", "", false},
+		{"regex without match", newTestRoleMappingRule(roleMatchRegex, "team-(.+)-lead", "lead-$1"), "cn-admins", "", false},
+	}
+
+	for _, test := range tests {
+		role, matched := test.rule.mapGroup(test.group)
+		if (role != test.expected) || (matched != test.matched) {
+			t.Errorf("%s: the group %s is mapped to %q (%v), expected %q (%v)", test.name, test.group, role, matched, test.expected, test.matched)
+		}
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+
+	rules := []*roleMappingRule{
+		newTestRoleMappingRule(roleMatchExact, "cn-admins", "admin"),
+		newTestRoleMappingRule(roleMatchPrefix, "app-", ""),
+		newTestRoleMappingRule(roleMatchRegex, "app-(.+)", "legacy-$1"),
+		newTestRoleMappingRule(roleMatchExact, "cn-editors", "editor"),
+	}
+
+	tests := []struct {
+		name     string
+		table    *roleMappingTable
+		provider string
+		groups   []string
+		expected string
+	}{
+		{"rules are applied in order", &roleMappingTable{rules: rules}, "basic", []string{"app-editor", "cn-admins"}, "editor,legacy-editor,admin"},
+		{"a group is mapped by all its rules", &roleMappingTable{rules: rules}, "basic", []string{"app-viewer"}, "viewer,legacy-viewer"},
+		{"roles are given without duplicate", &roleMappingTable{rules: rules}, "basic", []string{"cn-editors", "app-editor"}, "editor,legacy-editor"},
+		{"unmapped groups are dropped", &roleMappingTable{rules: rules}, "basic", []string{"cn-admins", "cn-users"}, "admin"},
+		{"unmapped groups are kept", &roleMappingTable{rules: rules, keepUnmapped: true}, "basic", []string{"cn-users", "cn-admins"}, "cn-users,admin"},
+		{"default roles are given", &roleMappingTable{rules: rules, defaultRoles: []string{"user", "admin"}}, "basic", []string{"cn-admins"}, "admin,user"},
+		{"default roles without group", &roleMappingTable{defaultRoles: []string{"user"}}, "basic", nil, "user"},
+		{"provider table is used", &roleMappingTable{rules: rules}, "ldap", []string{"cn-admins", "ldap-admins"}, "ldap-admin"},
+	}
+
+	for _, test := range tests {
+		mapping := &roleMapping{
+			defaultTable: test.table,
+			providerTables: map[string]*roleMappingTable{
+				"ldap": {rules: []*roleMappingRule{newTestRoleMappingRule(roleMatchExact, "ldap-admins", "ldap-admin")}},
+			},
+		}
+		if roles := strings.Join(mapping.MapRoles(test.provider, test.groups), ","); roles != test.expected {
+			t.Errorf("%s: the groups %v are mapped to %s, expected %s", test.name, test.groups, roles, test.expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"strings"
+)
+
+// scopeDefinition holds a scope that can be requested for the tokens. A scope is only granted to the users
+// having one of its roles, or to all the users if it has no role.
+type scopeDefinition struct {
+	name  string
+	roles []string
+}
+
+// newScopeDefinitions builds the scopes from the configuration, in the order of the configuration. The
+// configuration is checked while loading config.
+func newScopeDefinitions(configuration *SsoConfiguration) []*scopeDefinition {
+
+	scopes := make([]*scopeDefinition, 0)
+	if configuration.Scopes == nil {
+		return scopes
+	}
+
+	for _, scopeConfiguration := range *configuration.Scopes {
+
+		scope := &scopeDefinition{
+			name:  *scopeConfiguration.Name,
+			roles: make([]string, 0),
+		}
+
+		if scopeConfiguration.Roles != nil {
+			for _, role := range *scopeConfiguration.Roles {
+				scope.roles = append(scope.roles, *role)
+			}
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return scopes
+}
+
+// isGrantedTo returns true if the scope can be granted to a user with the given roles
+func (scope *scopeDefinition) isGrantedTo(roles []string) bool {
+
+	if len(scope.roles) == 0 {
+		return true
+	}
+
+	for _, role := range roles {
+		if containsString(scope.roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseScope reads a scope parameter, a list of scopes separated by spaces (RFC 6749, section 3.3). The
+// duplicated scopes are removed.
+func parseScope(scope string) []string {
+
+	scopes := make([]string, 0)
+	for _, item := range strings.Fields(scope) {
+		if !containsString(scopes, item) {
+			scopes = append(scopes, item)
+		}
+	}
+
+	return scopes
+}
+
+// formatScope writes a list of scopes as a scope parameter
+func formatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
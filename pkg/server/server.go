@@ -2,13 +2,14 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
 )
 
 // AddServer creates a new Authentication server and add its endpoint to the given http mux. Note that the endpoints
-// are added either to the public mux (e.g.: /token, /refresh) or to the private mux(e.g.: /status, /reload-sso-configuration)
+// are added either to the public mux (e.g.: /token, /authorize, /refresh, /revoke) or to the private mux(e.g.: /status, /reload-sso-configuration, /introspect, /metrics)
 // The same http mux can be used for both public and private
 func AddServer(
 	configuration *Configuration,
@@ -32,6 +33,13 @@ func AddServer(
 		return common.ErrBadConfiguration
 	}
 
+	// Open the sinks of the audit events, that are kept when the configuration is reloaded
+	audit, err := newAuditLogger(configuration.Audit)
+	if err != nil {
+		log.Error("Unable to open the sinks of the audit events.")
+		return err
+	}
+
 	log.Info("Creating SSO Engine.")
 
 	// Create an Engine
@@ -42,61 +50,117 @@ func AddServer(
 	}
 
 	// Build the function that will reload needed details from the configuration
-	reloadConfiguration := func(currentEngine ssoEngine) (ssoEngine, func(request *http.Request) error, error) {
-
-		// Load the new configuration
-		configuration, err := getCurrentConfiguration()
-		if err != nil {
-			log.Error("Unable to load the new SSO engine configuration.")
-			return nil, nil, err
-		}
-
-		// Create a new Engine
-		newEngine, err := newSsoEngineKeepingRefreshToken(configuration, currentEngine)
-		if err != nil {
-			log.Error("Unable to load the SSO engine.")
-			return nil, nil, err
-		}
-
-		return newEngine, buildEndpointAuthenticationFunction(*configuration), nil
+	var reloadConfiguration func(currentEngine ssoEngine) (*authServerState, error)
+	if getCurrentConfiguration != nil {
+		reloadConfiguration = buildReloadConfigurationFunction(getCurrentConfiguration)
 	}
 
 	// Create a server
-	var server authServer = authServerImpl{
-		ssoEngine:              engine,
-		endpointAuthentication: buildEndpointAuthenticationFunction(*configuration),
-		reloadConfiguration:    reloadConfiguration,
-	}
+	serverImpl := newAuthServer(
+		newAuthServerState(engine, *configuration),
+		reloadConfiguration,
+		audit)
+	var server authServer = serverImpl
 
 	log.Info("Adding SSO Server Handler.")
 
 	// Add the public endpoints
-	publicServer.HandleFunc("/token", server.handleTokenRequest)
-	publicServer.HandleFunc("/refresh", server.handleRefreshRequest)
+	publicServer.HandleFunc("/token", serverImpl.measure("token", server.handleTokenRequest))
+	publicServer.HandleFunc("/authorize", server.handleAuthorizeRequest)
+	publicServer.HandleFunc("/refresh", serverImpl.measure("refresh", server.handleRefreshRequest))
+	publicServer.HandleFunc("/revoke", server.handleRevokeRequest)
+	publicServer.HandleFunc("/.well-known/jwks.json", server.handleGetKeys)
+	publicServer.HandleFunc("/.well-known/openid-configuration", server.handleGetConfiguration)
 
 	// Add the private endpoints
 	privateServer.HandleFunc("/status", server.handleGetStatus)
-	privateServer.HandleFunc("/reload-sso-configuration", server.handleReloadConfiguration)
+	privateServer.HandleFunc("/reload-sso-configuration", serverImpl.measure("reload-sso-configuration", server.handleReloadConfiguration))
+	privateServer.HandleFunc("/introspect", server.handleIntrospectRequest)
+	privateServer.HandleFunc("/sessions", server.handleGetSessions)
+	privateServer.HandleFunc("/sessions/revoke", server.handleRevokeSessions)
+	privateServer.HandleFunc("/lockouts", server.handleGetLockouts)
+	privateServer.HandleFunc("/lockouts/unlock", server.handleUnlock)
+	privateServer.HandleFunc("/metrics", server.handleGetMetrics)
+	privateServer.HandleFunc("/healthz", server.handleGetHealth)
+	privateServer.HandleFunc("/readyz", server.handleGetReadiness)
+
+	// Start removing the timed out refresh tokens in background
+	sweepSeconds := int64(60)
+	if configuration.Sso.RefreshSweepSeconds != nil {
+		sweepSeconds = *configuration.Sso.RefreshSweepSeconds
+	}
+	go sweepRefreshTokens(func() ssoEngine { return serverImpl.getState().ssoEngine }, time.Duration(sweepSeconds)*time.Second)
+
+	// Start rotating the signing keys in background. As the rotation may be enabled by a reload, the engine in use
+	// is always asked, the rotation being ignored by the engines without rotation.
+	go rotateSigningKeys(func() ssoEngine { return serverImpl.getState().ssoEngine }, signingKeysRotationCheck)
 
 	return nil
 }
 
-// checkAuthorization checks if the query can pass the authorization if any defined
-func buildEndpointAuthenticationFunction(configuration Configuration) func(request *http.Request) error {
+// signingKeysRotationCheck is the interval between two checks of the rotation of the signing keys
+const signingKeysRotationCheck = 10 * time.Second
+
+// rotateSigningKeys asks periodically the current engine to rotate its signing keys
+func rotateSigningKeys(getEngine func() ssoEngine, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := getEngine().RotateSigningKeys(); err != nil {
+			log.Error("Unable to rotate the signing keys")
+		}
+	}
+}
+
+// sweepRefreshTokens asks periodically the current engine to remove the timed out refresh tokens and the forgotten
+// failures. Although the stores are shared by the engines created when reloading the configuration, the engine in
+// use is always asked, so that its lockout policy is applied.
+func sweepRefreshTokens(getEngine func() ssoEngine, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	// If no configuration, skip
-	if (configuration.Sso == nil) || (configuration.Sso.ClientId == nil) || (configuration.Sso.ClientPassword == nil) {
-		return nil
+	for range ticker.C {
+		swept, err := getEngine().SweepRefreshTokens()
+		if err != nil {
+			log.Error("Unable to sweep the timed out RefreshTokens")
+			continue
+		}
+		if swept > 0 {
+			log.Debugf("%d timed out RefreshTokens were removed", swept)
+		}
 	}
+}
 
-	return func(request *http.Request) error {
-		userName, password, ok := request.BasicAuth()
-		if !ok {
-			return common.ErrNoAuthorization
+// buildReloadConfigurationFunction builds the function creating a new state of the server (engine, endpoint
+// protection and trusted proxies) from the current configuration. The previous state is only replaced if the whole
+// new configuration can be used.
+func buildReloadConfigurationFunction(
+	getCurrentConfiguration func() (*Configuration, error)) func(currentEngine ssoEngine) (*authServerState, error) {
+
+	return func(currentEngine ssoEngine) (*authServerState, error) {
+
+		// Load the new configuration
+		configuration, err := getCurrentConfiguration()
+		if err != nil {
+			log.Error("Unable to load the new SSO engine configuration.")
+			return nil, err
 		}
-		if (userName != *configuration.Sso.ClientId) && (password != *configuration.Sso.ClientPassword) {
-			return common.ErrNoAuthorization
+
+		if err := ValidateConfiguration(configuration); err != nil {
+			log.Error("Unable to use the new SSO engine configuration.")
+			return nil, err
 		}
-		return nil
+
+		// Create a new Engine
+		newEngine, err := newSsoEngineKeepingRefreshToken(configuration, currentEngine)
+		if err != nil {
+			log.Error("Unable to load the SSO engine.")
+			return nil, err
+		}
+
+		return newAuthServerState(newEngine, *configuration), nil
 	}
 }
@@ -16,7 +16,45 @@ type authServer interface {
 	// given in a form
 	handleTokenRequest(writer http.ResponseWriter, request *http.Request)
 
+	// handleAuthorizeRequest displays the login page and redirects the authenticated user to the client with
+	// an authorization code
+	handleAuthorizeRequest(writer http.ResponseWriter, request *http.Request)
+
 	// handleRefreshRequest returns (if authorized) a new token associated with the refreshToken
 	// given in a form
 	handleRefreshRequest(writer http.ResponseWriter, request *http.Request)
+
+	// handleRevokeRequest invalidates (if authorized) the refresh token or the access token given in a form
+	handleRevokeRequest(writer http.ResponseWriter, request *http.Request)
+
+	// handleIntrospectRequest returns (if authorized) the information about the token given in a form
+	handleIntrospectRequest(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetSessions returns (if authorized) the active sessions, possibly only the ones of a user
+	handleGetSessions(writer http.ResponseWriter, request *http.Request)
+
+	// handleRevokeSessions invalidates (if authorized) a session or all the sessions of a user
+	handleRevokeSessions(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetLockouts returns (if authorized) the users and the addresses locked because of too many failed
+	// authentications
+	handleGetLockouts(writer http.ResponseWriter, request *http.Request)
+
+	// handleUnlock forgets (if authorized) the failed authentications of a user or of an address
+	handleUnlock(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetMetrics returns (if authorized) the metrics of the server, in the Prometheus text format
+	handleGetMetrics(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetHealth returns OK as long as the server is running, without authentication
+	handleGetHealth(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetReadiness checks the providers and the signing key, without authentication
+	handleGetReadiness(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetKeys returns the public keys used for signing the tokens as a JWKS
+	handleGetKeys(writer http.ResponseWriter, request *http.Request)
+
+	// handleGetConfiguration returns the OpenID Connect discovery document
+	handleGetConfiguration(writer http.ResponseWriter, request *http.Request)
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// readinessCacheDuration is how long the result of the readiness checks is reused, so that the probes (or anyone,
+// as the endpoint is not protected) can not flood the providers with connections
+const readinessCacheDuration = 5 * time.Second
+
+// readinessCache holds the last result of the readiness checks, with the engine that was checked
+type readinessCache struct {
+	mutex     sync.Mutex
+	engine    ssoEngine
+	checkedAt time.Time
+	checks    []*protocol.ReadinessCheck
+}
+
+// getChecks returns the result of the readiness checks of the given engine, running the checks only if the last
+// result is too old or is about another engine. The concurrent queries wait for the same checks.
+func (cache *readinessCache) getChecks(engine ssoEngine) []*protocol.ReadinessCheck {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if (cache.engine != engine) || (time.Since(cache.checkedAt) >= readinessCacheDuration) {
+		cache.checks = engine.CheckReadiness()
+		cache.engine = engine
+		cache.checkedAt = time.Now()
+	}
+
+	return cache.checks
+}
+
+// handleGetHealth returns OK as long as the server is running. It is made for the liveness probes, so it does not
+// require any authentication and does not check anything.
+func (server *authServerImpl) handleGetHealth(writer http.ResponseWriter, request *http.Request) {
+
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.WriteHeader(http.StatusOK)
+	fmt.Fprint(writer, "OK")
+}
+
+// handleGetReadiness checks the providers and the signing key and returns the result of each check as JSON. The
+// status is 200 if all the checks are ok, 503 otherwise. It is made for the readiness probes, so it does not
+// require any authentication, the result of the checks being reused for a few seconds.
+func (server *authServerImpl) handleGetReadiness(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	response := protocol.ReadinessResponse{
+		Status: protocol.ReadinessStatusOk,
+		Checks: server.readiness.getChecks(state.ssoEngine),
+	}
+	for _, check := range response.Checks {
+		if check.Status != protocol.ReadinessStatusOk {
+			response.Status = protocol.ReadinessStatusFailed
+		}
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	status := http.StatusOK
+	if response.Status != protocol.ReadinessStatusOk {
+		status = http.StatusServiceUnavailable
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonResponse)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+func TestReadinessDoesNotPublishTheErrorsOfTheChecks(t *testing.T) {
+
+	server := newTestServer(t, newTestConfiguration(t))
+	server.getState().ssoEngine.(*ssoEngineImpl).providers = []authenticationProvider{unreachableProvider{}}
+
+	recorder := httptest.NewRecorder()
+	server.handleGetReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatal("The readiness with an unreachable provider answered the status ", recorder.Code)
+	}
+	if strings.Contains(recorder.Body.String(), errUnreachableProvider.Error()) {
+		t.Fatal("The readiness published the error of the provider: ", recorder.Body.String())
+	}
+
+	response := protocol.ReadinessResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal("Unable to read the readiness response: ", err)
+	}
+	if (len(response.Checks) != 2) ||
+		(response.Checks[0].Name != "unreachable") ||
+		(response.Checks[0].Status != protocol.ReadinessStatusFailed) ||
+		(response.Checks[1].Status != protocol.ReadinessStatusOk) {
+		t.Fatal("The readiness answered unexpected checks: ", recorder.Body.String())
+	}
+}
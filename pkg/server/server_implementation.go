@@ -3,10 +3,16 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
 )
 
 // errors401 is a map holding the various errors that should (but not must) generate a 401 error in the general context
@@ -14,35 +20,108 @@ var errors401 = map[error]bool{
 	common.ErrRefreshTokenNotFound: true,
 	common.ErrUnauthorized:         true,
 	common.ErrUserNotFound:         true,
+	common.ErrRefreshTooOld:        true,
+	errRefreshTokenReused:          true,
 }
 
 type authServerImpl struct {
+	// The current state of the server (an *authServerState), replaced atomically when the configuration is reloaded
+	state atomic.Value
+	// The mutex serializing the reloads of the configuration
+	reloadMutex sync.Mutex
+	// The function for updating the configuration
+	reloadConfiguration func(currentEngine ssoEngine) (*authServerState, error)
+	// The sinks of the audit events, that are kept when the configuration is reloaded
+	audit *auditLogger
+	// The last result of the readiness checks
+	readiness readinessCache
+}
+
+// authServerState holds all the information of the server that is replaced when the configuration is reloaded.
+// A state is never modified once stored, so that a query always uses a consistent engine and authentication.
+type authServerState struct {
 	// The SSO engine by itself
 	ssoEngine ssoEngine
 	// The optional function protecting the endpoints
-	endpointAuthentication func(request *http.Request) error
-	// The function for updating the configuration
-	reloadConfiguration func(currentEngine ssoEngine) (ssoEngine, func(request *http.Request) error, error)
+	endpointAuthentication endpointAuthenticationFunction
+	// The proxies whose X-Forwarded-For header is used for finding the address of the callers
+	trustedProxies []*net.IPNet
+}
+
+// newAuthServerState builds the state of the server for the given engine and the configuration it was built from
+func newAuthServerState(engine ssoEngine, configuration Configuration) *authServerState {
+
+	return &authServerState{
+		ssoEngine:              engine,
+		endpointAuthentication: buildEndpointAuthenticationFunction(configuration),
+		trustedProxies:         parseTrustedProxies(*configuration.Sso),
+	}
+}
+
+// newAuthServer allocates a new authServerImpl with the given state and audit sinks
+func newAuthServer(
+	state *authServerState,
+	reloadConfiguration func(currentEngine ssoEngine) (*authServerState, error),
+	audit *auditLogger) *authServerImpl {
+
+	server := &authServerImpl{
+		reloadConfiguration: reloadConfiguration,
+		audit:               audit,
+	}
+	server.state.Store(state)
+
+	return server
+}
+
+// getState returns the current state of the server
+func (server *authServerImpl) getState() *authServerState {
+	return server.state.Load().(*authServerState)
 }
 
 // handleGetStatus returns the status of the server
-func (server authServerImpl) handleGetStatus(writer http.ResponseWriter, request *http.Request) {
+func (server *authServerImpl) handleGetStatus(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
 
 	// Check endpoint Authentication
-	if err := checkEndPointAuthentication(server.endpointAuthentication, request, writer); err != nil {
+	if _, err := checkEndPointAuthentication(state.endpointAuthentication, "status", request, writer); err != nil {
 		return
 	}
 
+	// Read the number of refresh tokens currently kept
+	refreshTokenCount, err := state.ssoEngine.GetRefreshTokenStore().Count()
+	if err != nil {
+		log.Error("Unable to read the number of RefreshTokens for the status")
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+	counters := state.ssoEngine.GetRefreshTokenCounters()
+
 	writer.Header().Set("Content-Type", "text/plain")
 	writer.WriteHeader(http.StatusOK)
-	fmt.Fprint(writer, "OK")
+	fmt.Fprintln(writer, "OK")
+	fmt.Fprintf(writer, "refreshTokens.stored: %d\n", refreshTokenCount)
+	fmt.Fprintf(writer, "refreshTokens.issued: %d\n", atomic.LoadInt64(&counters.issued))
+	fmt.Fprintf(writer, "refreshTokens.consumed: %d\n", atomic.LoadInt64(&counters.consumed))
+	fmt.Fprintf(writer, "refreshTokens.reused: %d\n", atomic.LoadInt64(&counters.reused))
+	fmt.Fprintf(writer, "refreshTokens.swept: %d\n", atomic.LoadInt64(&counters.swept))
+	fmt.Fprintf(writer, "refreshTokens.evicted: %d\n", atomic.LoadInt64(&counters.evicted))
+	fmt.Fprintf(writer, "refreshTokens.rejected: %d\n", atomic.LoadInt64(&counters.rejected))
 }
 
 // handleGetStatus reload the configuration of the SSO
-func (server authServerImpl) handleReloadConfiguration(writer http.ResponseWriter, request *http.Request) {
+func (server *authServerImpl) handleReloadConfiguration(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
 
 	// Check endpoint Authentication
-	if err := checkEndPointAuthentication(server.endpointAuthentication, request, writer); err != nil {
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "reload-sso-configuration", request, writer)
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventReload, "", "", nil, err))
 		return
 	}
 
@@ -54,8 +133,13 @@ func (server authServerImpl) handleReloadConfiguration(writer http.ResponseWrite
 		return
 	}
 
-	// Grab a new ssoEngine and an authentication function
-	newSsoEngine, newAuthenticationFunction, err := server.reloadConfiguration(server.ssoEngine)
+	// Only one reload at a time, so that a reload is always based on the latest engine
+	server.reloadMutex.Lock()
+	defer server.reloadMutex.Unlock()
+
+	// Grab a new state, with a new ssoEngine and an authentication function
+	newState, err := server.reloadConfiguration(server.getState().ssoEngine)
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventReload, "", clientId, nil, err))
 	if err != nil {
 		log.Error("Unable to load the configuration - error creating a new SSO engine instance")
 		writer.Header().Set("Content-Type", "text/plain")
@@ -64,8 +148,8 @@ func (server authServerImpl) handleReloadConfiguration(writer http.ResponseWrite
 		return
 	}
 
-	server.ssoEngine = newSsoEngine
-	server.endpointAuthentication = newAuthenticationFunction
+	// Replace the state for all the following queries
+	server.state.Store(newState)
 	writer.Header().Set("Content-Type", "text/plain")
 	writer.WriteHeader(http.StatusOK)
 	fmt.Fprint(writer, "OK")
@@ -73,17 +157,37 @@ func (server authServerImpl) handleReloadConfiguration(writer http.ResponseWrite
 
 // handleTokenRequest returns (if authorized) a new token associated with the user
 // given in a form
-func (server authServerImpl) handleTokenRequest(writer http.ResponseWriter, request *http.Request) {
+func (server *authServerImpl) handleTokenRequest(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// The grants given in a form follow the OAuth 2.0 protocol
+	if isFormRequest(request) {
+		server.handleTokenGrantRequest(state, writer, request)
+		return
+	}
 
 	// Check endpoint Authentication
-	if err := checkEndPointAuthentication(server.endpointAuthentication, request, writer); err != nil {
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "token", request, writer)
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, "", nil, err))
+		return
+	}
+
+	// Check that the client can use the grant
+	if !isGrantAllowedForClient(state.ssoEngine, clientId, protocol.GrantTypePassword) {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, clientId, nil, errClientNotAllowed))
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(writer, "Forbidden")
 		return
 	}
 
 	// Read the parameters of the request
 	decoder := json.NewDecoder(request.Body)
-	var tokenRequest common.TokenRequestBody
-	err := decoder.Decode(&tokenRequest)
+	var tokenRequest protocol.TokenRequestBody
+	err = decoder.Decode(&tokenRequest)
 	if err != nil {
 		log.Debug("Unable to read the request")
 		writer.Header().Set("Content-Type", "text/plain")
@@ -109,10 +213,29 @@ func (server authServerImpl) handleTokenRequest(writer http.ResponseWriter, requ
 		return
 	}
 
+	// Check that the client can request the audiences
+	if err := state.ssoEngine.CheckAudiences(clientId, tokenRequest.Audiences); err != nil {
+		event := newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, clientId, nil, err)
+		event.UserName = tokenRequest.UserName
+		server.auditRequest(request, event)
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The requested audiences can not be given")
+		return
+	}
+
 	// Authenticate the user
-	authenticatedUser, err := server.ssoEngine.Authenticate(tokenRequest.UserName, tokenRequest.Password)
+	authenticatedUser, err := state.ssoEngine.Authenticate(tokenRequest.UserName, tokenRequest.Password, state.getRemoteAddress(request))
 	if err != nil {
-		if errors401[err] {
+		event := newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, clientId, nil, err)
+		event.UserName = tokenRequest.UserName
+		server.auditRequest(request, event)
+		if lockout, ok := err.(*lockoutError); ok {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.Header().Set("Retry-After", strconv.FormatInt(lockout.retryAfter, 10))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(writer, "Too many failed authentications")
+		} else if errors401[err] {
 			writer.Header().Set("Content-Type", "text/plain")
 			writer.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(writer, "Unauthorized")
@@ -124,13 +247,33 @@ func (server authServerImpl) handleTokenRequest(writer http.ResponseWriter, requ
 		return
 	}
 
+	// Grant the scopes requested
+	scopes, err := state.ssoEngine.GrantScopes(authenticatedUser, clientId, parseScope(tokenRequest.Scope))
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, clientId, authenticatedUser, err))
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The requested scope can not be given")
+		return
+	}
+
 	// Enroll the user
-	token, err := server.ssoEngine.Enroll(authenticatedUser)
+	token, err := state.ssoEngine.Enroll(authenticatedUser, tokenGrant{
+		clientId:      clientId,
+		audiences:     tokenRequest.Audiences,
+		scopes:        scopes,
+		remoteAddress: state.getRemoteAddress(request),
+	})
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypePassword, clientId, authenticatedUser, err))
 	if err != nil {
 		if errors401[err] {
 			writer.Header().Set("Content-Type", "text/plain")
 			writer.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(writer, "Unauthorized")
+		} else if err == errTooManyRefreshTokens {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(writer, "Too many sessions, please retry later")
 		} else {
 			writer.Header().Set("Content-Type", "text/plain")
 			writer.WriteHeader(http.StatusInternalServerError)
@@ -153,19 +296,54 @@ func (server authServerImpl) handleTokenRequest(writer http.ResponseWriter, requ
 	writer.Write(jsonResponse)
 }
 
+// handleTokenGrantRequest returns (if authorized) a new token for the grant given in a form, following the
+// RFC 6749. The errors are also returned as defined by the RFC.
+func (server *authServerImpl) handleTokenGrantRequest(state *authServerState, writer http.ResponseWriter, request *http.Request) {
+
+	if err := request.ParseForm(); err != nil {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "unable to read the request")
+		return
+	}
+
+	switch request.PostForm.Get("grant_type") {
+	case protocol.GrantTypeAuthorizationCode:
+		server.handleAuthorizationCodeRequest(state, writer, request)
+	case protocol.GrantTypeClientCredentials:
+		server.handleClientCredentialsRequest(state, writer, request)
+	case protocol.GrantTypeTokenExchange:
+		server.handleTokenExchangeRequest(state, writer, request)
+	default:
+		writeOAuthError(writer, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
 // handleRefreshRequest returns (if authorized) a new token associated with the refreshToken
 // given in a form
-func (server authServerImpl) handleRefreshRequest(writer http.ResponseWriter, request *http.Request) {
+func (server *authServerImpl) handleRefreshRequest(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
 
 	// Check endpoint Authentication
-	if err := checkEndPointAuthentication(server.endpointAuthentication, request, writer); err != nil {
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "refresh", request, writer)
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventRefresh, protocol.GrantTypeRefreshToken, "", nil, err))
+		return
+	}
+
+	// Check that the client can use the grant
+	if !isGrantAllowedForClient(state.ssoEngine, clientId, protocol.GrantTypeRefreshToken) {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventRefresh, protocol.GrantTypeRefreshToken, clientId, nil, errClientNotAllowed))
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(writer, "Forbidden")
 		return
 	}
 
 	// Read the parameters of the request
 	decoder := json.NewDecoder(request.Body)
-	var refreshRequest common.TokenRefreshBody
-	err := decoder.Decode(&refreshRequest)
+	var refreshRequest protocol.TokenRefreshBody
+	err = decoder.Decode(&refreshRequest)
 	if err != nil {
 		log.Debug("Unable to read the request")
 		writer.Header().Set("Content-Type", "text/plain")
@@ -185,12 +363,21 @@ func (server authServerImpl) handleRefreshRequest(writer http.ResponseWriter, re
 	}
 
 	// Refresh the token
-	token, err := server.ssoEngine.Refresh(refreshRequest.RefreshToken)
+	token, authenticatedUser, err := state.ssoEngine.Refresh(refreshRequest.RefreshToken, clientId, parseScope(refreshRequest.Scope))
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventRefresh, protocol.GrantTypeRefreshToken, clientId, authenticatedUser, err))
 	if err != nil {
 		if errors401[err] {
 			writer.Header().Set("Content-Type", "text/plain")
 			writer.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(writer, "Unauthorized")
+		} else if err == errScopeNotAllowed {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, "The requested scope was not granted with the refresh token")
+		} else if err == errTooManyRefreshTokens {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(writer, "Too many sessions, please retry later")
 		} else {
 			writer.Header().Set("Content-Type", "text/plain")
 			writer.WriteHeader(http.StatusInternalServerError)
@@ -213,20 +400,302 @@ func (server authServerImpl) handleRefreshRequest(writer http.ResponseWriter, re
 	writer.Write(jsonResponse)
 }
 
-// checkEndPointAuthentication checks if the query can pass the authorization if any defined
+// handleRevokeRequest invalidates (if authorized) the refresh token or the access token given in a form. As
+// defined by the RFC 7009, the form can either be a JSON or an URL encoded form and the query is successful
+// even if the token is unknown.
+func (server *authServerImpl) handleRevokeRequest(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "revoke", request, writer)
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventRevocation, "", "", nil, err))
+		return
+	}
+
+	// Read the parameters of the request
+	var revocationRequest protocol.TokenRevocationBody
+	if isFormRequest(request) {
+		revocationRequest.Token = request.PostFormValue("token")
+		revocationRequest.TokenTypeHint = request.PostFormValue("token_type_hint")
+	} else {
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&revocationRequest)
+		if err != nil {
+			log.Debug("Unable to read the request")
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, "Unable to read the request")
+			return
+		}
+	}
+
+	// Close the body
+	defer request.Body.Close()
+
+	if len(revocationRequest.Token) == 0 && len(revocationRequest.AccessTokenId) == 0 {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The parameters 'token' or 'accessTokenId' must be given in the query")
+		return
+	}
+
+	// Revoke the token, finding first its user for the audit
+	if len(revocationRequest.Token) > 0 {
+		event := newAuditEvent(protocol.AuditEventRevocation, "", clientId, nil, nil)
+		information, err := state.ssoEngine.Introspect(revocationRequest.Token, revocationRequest.TokenTypeHint)
+		if err == nil && information.Active {
+			event.UserName = information.UserName
+		}
+		err = state.ssoEngine.Revoke(revocationRequest.Token, revocationRequest.TokenTypeHint, clientId)
+		if err != nil {
+			event.Outcome = protocol.AuditOutcomeFailure
+			event.Reason = auditReason(err)
+		}
+		server.auditRequest(request, event)
+		// The tokens of the other clients are ignored, the client not learning that they exist (RFC 7009, section 2.2)
+		if err != nil && err != errTokenNotOwned {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(writer, "Unable to serve the request")
+			return
+		}
+	}
+
+	// Revoke the access token id
+	if len(revocationRequest.AccessTokenId) > 0 {
+		err := state.ssoEngine.RevokeAccessTokenId(revocationRequest.AccessTokenId, clientId)
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventRevocation, "", clientId, nil, err))
+		if err != nil && err != errTokenNotOwned {
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(writer, "Unable to serve the request")
+			return
+		}
+	}
+
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.WriteHeader(http.StatusOK)
+	fmt.Fprint(writer, "OK")
+}
+
+// handleIntrospectRequest returns (if authorized) the information about the token given in a form. As
+// defined by the RFC 7662, the form can either be a JSON or an URL encoded form.
+func (server *authServerImpl) handleIntrospectRequest(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	if _, err := checkEndPointAuthentication(state.endpointAuthentication, "introspect", request, writer); err != nil {
+		return
+	}
+
+	// Read the parameters of the request
+	var introspectionRequest protocol.TokenIntrospectionBody
+	if isFormRequest(request) {
+		introspectionRequest.Token = request.PostFormValue("token")
+		introspectionRequest.TokenTypeHint = request.PostFormValue("token_type_hint")
+	} else {
+		decoder := json.NewDecoder(request.Body)
+		err := decoder.Decode(&introspectionRequest)
+		if err != nil {
+			log.Debug("Unable to read the request")
+			writer.Header().Set("Content-Type", "text/plain")
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, "Unable to read the request")
+			return
+		}
+	}
+
+	// Close the body
+	defer request.Body.Close()
+
+	if len(introspectionRequest.Token) == 0 {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The parameters 'token' was missing in the query")
+		return
+	}
+
+	// Introspect the token
+	introspection, err := state.ssoEngine.Introspect(introspectionRequest.Token, introspectionRequest.TokenTypeHint)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(introspection)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// handleGetKeys returns the public keys used for signing the tokens as a JWKS. As the keys are public, this
+// endpoint is not protected.
+func (server *authServerImpl) handleGetKeys(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(state.ssoEngine.GetPublicKeys())
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=300")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// handleGetConfiguration returns the OpenID Connect discovery document, describing the issuer, the endpoints and
+// the algorithms of the tokens. As the document is public, this endpoint is not protected.
+func (server *authServerImpl) handleGetConfiguration(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// The algorithms of all the published keys, as the tokens of all of them are accepted
+	algorithms := make([]string, 0)
+	for _, key := range state.ssoEngine.GetPublicKeys().Keys {
+		if !containsString(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+
+	issuer := state.ssoEngine.GetIssuer()
+	baseURL := getBaseURL(issuer, request)
+
+	// The claims of the tokens, followed by the ones mapped from the attributes of the users
+	claims := []string{"iss", "sub", "aud", "exp", "iat", "jti", "user", "roles", "azp", "client_id", "scope", "act"}
+	claims = append(claims, state.ssoEngine.GetMappedClaims()...)
+
+	configuration := &protocol.OpenIDConfiguration{
+		Issuer:                           issuer,
+		TokenEndpoint:                    baseURL + "/token",
+		RefreshEndpoint:                  baseURL + "/refresh",
+		RevocationEndpoint:               baseURL + "/revoke",
+		JwksURI:                          baseURL + "/.well-known/jwks.json",
+		AuthorizationEndpoint:            baseURL + "/authorize",
+		GrantTypesSupported:              []string{"password", protocol.GrantTypeAuthorizationCode, protocol.GrantTypeClientCredentials, protocol.GrantTypeTokenExchange},
+		ResponseTypesSupported:           []string{"code"},
+		CodeChallengeMethodsSupported:    []string{"S256"},
+		TokenEndpointAuthMethods:         []string{"none", "client_secret_basic", "client_secret_post"},
+		SubjectTypesSupported:            []string{"public"},
+		IdTokenSigningAlgValuesSupported: algorithms,
+		ClaimsSupported:                  claims,
+		ScopesSupported:                  state.ssoEngine.GetSupportedScopes(),
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(configuration)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=300")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// getBaseURL returns the URL of the public endpoints. If the issuer is an URL (as expected by OpenID Connect),
+// the endpoints are relative to the issuer. Otherwise, the URL is built from the request.
+func getBaseURL(issuer string, request *http.Request) string {
+
+	if strings.HasPrefix(issuer, "https://") || strings.HasPrefix(issuer, "http://") {
+		return strings.TrimSuffix(issuer, "/")
+	}
+
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + request.Host
+}
+
+// containsString returns true if the value is in the list
+func containsString(list []string, value string) bool {
+
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auditRequest completes the given audit event with the address of the caller of the request and emits it
+func (server *authServerImpl) auditRequest(request *http.Request, event *protocol.AuditEvent) {
+
+	event.RemoteAddress = server.getState().getRemoteAddress(request)
+	server.audit.Emit(event)
+}
+
+// isFormRequest returns true if the body of the request is an URL encoded form
+func isFormRequest(request *http.Request) bool {
+
+	return strings.HasPrefix(request.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+// checkEndPointAuthentication checks if the query can pass the authorization if any defined. Returns the id of
+// the authenticated client, empty if the end point is not protected
 func checkEndPointAuthentication(
-	checkAuthentication func(request *http.Request) error,
+	checkAuthentication endpointAuthenticationFunction,
+	endpoint string,
 	request *http.Request,
-	writer http.ResponseWriter) error {
+	writer http.ResponseWriter) (string, error) {
 
 	if checkAuthentication == nil {
-		return nil
+		return "", nil
 	}
 
-	if err := checkAuthentication(request); err != nil {
+	clientId, err := checkAuthentication(request, endpoint)
+	if err == errClientNotAllowed {
+		http.Error(writer, "Forbidden", http.StatusForbidden)
+		return "", err
+	}
+	if err != nil {
 		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-		return common.ErrNoAuthorization
+		return "", common.ErrNoAuthorization
+	}
+
+	return clientId, nil
+}
+
+// isGrantAllowedForClient returns true if the given client can use the given grant. The clients that are not
+// registered (or the shared client) are not restricted.
+func isGrantAllowedForClient(engine ssoEngine, clientId string, grantType string) bool {
+
+	client := engine.GetClient(clientId)
+	if client == nil {
+		return true
 	}
 
-	return nil
+	return client.isGrantAllowed(grantType)
 }
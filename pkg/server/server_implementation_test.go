@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// postJSON sends the given body as JSON to the given handler and returns the response. If a client is given, it
+// authenticates with testClientSecret.
+func postJSON(handler http.HandlerFunc, path string, clientId string, body interface{}) *httptest.ResponseRecorder {
+
+	content, _ := json.Marshal(body)
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(content))
+	request.Header.Set("Content-Type", "application/json")
+	if len(clientId) > 0 {
+		request.SetBasicAuth(clientId, testClientSecret)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+// requestTestToken authenticates testUserName on /token, with the given client if not empty, and returns the
+// response
+func requestTestToken(t *testing.T, server *authServerImpl, clientId string) *protocol.AuthenticationResponse {
+
+	body := protocol.TokenRequestBody{}
+	body.UserName = testUserName
+	body.Password = testPassword
+
+	recorder := postJSON(server.handleTokenRequest, "/token", clientId, body)
+	if recorder.Code != http.StatusOK {
+		t.Error("The token request failed with the status ", recorder.Code)
+		return nil
+	}
+
+	var response protocol.AuthenticationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Error("Unable to read the token response: ", err)
+		return nil
+	}
+	return &response
+}
+
+// requestTestRefresh refreshes the given refresh token on /refresh and returns the response
+func requestTestRefresh(t *testing.T, server *authServerImpl, refreshToken string) *protocol.AuthenticationResponse {
+
+	body := protocol.TokenRefreshBody{}
+	body.RefreshToken = refreshToken
+
+	recorder := postJSON(server.handleRefreshRequest, "/refresh", "", body)
+	if recorder.Code != http.StatusOK {
+		t.Error("The refresh request failed with the status ", recorder.Code)
+		return nil
+	}
+
+	var response protocol.AuthenticationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Error("Unable to read the refresh response: ", err)
+		return nil
+	}
+	return &response
+}
+
+func TestTokenAndRefreshDuringConfigurationReloads(t *testing.T) {
+
+	server := newTestServer(t, newTestConfiguration(t))
+
+	var wait sync.WaitGroup
+
+	// Reload the configuration while the tokens are requested, each reload replacing the engine
+	stopReloads := make(chan struct{})
+	reloadsDone := make(chan struct{})
+	go func() {
+		defer close(reloadsDone)
+		for {
+			select {
+			case <-stopReloads:
+				return
+			default:
+			}
+			recorder := httptest.NewRecorder()
+			server.handleReloadConfiguration(recorder, httptest.NewRequest(http.MethodPost, "/reload-sso-configuration", nil))
+			if recorder.Code != http.StatusOK {
+				t.Error("The reload failed with the status ", recorder.Code)
+				return
+			}
+		}
+	}()
+
+	for user := 0; user < 8; user++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			response := requestTestToken(t, server, "")
+			for refresh := 0; (response != nil) && (refresh < 10); refresh++ {
+				response = requestTestRefresh(t, server, response.RefreshToken)
+			}
+		}()
+	}
+
+	wait.Wait()
+	close(stopReloads)
+	<-reloadsDone
+}
+
+func TestConcurrentRefreshesOfTheSameToken(t *testing.T) {
+
+	server := newTestServer(t, newTestConfiguration(t))
+	response := requestTestToken(t, server, "")
+	if response == nil {
+		t.FailNow()
+	}
+
+	body := protocol.TokenRefreshBody{}
+	body.RefreshToken = response.RefreshToken
+
+	// Only one of the concurrent refreshes can consume the refresh token
+	statuses := make(chan int, 10)
+	var wait sync.WaitGroup
+	for index := 0; index < cap(statuses); index++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			statuses <- postJSON(server.handleRefreshRequest, "/refresh", "", body).Code
+		}()
+	}
+	wait.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		} else if status != http.StatusUnauthorized {
+			t.Error("A refresh failed with the unexpected status ", status)
+		}
+	}
+	if succeeded != 1 {
+		t.Error(succeeded, " refreshes succeeded with the same refresh token")
+	}
+
+	// As the refresh token was reused, it is revoked
+	_, _, err := server.getState().ssoEngine.Refresh(response.RefreshToken, "", nil)
+	if err != common.ErrRefreshTokenNotFound {
+		t.Error("The reused refresh token is still known: ", err)
+	}
+}
+
+func TestReloadReplacesTheEngineAndKeepsTheRefreshTokens(t *testing.T) {
+
+	server := newTestServer(t, newTestConfiguration(t))
+	previousEngine := server.getState().ssoEngine
+	response := requestTestToken(t, server, "")
+	if response == nil {
+		t.FailNow()
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleReloadConfiguration(recorder, httptest.NewRequest(http.MethodPost, "/reload-sso-configuration", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The reload failed with the status ", recorder.Code)
+	}
+
+	if server.getState().ssoEngine == previousEngine {
+		t.Error("The engine was not replaced by the reload")
+	}
+	if requestTestRefresh(t, server, response.RefreshToken) == nil {
+		t.Error("The refresh token obtained before the reload can not be used")
+	}
+}
+
+// isTokenActive returns true if the given token is active according to the engine of the server
+func isTokenActive(t *testing.T, server *authServerImpl, token string) bool {
+
+	introspection, err := server.getState().ssoEngine.Introspect(token, "")
+	if err != nil {
+		t.Fatal("Unable to introspect the token: ", err)
+	}
+	return introspection.Active
+}
+
+func TestRevokeIgnoresTheTokensOfAnotherClient(t *testing.T) {
+
+	server := newTestServer(t, newTestConfigurationWithClients(t, "client-a", "client-b"))
+	response := requestTestToken(t, server, "client-a")
+	if response == nil {
+		t.FailNow()
+	}
+
+	// The tokens of client A are ignored when client B revokes them, but the query succeeds (RFC 7009, section 2.2)
+	for _, token := range []string{response.RefreshToken, response.AccessToken} {
+		recorder := postJSON(server.handleRevokeRequest, "/revoke", "client-b", protocol.TokenRevocationBody{Token: token})
+		if recorder.Code != http.StatusOK {
+			t.Error("The revocation of a token of another client failed with the status ", recorder.Code)
+		}
+		if !isTokenActive(t, server, token) {
+			t.Error("A client revoked a token of another client")
+		}
+	}
+
+	// Client A can revoke its own tokens
+	for _, token := range []string{response.RefreshToken, response.AccessToken} {
+		recorder := postJSON(server.handleRevokeRequest, "/revoke", "client-a", protocol.TokenRevocationBody{Token: token})
+		if recorder.Code != http.StatusOK {
+			t.Error("The revocation of a token of the client failed with the status ", recorder.Code)
+		}
+		if isTokenActive(t, server, token) {
+			t.Error("A client could not revoke its own token")
+		}
+	}
+}
+
+func TestRevokeRefusesTheAccessTokenIdsFromRegisteredClients(t *testing.T) {
+
+	server := newTestServer(t, newTestConfigurationWithClients(t, "client-a", "client-b"))
+	response := requestTestToken(t, server, "client-a")
+	if response == nil {
+		t.FailNow()
+	}
+	introspection, _ := server.getState().ssoEngine.Introspect(response.AccessToken, protocol.TokenTypeHintAccessToken)
+
+	// As the client of a token id is not known, a registered client can not revoke it, even its own
+	for _, clientId := range []string{"client-a", "client-b"} {
+		recorder := postJSON(server.handleRevokeRequest, "/revoke", clientId, protocol.TokenRevocationBody{AccessTokenId: introspection.TokenId})
+		if recorder.Code != http.StatusOK {
+			t.Error("The revocation of an access token id failed with the status ", recorder.Code)
+		}
+		if !isTokenActive(t, server, response.AccessToken) {
+			t.Error("A registered client revoked an access token by its id")
+		}
+	}
+}
+
+// introspectTestToken introspects the given token with the given client on /introspect and returns the response
+func introspectTestToken(t *testing.T, server *authServerImpl, clientId string, token string) *httptest.ResponseRecorder {
+
+	recorder := postJSON(server.handleIntrospectRequest, "/introspect", clientId, protocol.TokenIntrospectionBody{Token: token})
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The introspection failed with the status ", recorder.Code)
+	}
+	return recorder
+}
+
+// newIntrospectionTestServer returns a server with the client "resource-server" allowed on the introspection
+// endpoint and the client "client-a" only allowed on the public endpoints
+func newIntrospectionTestServer(t *testing.T) *authServerImpl {
+
+	configuration := newTestConfigurationWithClients(t, "resource-server", "client-a")
+	(*configuration.Clients)[0].AllowedEndpoints = &[]*string{stringPointer("introspect")}
+
+	return newTestServer(t, configuration)
+}
+
+func TestIntrospectActiveTokens(t *testing.T) {
+
+	server := newIntrospectionTestServer(t)
+	response := requestTestToken(t, server, "client-a")
+	if response == nil {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		token     string
+		tokenType string
+	}{
+		{response.AccessToken, protocol.TokenTypeHintAccessToken},
+		{response.RefreshToken, protocol.TokenTypeHintRefreshToken},
+	}
+
+	for _, test := range tests {
+		recorder := introspectTestToken(t, server, "resource-server", test.token)
+
+		var introspection protocol.IntrospectionResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &introspection); err != nil {
+			t.Fatal("Unable to read the introspection: ", err)
+		}
+		if !introspection.Active || (introspection.TokenType != test.tokenType) {
+			t.Errorf("%s: the token is introspected as %+v", test.tokenType, introspection)
+		}
+		if (introspection.UserName != testUserName) || (introspection.ClientId != "client-a") || (introspection.ExpiresAt == 0) {
+			t.Errorf("%s: the introspection does not describe the token: %+v", test.tokenType, introspection)
+		}
+	}
+
+	// The token type hint can be given in a form
+	form := url.Values{"token": {response.RefreshToken}, "token_type_hint": {protocol.TokenTypeHintRefreshToken}}
+	request := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("resource-server", testClientSecret)
+	recorder := httptest.NewRecorder()
+	server.handleIntrospectRequest(recorder, request)
+	if (recorder.Code != http.StatusOK) || !strings.Contains(recorder.Body.String(), `"active":true`) {
+		t.Error("The introspection of a form failed: ", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestIntrospectInactiveTokens(t *testing.T) {
+
+	server := newIntrospectionTestServer(t)
+	response := requestTestToken(t, server, "client-a")
+	if response == nil {
+		t.FailNow()
+	}
+
+	// A consumed refresh token is no longer active
+	refreshBody := protocol.TokenRefreshBody{}
+	refreshBody.RefreshToken = response.RefreshToken
+	if recorder := postJSON(server.handleRefreshRequest, "/refresh", "client-a", refreshBody); recorder.Code != http.StatusOK {
+		t.Fatal("The refresh request failed with the status ", recorder.Code)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unknown token", "unknown-token"},
+		{"consumed refresh token", response.RefreshToken},
+		{"access token with a wrong signature", response.AccessToken[:len(response.AccessToken)-4] + "AAAA"},
+	}
+
+	// As defined by the RFC 7662, nothing but the state is given for a token that is not active
+	for _, test := range tests {
+		recorder := introspectTestToken(t, server, "resource-server", test.token)
+		if body := strings.TrimSpace(recorder.Body.String()); body != `{"active":false}` {
+			t.Errorf("%s: the token is introspected as %s", test.name, body)
+		}
+	}
+
+	if recorder := postJSON(server.handleIntrospectRequest, "/introspect", "resource-server", protocol.TokenIntrospectionBody{}); recorder.Code != http.StatusBadRequest {
+		t.Error("An introspection without token was accepted, status ", recorder.Code)
+	}
+}
+
+// getTestDiscovery reads the discovery document of the server, requested on the given host
+func getTestDiscovery(t *testing.T, server *authServerImpl, host string) *protocol.OpenIDConfiguration {
+
+	request := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+	request.Host = host
+	recorder := httptest.NewRecorder()
+	server.handleGetConfiguration(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The discovery document can not be read, status ", recorder.Code)
+	}
+
+	var configuration protocol.OpenIDConfiguration
+	if err := json.Unmarshal(recorder.Body.Bytes(), &configuration); err != nil {
+		t.Fatal("Unable to read the discovery document: ", err)
+	}
+	return &configuration
+}
+
+func TestDiscoveryDocumentDescribesTheServer(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	configuration.Sso.Issuer = stringPointer("https://sso.example.com/")
+	discovery := getTestDiscovery(t, newTestServer(t, configuration), "internal:8080")
+
+	// The endpoints are relative to an issuer given as an URL
+	if (discovery.Issuer != "https://sso.example.com/") ||
+		(discovery.TokenEndpoint != "https://sso.example.com/token") ||
+		(discovery.JwksURI != "https://sso.example.com/.well-known/jwks.json") {
+		t.Errorf("The discovery document does not use the issuer: %+v", discovery)
+	}
+	if (len(discovery.IdTokenSigningAlgValuesSupported) != 1) || (discovery.IdTokenSigningAlgValuesSupported[0] != "ES256") {
+		t.Error("The discovery document does not give the algorithm of the keys: ", discovery.IdTokenSigningAlgValuesSupported)
+	}
+	if !containsString(discovery.ClaimsSupported, "roles") || !containsString(discovery.GrantTypesSupported, protocol.GrantTypeClientCredentials) {
+		t.Errorf("The discovery document does not give the claims or the grants: %+v", discovery)
+	}
+
+	// Otherwise, they are relative to the host of the request
+	discovery = getTestDiscovery(t, newTestServer(t, newTestConfiguration(t)), "sso.example.org")
+	if discovery.TokenEndpoint != "http://sso.example.org/token" {
+		t.Error("The endpoints are not relative to the host of the request: ", discovery.TokenEndpoint)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// handleGetLockouts returns (if authorized) the users and the addresses locked because of too many failed
+// authentications, as a JSON list
+func (server *authServerImpl) handleGetLockouts(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	_, err := checkEndPointAuthentication(state.endpointAuthentication, "lockouts", request, writer)
+	if err != nil {
+		return
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(state.ssoEngine.GetLockouts())
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// handleUnlock forgets (if authorized) the failed authentications of the user, of the address or of both given in
+// the query
+func (server *authServerImpl) handleUnlock(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "lockouts", request, writer)
+	if err != nil {
+		return
+	}
+
+	// Read the parameters of the request
+	decoder := json.NewDecoder(request.Body)
+	var unlockRequest protocol.UnlockBody
+	err = decoder.Decode(&unlockRequest)
+	if err != nil {
+		log.Debug("Unable to read the request")
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "Unable to read the request")
+		return
+	}
+
+	// Close the body
+	defer request.Body.Close()
+
+	if len(unlockRequest.UserName) == 0 && len(unlockRequest.RemoteAddress) == 0 {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The parameter 'userName' or 'remoteAddress' must be given in the query")
+		return
+	}
+
+	unlocked := state.ssoEngine.Unlock(unlockRequest.UserName, unlockRequest.RemoteAddress)
+
+	// Keep a trace of who unlocked
+	event := newAuditEvent(protocol.AuditEventUnlock, "", clientId, nil, nil)
+	event.UserName = unlockRequest.UserName
+	event.TargetAddress = unlockRequest.RemoteAddress
+	server.auditRequest(request, event)
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(&protocol.UnlockResponse{Unlocked: unlocked})
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
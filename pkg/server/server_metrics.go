@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statusRecorder keeps the status sent by a handler, for measuring the queries
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// measure wraps the given handler so that the number, the outcome and the duration of its queries are kept in
+// the metrics of the server
+func (server *authServerImpl) measure(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		handler(recorder, request)
+
+		// The metrics are shared by all the engines, so the current one can be used
+		server.getState().ssoEngine.GetMetrics().ObserveRequest(endpoint, recorder.status, time.Since(start))
+	}
+}
+
+// handleGetMetrics returns (if authorized) the metrics of the server, in the Prometheus text format
+func (server *authServerImpl) handleGetMetrics(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	if _, err := checkEndPointAuthentication(state.endpointAuthentication, "metrics", request, writer); err != nil {
+		return
+	}
+
+	// Count the refresh tokens kept and the ones that can still be used
+	refreshTokens, err := state.ssoEngine.GetRefreshTokenStore().GetAll()
+	if err != nil {
+		log.Error("Unable to read the RefreshTokens for the metrics")
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+	now := time.Now().Unix()
+	activeRefreshTokens := int64(0)
+	for _, refreshInformation := range refreshTokens {
+		if !refreshInformation.consumed && refreshInformation.refreshTimeOut >= now {
+			activeRefreshTokens++
+		}
+	}
+
+	// Write everything before sending, so that a scrape is consistent
+	var content bytes.Buffer
+	state.ssoEngine.GetMetrics().Write(&content)
+
+	counters := state.ssoEngine.GetRefreshTokenCounters()
+	refreshTokenEvents := newCounterVec(
+		"easysso_refresh_tokens_events_total",
+		"The number of events in the life of the refresh tokens, by event.",
+		"event")
+	for event, counter := range map[string]*int64{
+		"issued":   &counters.issued,
+		"consumed": &counters.consumed,
+		"reused":   &counters.reused,
+		"swept":    &counters.swept,
+		"evicted":  &counters.evicted,
+		"rejected": &counters.rejected,
+	} {
+		refreshTokenEvents.Add(uint64(atomic.LoadInt64(counter)), event)
+	}
+	refreshTokenEvents.Write(&content)
+
+	writeGauge(&content, "easysso_refresh_tokens_stored", "The number of refresh tokens kept, including the consumed ones.", int64(len(refreshTokens)))
+	writeGauge(&content, "easysso_refresh_tokens_active", "The number of refresh tokens that can still be used.", activeRefreshTokens)
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(content.Bytes())
+}
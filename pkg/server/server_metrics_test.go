@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// getTestMetrics reads the metrics with the given client and returns the response
+func getTestMetrics(server *authServerImpl, clientId string) *httptest.ResponseRecorder {
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.SetBasicAuth(clientId, testClientSecret)
+	recorder := httptest.NewRecorder()
+	server.handleGetMetrics(recorder, request)
+	return recorder
+}
+
+func TestMetricsAreOnlyAllowedToTheirClients(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "monitoring", "client-a")
+	(*configuration.Clients)[0].AllowedEndpoints = &[]*string{stringPointer("metrics")}
+	server := newTestServer(t, configuration)
+
+	if recorder := getTestMetrics(server, "client-a"); recorder.Code != http.StatusForbidden {
+		t.Error("A client not allowed read the metrics, status ", recorder.Code)
+	}
+	if recorder := getTestMetrics(server, "monitoring"); recorder.Code != http.StatusOK {
+		t.Error("The client allowed can not read the metrics, status ", recorder.Code)
+	}
+}
+
+func TestMetricsCountTheQueriesAndTheRefreshTokens(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "monitoring", "client-a")
+	(*configuration.Clients)[0].AllowedEndpoints = &[]*string{stringPointer("metrics")}
+	server := newTestServer(t, configuration)
+	handleTokenRequest := server.measure("token", server.handleTokenRequest)
+
+	if requestTestToken(t, server, "client-a") == nil {
+		t.FailNow()
+	}
+	body := protocol.TokenRequestBody{}
+	body.UserName = testUserName
+	body.Password = "wrong-password"
+	for i := 0; i < 2; i++ {
+		if recorder := postJSON(handleTokenRequest, "/token", "client-a", body); recorder.Code != http.StatusUnauthorized {
+			t.Fatal("The authentication with a wrong password answered the status ", recorder.Code)
+		}
+	}
+
+	recorder := getTestMetrics(server, "monitoring")
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The metrics can not be read, status ", recorder.Code)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Error("The metrics are not in the Prometheus text format: ", recorder.Header().Get("Content-Type"))
+	}
+
+	metrics := recorder.Body.String()
+	for _, expected := range []string{
+		`easysso_requests_total{endpoint="token",outcome="failure"} 2`,
+		`easysso_request_duration_seconds_count{endpoint="token",outcome="failure"} 2`,
+		`easysso_refresh_tokens_events_total{event="issued"} 1`,
+		`easysso_refresh_tokens_events_total{event="consumed"} 0`,
+		`easysso_refresh_tokens_stored 1`,
+		`easysso_refresh_tokens_active 1`,
+		`easysso_token_signing_duration_seconds_count{algorithm="ES256"} 1`,
+		`# TYPE easysso_provider_authentication_duration_seconds histogram`,
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("The metrics do not have the line %s:\n%s", expected, metrics)
+		}
+	}
+
+	// The query not measured is not counted
+	if strings.Contains(metrics, `easysso_requests_total{endpoint="token",outcome="success"}`) {
+		t.Error("A query not measured is counted")
+	}
+}
+
+func TestHistogramsHaveCumulativeBuckets(t *testing.T) {
+
+	histogram := newHistogramVec("test_duration_seconds", "A test.", "endpoint")
+	histogram.Observe((3 * time.Millisecond).Seconds(), `a"b`)
+	histogram.Observe((30 * time.Millisecond).Seconds(), `a"b`)
+	histogram.Observe((20 * time.Second).Seconds(), `a"b`)
+
+	var content strings.Builder
+	histogram.Write(&content)
+
+	for _, expected := range []string{
+		`test_duration_seconds_bucket{endpoint="a\"b",le="0.005"} 1`,
+		`test_duration_seconds_bucket{endpoint="a\"b",le="0.025"} 1`,
+		`test_duration_seconds_bucket{endpoint="a\"b",le="0.05"} 2`,
+		`test_duration_seconds_bucket{endpoint="a\"b",le="10"} 2`,
+		`test_duration_seconds_bucket{endpoint="a\"b",le="+Inf"} 3`,
+		`test_duration_seconds_count{endpoint="a\"b"} 3`,
+	} {
+		if !strings.Contains(content.String(), expected+"\n") {
+			t.Errorf("The histogram does not have the line %s:\n%s", expected, content.String())
+		}
+	}
+}
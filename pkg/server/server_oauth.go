@@ -0,0 +1,439 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// codeChallengePattern is the format of a S256 code challenge: the base64url encoding of a SHA-256 hash
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// loginPageTemplate is the page displayed by the authorize endpoint for authenticating the user
+var loginPageTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 5em auto; padding: 2em; background: #fff; border-radius: 4px; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.3em 0 1em 0; padding: 0.5em; }
+button { padding: 0.6em; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post">
+<h1>Sign in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+{{range .Audiences}}<input type="hidden" name="audience" value="{{.}}">
+{{end}}{{if .Scope}}<input type="hidden" name="scope" value="{{.Scope}}">
+{{end}}<label for="userName">User name</label>
+<input id="userName" name="userName" value="{{.UserName}}" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// loginPage holds the values displayed in the login page
+type loginPage struct {
+	ClientId      string
+	RedirectURI   string
+	State         string
+	CodeChallenge string
+	Audiences     []string
+	Scope         string
+	UserName      string
+	Error         string
+}
+
+// handleAuthorizeRequest starts the authorization code flow (RFC 6749, with PKCE as defined by the RFC 7636). The
+// login page is displayed for a GET query. When the form is posted, the user is authenticated and redirected to
+// the client with an authorization code. As this endpoint is used by the browsers, it is not protected.
+func (server *authServerImpl) handleAuthorizeRequest(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	if (request.Method != http.MethodGet) && (request.Method != http.MethodPost) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprint(writer, "Method not allowed")
+		return
+	}
+
+	if err := request.ParseForm(); err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "Unable to read the request")
+		return
+	}
+
+	page := &loginPage{
+		ClientId:      request.Form.Get("client_id"),
+		RedirectURI:   request.Form.Get("redirect_uri"),
+		State:         request.Form.Get("state"),
+		CodeChallenge: request.Form.Get("code_challenge"),
+		Audiences:     request.Form["audience"],
+		Scope:         request.Form.Get("scope"),
+	}
+
+	// The user is not redirected to an URI that is not registered for the client (RFC 6749, section 4.1.2.1)
+	client := state.ssoEngine.GetClient(page.ClientId)
+	if client == nil || !client.isRedirectURIAllowed(page.RedirectURI) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"clientId": page.ClientId,
+		}).Warn("An authorization was requested for an unknown client or redirect URI")
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "The client or the redirect URI is not registered")
+		return
+	}
+
+	// The other errors are returned to the client
+	if request.Form.Get("response_type") != "code" {
+		redirectToClient(writer, request, page.RedirectURI, url.Values{"error": {"unsupported_response_type"}, "state": {page.State}})
+		return
+	}
+	if !client.isGrantAllowed(protocol.GrantTypeAuthorizationCode) {
+		redirectToClient(writer, request, page.RedirectURI, url.Values{"error": {"unauthorized_client"}, "state": {page.State}})
+		return
+	}
+	if err := state.ssoEngine.CheckAudiences(page.ClientId, page.Audiences); err != nil {
+		redirectToClient(writer, request, page.RedirectURI, url.Values{"error": {"invalid_target"}, "state": {page.State}})
+		return
+	}
+	if !codeChallengePattern.MatchString(page.CodeChallenge) || request.Form.Get("code_challenge_method") != "S256" {
+		redirectToClient(writer, request, page.RedirectURI, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"a S256 code challenge is required"},
+			"state":             {page.State},
+		})
+		return
+	}
+
+	// Display the login page
+	if request.Method == http.MethodGet {
+		writeLoginPage(writer, http.StatusOK, page)
+		return
+	}
+
+	// Authenticate the user. The credentials are never given empty to the providers, as an LDAP would accept a bind
+	// without password as an anonymous bind.
+	page.UserName = request.PostForm.Get("userName")
+	password := request.PostForm.Get("password")
+	if len(page.UserName) == 0 || len(password) == 0 {
+		page.Error = "The user name and the password are required"
+		writeLoginPage(writer, http.StatusBadRequest, page)
+		return
+	}
+	authenticatedUser, err := state.ssoEngine.Authenticate(page.UserName, password, state.getRemoteAddress(request))
+	if err != nil {
+		event := newAuditEvent(protocol.AuditEventAuthorization, protocol.GrantTypeAuthorizationCode, page.ClientId, nil, err)
+		event.UserName = page.UserName
+		server.auditRequest(request, event)
+		if lockout, ok := err.(*lockoutError); ok {
+			page.Error = "Too many failed authentications, please retry later"
+			writer.Header().Set("Retry-After", strconv.FormatInt(lockout.retryAfter, 10))
+			writeLoginPage(writer, http.StatusTooManyRequests, page)
+		} else if errors401[err] {
+			page.Error = "The user name or the password is not valid"
+			writeLoginPage(writer, http.StatusUnauthorized, page)
+		} else {
+			page.Error = "Unable to authenticate the user, please retry later"
+			writeLoginPage(writer, http.StatusInternalServerError, page)
+		}
+		return
+	}
+
+	scopes, err := state.ssoEngine.GrantScopes(authenticatedUser, page.ClientId, parseScope(page.Scope))
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventAuthorization, protocol.GrantTypeAuthorizationCode, page.ClientId, authenticatedUser, err))
+		redirectToClient(writer, request, page.RedirectURI, url.Values{"error": {"invalid_scope"}, "state": {page.State}})
+		return
+	}
+
+	code, err := state.ssoEngine.CreateAuthorizationCode(
+		authenticatedUser,
+		tokenGrant{
+			clientId:      page.ClientId,
+			audiences:     page.Audiences,
+			scopes:        scopes,
+			remoteAddress: state.getRemoteAddress(request),
+		},
+		page.RedirectURI,
+		page.CodeChallenge)
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventAuthorization, protocol.GrantTypeAuthorizationCode, page.ClientId, authenticatedUser, err))
+	if err != nil {
+		redirectToClient(writer, request, page.RedirectURI, url.Values{"error": {"server_error"}, "state": {page.State}})
+		return
+	}
+
+	redirectToClient(writer, request, page.RedirectURI, url.Values{"code": {code}, "state": {page.State}})
+}
+
+// handleAuthorizationCodeRequest redeems an authorization code given in a form (RFC 6749, section 4.1.3). A public
+// client (without secret) is not authenticated, the code being bound to the verifier of the code challenge. A
+// confidential client must authenticate, as for the client credentials grant.
+func (server *authServerImpl) handleAuthorizationCodeRequest(state *authServerState, writer http.ResponseWriter, request *http.Request) {
+
+	clientId := request.PostForm.Get("client_id")
+	code := request.PostForm.Get("code")
+	codeVerifier := request.PostForm.Get("code_verifier")
+	if len(clientId) == 0 || len(code) == 0 || len(codeVerifier) == 0 {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "the parameters client_id, code and code_verifier are required")
+		return
+	}
+
+	if client := state.ssoEngine.GetClient(clientId); (client != nil) && (len(client.secretHashes) > 0) {
+		authenticatedClient := server.authenticateFormClient(state, writer, request, protocol.GrantTypeAuthorizationCode, false)
+		if authenticatedClient == nil {
+			return
+		}
+		// The client authenticated with HTTP Basic must be the one given in the form
+		if authenticatedClient.clientId != clientId {
+			server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeAuthorizationCode, clientId, nil, common.ErrUnauthorized))
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+	} else if !isGrantAllowedForClient(state.ssoEngine, clientId, protocol.GrantTypeAuthorizationCode) {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeAuthorizationCode, clientId, nil, errClientNotAllowed))
+		writeOAuthError(writer, http.StatusBadRequest, "unauthorized_client", "")
+		return
+	}
+
+	token, authenticatedUser, err := state.ssoEngine.RedeemAuthorizationCode(code, clientId, request.PostForm.Get("redirect_uri"), codeVerifier)
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeAuthorizationCode, clientId, authenticatedUser, err))
+	if err != nil {
+		if err == errAuthorizationCodeInvalid {
+			writeOAuthError(writer, http.StatusBadRequest, "invalid_grant", "")
+		} else if err == errTooManyRefreshTokens {
+			writeOAuthError(writer, http.StatusServiceUnavailable, "temporarily_unavailable", "")
+		} else {
+			writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	writeTokenResponse(writer, token)
+}
+
+// handleClientCredentialsRequest returns a token for the client itself (RFC 6749, section 4.4). The client
+// authenticates with its id and one of its secrets, given either with HTTP Basic or in the form.
+func (server *authServerImpl) handleClientCredentialsRequest(state *authServerState, writer http.ResponseWriter, request *http.Request) {
+
+	client := server.authenticateFormClient(state, writer, request, protocol.GrantTypeClientCredentials, true)
+	if client == nil {
+		return
+	}
+
+	// The audiences are requested as defined by the RFC 8693
+	audiences := request.PostForm["audience"]
+	if err := state.ssoEngine.CheckAudiences(client.clientId, audiences); err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeClientCredentials, client.clientId, client.toAuthenticatedUser(), err))
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_target", "")
+		return
+	}
+
+	scopes, err := state.ssoEngine.GrantScopes(client.toAuthenticatedUser(), client.clientId, parseScope(request.PostForm.Get("scope")))
+	if err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeClientCredentials, client.clientId, client.toAuthenticatedUser(), err))
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_scope", "")
+		return
+	}
+
+	token, err := state.ssoEngine.EnrollClient(client, tokenGrant{audiences: audiences, scopes: scopes})
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeClientCredentials, client.clientId, client.toAuthenticatedUser(), err))
+	if err != nil {
+		writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeTokenResponse(writer, token)
+}
+
+// handleTokenExchangeRequest exchanges the access token of a user for a new token, for the authenticated client
+// calling another service on behalf of the user (RFC 8693). The new token has the client as actor, only the
+// requested audiences and a shorter time to live. The client authenticates as for the client credentials grant.
+func (server *authServerImpl) handleTokenExchangeRequest(state *authServerState, writer http.ResponseWriter, request *http.Request) {
+
+	client := server.authenticateFormClient(state, writer, request, protocol.GrantTypeTokenExchange, false)
+	if client == nil {
+		return
+	}
+
+	// Only the access tokens issued by the server can be exchanged, and only for access tokens
+	subjectToken := request.PostForm.Get("subject_token")
+	subjectTokenType := request.PostForm.Get("subject_token_type")
+	if len(subjectToken) == 0 || len(subjectTokenType) == 0 {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "the parameters subject_token and subject_token_type are required")
+		return
+	}
+	if subjectTokenType != protocol.TokenTypeAccessToken && subjectTokenType != protocol.TokenTypeJWT {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "only the access tokens can be exchanged")
+		return
+	}
+	requestedTokenType := request.PostForm.Get("requested_token_type")
+	if len(requestedTokenType) > 0 && requestedTokenType != protocol.TokenTypeAccessToken {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "only access tokens can be requested")
+		return
+	}
+	if len(request.PostForm.Get("actor_token")) > 0 {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "the actor is always the authenticated client, actor_token is not supported")
+		return
+	}
+
+	// The new token must be restricted to the services called
+	audiences := request.PostForm["audience"]
+	if len(audiences) == 0 {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "the parameter audience is required")
+		return
+	}
+	if err := state.ssoEngine.CheckAudiences(client.clientId, audiences); err != nil {
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeTokenExchange, client.clientId, nil, err))
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_target", "")
+		return
+	}
+
+	token, authenticatedUser, err := state.ssoEngine.ExchangeToken(client, subjectToken, audiences, parseScope(request.PostForm.Get("scope")))
+	server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, protocol.GrantTypeTokenExchange, client.clientId, authenticatedUser, err))
+	if err != nil {
+		if err == errSubjectTokenInvalid {
+			// The invalid subject tokens are reported as invalid requests (RFC 8693, section 2.2.2)
+			writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "the subject token is not valid")
+		} else if err == errScopeNotAllowed {
+			writeOAuthError(writer, http.StatusBadRequest, "invalid_scope", "")
+		} else {
+			writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		}
+		return
+	}
+
+	writeTokenResponse(writer, token)
+}
+
+// authenticateFormClient authenticates the client of a form based grant with its id and one of its secrets, given
+// either with HTTP Basic or in the form, and checks that it can use the grant. If not, the error is sent and nil is
+// returned. The client is audited as the user if asked, for the grants where it is the only party.
+func (server *authServerImpl) authenticateFormClient(
+	state *authServerState,
+	writer http.ResponseWriter,
+	request *http.Request,
+	grantType string,
+	clientIsUser bool) *registeredClient {
+
+	clientId, clientSecret, isBasic := request.BasicAuth()
+	if !isBasic {
+		clientId = request.PostForm.Get("client_id")
+		clientSecret = request.PostForm.Get("client_secret")
+	}
+
+	client, err := state.ssoEngine.AuthenticateClient(clientId, clientSecret)
+	if err != nil {
+		event := newAuditEvent(protocol.AuditEventToken, grantType, clientId, nil, err)
+		if clientIsUser {
+			event.UserName = clientId
+		}
+		server.auditRequest(request, event)
+		// The scheme used by the client must be given back (RFC 6749, section 5.2)
+		if isBasic {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="EasySSO"`)
+		}
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "")
+		return nil
+	}
+
+	if !client.isGrantAllowed(grantType) {
+		var user *authenticatedUser
+		if clientIsUser {
+			user = client.toAuthenticatedUser()
+		}
+		server.auditRequest(request, newAuditEvent(protocol.AuditEventToken, grantType, clientId, user, errClientNotAllowed))
+		writeOAuthError(writer, http.StatusBadRequest, "unauthorized_client", "")
+		return nil
+	}
+
+	return client
+}
+
+// writeTokenResponse sends a successful token response, that must not be cached (RFC 6749, section 5.1)
+func writeTokenResponse(writer http.ResponseWriter, token *protocol.AuthenticationResponse) {
+
+	jsonResponse, err := json.Marshal(token)
+	if err != nil {
+		writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// writeLoginPage sends the login page. The page can not be displayed in a frame, so that the user can not be
+// tricked into authenticating.
+func writeLoginPage(writer http.ResponseWriter, status int, page *loginPage) {
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("X-Frame-Options", "DENY")
+	writer.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	writer.WriteHeader(status)
+
+	if err := loginPageTemplate.Execute(writer, page); err != nil {
+		log.Error("Unable to write the login page", err)
+	}
+}
+
+// redirectToClient redirects the browser to the redirection URI of the client, with the given parameters
+func redirectToClient(writer http.ResponseWriter, request *http.Request, redirectURI string, parameters url.Values) {
+
+	// The redirect URI was checked against the registered ones
+	redirectURL, _ := url.Parse(redirectURI)
+
+	query := redirectURL.Query()
+	for name, values := range parameters {
+		if len(values) > 0 && len(values[0]) > 0 {
+			query.Set(name, values[0])
+		}
+	}
+	redirectURL.RawQuery = query.Encode()
+
+	http.Redirect(writer, request, redirectURL.String(), http.StatusFound)
+}
+
+// writeOAuthError sends an error following the format of the RFC 6749, section 5.2
+func writeOAuthError(writer http.ResponseWriter, status int, errorCode string, description string) {
+
+	jsonResponse, _ := json.Marshal(&protocol.OAuthError{
+		Error:            errorCode,
+		ErrorDescription: description,
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	writer.Write(jsonResponse)
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// The public client and the verifier used for the authorization code flow
+const (
+	testPublicClientId = "public-client"
+	testRedirectURI    = "https://application.example.com/callback"
+	testCodeVerifier   = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// newAuthorizationCodeTestServer builds a server with a public client registered for testRedirectURI
+func newAuthorizationCodeTestServer(t *testing.T) *authServerImpl {
+
+	configuration := newTestConfiguration(t)
+	configuration.Clients = &[]*ClientConfiguration{
+		{
+			ClientId:     stringPointer(testPublicClientId),
+			RedirectURIs: &[]*string{stringPointer(testRedirectURI)},
+		},
+	}
+
+	return newTestServer(t, configuration)
+}
+
+// computeCodeChallenge returns the S256 code challenge of the given verifier
+func computeCodeChallenge(codeVerifier string) string {
+
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// postForm sends the given form to the given handler and returns the response
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+// authorizeTestUser posts the login page for testUserName with the given challenge and returns the parameters
+// given to the client in the redirection
+func authorizeTestUser(t *testing.T, server *authServerImpl, codeChallenge string, codeChallengeMethod string) url.Values {
+
+	recorder := postForm(server.handleAuthorizeRequest, "/authorize", url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testPublicClientId},
+		"redirect_uri":          {testRedirectURI},
+		"state":                 {"xyz"},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {codeChallengeMethod},
+		"userName":              {testUserName},
+		"password":              {testPassword},
+	})
+	if recorder.Code != http.StatusFound {
+		t.Fatal("The authorization was not redirected to the client, status ", recorder.Code)
+	}
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), testRedirectURI) {
+		t.Fatal("The authorization was redirected to ", recorder.Header().Get("Location"))
+	}
+	if location.Query().Get("state") != "xyz" {
+		t.Error("The state was not given back to the client")
+	}
+	return location.Query()
+}
+
+// redeemTestCode redeems the given code on /token and returns the response
+func redeemTestCode(server *authServerImpl, code string, codeVerifier string, redirectURI string) *httptest.ResponseRecorder {
+
+	return postForm(server.handleTokenRequest, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {testPublicClientId},
+		"code":          {code},
+		"code_verifier": {codeVerifier},
+		"redirect_uri":  {redirectURI},
+	})
+}
+
+func TestAuthorizationCodeWithS256Challenge(t *testing.T) {
+
+	server := newAuthorizationCodeTestServer(t)
+	code := authorizeTestUser(t, server, computeCodeChallenge(testCodeVerifier), "S256").Get("code")
+	if len(code) == 0 {
+		t.Fatal("No authorization code was given")
+	}
+
+	recorder := redeemTestCode(server, code, testCodeVerifier, testRedirectURI)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The authorization code was not redeemed, status ", recorder.Code, ": ", recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), "accessToken") {
+		t.Error("The response does not have an access token: ", recorder.Body.String())
+	}
+}
+
+func TestAuthorizationCodeWithWrongVerifier(t *testing.T) {
+
+	server := newAuthorizationCodeTestServer(t)
+	code := authorizeTestUser(t, server, computeCodeChallenge(testCodeVerifier), "S256").Get("code")
+
+	recorder := redeemTestCode(server, code, "another-verifier-that-does-not-match-the-challenge", testRedirectURI)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid_grant") {
+		t.Error("The code was redeemed with a wrong verifier, status ", recorder.Code, ": ", recorder.Body.String())
+	}
+}
+
+func TestAuthorizationCodeWithPlainChallenge(t *testing.T) {
+
+	server := newAuthorizationCodeTestServer(t)
+
+	// The plain method would send the verifier itself as challenge
+	parameters := authorizeTestUser(t, server, testCodeVerifier, "plain")
+	if len(parameters.Get("code")) > 0 {
+		t.Error("A code was given with a plain code challenge")
+	}
+	if parameters.Get("error") != "invalid_request" {
+		t.Error("The plain code challenge was not refused: ", parameters.Get("error"))
+	}
+}
+
+func TestAuthorizationCodeRedeemedOnlyOnce(t *testing.T) {
+
+	server := newAuthorizationCodeTestServer(t)
+	code := authorizeTestUser(t, server, computeCodeChallenge(testCodeVerifier), "S256").Get("code")
+
+	if recorder := redeemTestCode(server, code, testCodeVerifier, testRedirectURI); recorder.Code != http.StatusOK {
+		t.Fatal("The authorization code was not redeemed, status ", recorder.Code)
+	}
+
+	recorder := redeemTestCode(server, code, testCodeVerifier, testRedirectURI)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid_grant") {
+		t.Error("The authorization code was redeemed twice, status ", recorder.Code)
+	}
+}
+
+func TestAuthorizationCodeWithAnotherRedirectURI(t *testing.T) {
+
+	server := newAuthorizationCodeTestServer(t)
+	code := authorizeTestUser(t, server, computeCodeChallenge(testCodeVerifier), "S256").Get("code")
+
+	recorder := redeemTestCode(server, code, testCodeVerifier, "https://attacker.example.com/callback")
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid_grant") {
+		t.Error("The authorization code was redeemed with another redirect URI, status ", recorder.Code)
+	}
+
+	// The code can not be used afterwards, even with the right redirect URI
+	if recorder := redeemTestCode(server, code, testCodeVerifier, testRedirectURI); recorder.Code != http.StatusBadRequest {
+		t.Error("The authorization code was redeemed after a failed redemption, status ", recorder.Code)
+	}
+}
+
+// newClientCredentialsTestServer builds a server with the client "service", only allowed to use the client
+// credentials grant for the audience "api", and the client "client-a" only allowed to use the password grant
+func newClientCredentialsTestServer(t *testing.T) *authServerImpl {
+
+	configuration := newTestConfigurationWithClients(t, "service", "client-a")
+	service := (*configuration.Clients)[0]
+	service.AllowedGrants = &[]*string{stringPointer(protocol.GrantTypeClientCredentials)}
+	service.AllowedAudiences = &[]*string{stringPointer("api")}
+	service.Roles = &[]*string{stringPointer("service")}
+	(*configuration.Clients)[1].AllowedGrants = &[]*string{stringPointer(protocol.GrantTypePassword)}
+
+	return newTestServer(t, configuration)
+}
+
+// requestClientToken posts a client credentials grant with the given form, the client authenticating with HTTP
+// Basic if given
+func requestClientToken(server *authServerImpl, clientId string, clientSecret string, form url.Values) *httptest.ResponseRecorder {
+
+	form.Set("grant_type", protocol.GrantTypeClientCredentials)
+	request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(clientId) > 0 {
+		request.SetBasicAuth(clientId, clientSecret)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleTokenRequest(recorder, request)
+	return recorder
+}
+
+func TestClientCredentialsGivesATokenToTheClient(t *testing.T) {
+
+	server := newClientCredentialsTestServer(t)
+
+	tests := []struct {
+		name         string
+		clientId     string
+		clientSecret string
+		form         url.Values
+	}{
+		{"secret with HTTP Basic", "service", testClientSecret, url.Values{"audience": {"api"}}},
+		{"secret in the form", "", "", url.Values{"client_id": {"service"}, "client_secret": {testClientSecret}, "audience": {"api"}}},
+	}
+
+	for _, test := range tests {
+		recorder := requestClientToken(server, test.clientId, test.clientSecret, test.form)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: the token request failed with the status %d", test.name, recorder.Code)
+			continue
+		}
+		if recorder.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: the token response can be cached", test.name)
+		}
+
+		var response protocol.AuthenticationResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal("Unable to read the token response: ", err)
+		}
+		if len(response.RefreshToken) > 0 {
+			t.Errorf("%s: a refresh token was given to the client", test.name)
+		}
+
+		claims := readTestTokenClaims(t, response.AccessToken)
+		if (claims["user"] != "service") || (claims["client_id"] != "service") {
+			t.Errorf("%s: the token is not issued for the client: %v", test.name, claims)
+		}
+		if roles, ok := claims["roles"].([]interface{}); !ok || (len(roles) != 1) || (roles[0] != "service") {
+			t.Errorf("%s: the token does not have the roles of the client: %v", test.name, claims)
+		}
+		if audience := fmt.Sprint(claims["aud"]); !strings.Contains(audience, "api") {
+			t.Errorf("%s: the token does not have the requested audience: %v", test.name, claims)
+		}
+	}
+}
+
+func TestClientCredentialsAreRefused(t *testing.T) {
+
+	server := newClientCredentialsTestServer(t)
+
+	tests := []struct {
+		name         string
+		clientId     string
+		clientSecret string
+		form         url.Values
+		status       int
+		errorCode    string
+	}{
+		{"wrong secret", "service", "wrong-secret", url.Values{}, http.StatusUnauthorized, "invalid_client"},
+		{"wrong secret in the form", "", "", url.Values{"client_id": {"service"}, "client_secret": {"wrong-secret"}}, http.StatusUnauthorized, "invalid_client"},
+		{"unknown client", "unknown-client", testClientSecret, url.Values{}, http.StatusUnauthorized, "invalid_client"},
+		{"no client", "", "", url.Values{}, http.StatusUnauthorized, "invalid_client"},
+		{"grant not allowed", "client-a", testClientSecret, url.Values{}, http.StatusBadRequest, "unauthorized_client"},
+		{"audience not allowed", "service", testClientSecret, url.Values{"audience": {"other-api"}}, http.StatusBadRequest, "invalid_target"},
+	}
+
+	for _, test := range tests {
+		recorder := requestClientToken(server, test.clientId, test.clientSecret, test.form)
+		if recorder.Code != test.status {
+			t.Errorf("%s: the token request answered the status %d, expected %d", test.name, recorder.Code, test.status)
+			continue
+		}
+
+		var oauthError protocol.OAuthError
+		if err := json.Unmarshal(recorder.Body.Bytes(), &oauthError); err != nil || oauthError.Error != test.errorCode {
+			t.Errorf("%s: the token request answered %s, expected the error %s", test.name, recorder.Body.String(), test.errorCode)
+		}
+	}
+
+	// The client authenticating with HTTP Basic is told to use it again
+	if recorder := requestClientToken(server, "service", "wrong-secret", url.Values{}); recorder.Header().Get("WWW-Authenticate") == "" {
+		t.Error("The refused client is not told the scheme of the authentication")
+	}
+}
+
+func TestPublicClientRefreshesAndRevokesItsTokensWhenTheEndpointsAreProtected(t *testing.T) {
+
+	configuration := newTestConfigurationWithClients(t, "client-a")
+	*configuration.Clients = append(*configuration.Clients, &ClientConfiguration{
+		ClientId:     stringPointer(testPublicClientId),
+		RedirectURIs: &[]*string{stringPointer(testRedirectURI)},
+	})
+	server := newTestServer(t, configuration)
+
+	code := authorizeTestUser(t, server, computeCodeChallenge(testCodeVerifier), "S256").Get("code")
+	recorder := redeemTestCode(server, code, testCodeVerifier, testRedirectURI)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The authorization code was not redeemed, status ", recorder.Code)
+	}
+	var response protocol.AuthenticationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal("Unable to read the token response: ", err)
+	}
+
+	// The public client gives its id with an empty password
+	refreshBody := protocol.TokenRefreshBody{}
+	refreshBody.RefreshToken = response.RefreshToken
+	content, _ := json.Marshal(refreshBody)
+	request := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(string(content)))
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(testPublicClientId, "")
+	recorder = httptest.NewRecorder()
+	server.handleRefreshRequest(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The public client can not refresh its token, status ", recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal("Unable to read the refresh response: ", err)
+	}
+
+	// Or as the client_id of a form
+	recorder = postForm(server.handleRevokeRequest, "/revoke", url.Values{"client_id": {testPublicClientId}, "token": {response.RefreshToken}})
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The public client can not revoke its token, status ", recorder.Code)
+	}
+	if isTokenActive(t, server, response.RefreshToken) {
+		t.Error("The public client did not revoke its refresh token")
+	}
+
+	// Without its id, the query is refused
+	if recorder := postForm(server.handleRevokeRequest, "/revoke", url.Values{"token": {response.AccessToken}}); recorder.Code != http.StatusUnauthorized {
+		t.Error("A revocation without client was accepted, status ", recorder.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// handleGetSessions returns (if authorized) the active sessions as a JSON list. If the parameter user is given in
+// the query, only the sessions of this user are returned.
+func (server *authServerImpl) handleGetSessions(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "sessions", request, writer)
+	if err != nil {
+		return
+	}
+
+	userName := request.URL.Query().Get("user")
+	sessions, err := state.ssoEngine.GetSessions(userName)
+
+	// Keep a trace of who looked at the sessions
+	event := newAuditEvent(protocol.AuditEventSessions, "", clientId, nil, err)
+	event.UserName = userName
+	server.auditRequest(request, event)
+
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(sessions)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
+
+// handleRevokeSessions invalidates (if authorized) the session or all the sessions of the user given in a form. The
+// access tokens already issued stay valid until they expire.
+func (server *authServerImpl) handleRevokeSessions(writer http.ResponseWriter, request *http.Request) {
+
+	// Use the same state for the whole query
+	state := server.getState()
+
+	// Check endpoint Authentication
+	clientId, err := checkEndPointAuthentication(state.endpointAuthentication, "sessions", request, writer)
+	if err != nil {
+		return
+	}
+
+	// Read the parameters of the request
+	decoder := json.NewDecoder(request.Body)
+	var revocationRequest protocol.SessionRevocationBody
+	err = decoder.Decode(&revocationRequest)
+	if err != nil {
+		log.Debug("Unable to read the request")
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "Unable to read the request")
+		return
+	}
+
+	// Close the body
+	defer request.Body.Close()
+
+	if (len(revocationRequest.SessionId) == 0) == (len(revocationRequest.UserName) == 0) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, "Either the parameter 'sessionId' or 'userName' must be given in the query")
+		return
+	}
+
+	// Revoke the sessions
+	var revoked int
+	if len(revocationRequest.SessionId) > 0 {
+		revoked, err = state.ssoEngine.RevokeSession(revocationRequest.SessionId)
+	} else {
+		revoked, err = state.ssoEngine.RevokeUserSessions(revocationRequest.UserName)
+	}
+
+	// Keep a trace of who revoked the sessions, even partially
+	event := newAuditEvent(protocol.AuditEventRevocation, "", clientId, nil, err)
+	event.UserName = revocationRequest.UserName
+	event.SessionId = revocationRequest.SessionId
+	server.auditRequest(request, event)
+
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Prepare the response
+	jsonResponse, err := json.Marshal(&protocol.SessionRevocationResponse{Revoked: revoked})
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(writer, "Unable to serve the request")
+		return
+	}
+
+	// Send the response back
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(jsonResponse)
+}
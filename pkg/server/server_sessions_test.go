@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// newSessionsTestServer returns a server with the client "admin" allowed on the sessions endpoints and the
+// client "client-a" only allowed on the public endpoints
+func newSessionsTestServer(t *testing.T) *authServerImpl {
+
+	configuration := newTestConfigurationWithClients(t, "admin", "client-a")
+	(*configuration.Clients)[0].AllowedEndpoints = &[]*string{stringPointer("sessions")}
+
+	return newTestServer(t, configuration)
+}
+
+// getTestSessions lists the sessions with the given client and returns them
+func getTestSessions(t *testing.T, server *authServerImpl, clientId string) []*protocol.Session {
+
+	request := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	request.SetBasicAuth(clientId, testClientSecret)
+	recorder := httptest.NewRecorder()
+	server.handleGetSessions(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The sessions can not be listed, status ", recorder.Code)
+	}
+
+	var sessions []*protocol.Session
+	if err := json.Unmarshal(recorder.Body.Bytes(), &sessions); err != nil {
+		t.Fatal("Unable to read the sessions: ", err)
+	}
+	return sessions
+}
+
+// revokeTestSession revokes the given session with the given client and returns the number of revoked sessions
+func revokeTestSession(t *testing.T, server *authServerImpl, clientId string, sessionId string) int {
+
+	recorder := postJSON(server.handleRevokeSessions, "/sessions/revoke", clientId, protocol.SessionRevocationBody{SessionId: sessionId})
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The session can not be revoked, status ", recorder.Code)
+	}
+
+	var response protocol.SessionRevocationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal("Unable to read the revocation: ", err)
+	}
+	return response.Revoked
+}
+
+func TestSessionsEndpointsAreOnlyAllowedToTheirClients(t *testing.T) {
+
+	server := newSessionsTestServer(t)
+
+	request := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	request.SetBasicAuth("client-a", testClientSecret)
+	recorder := httptest.NewRecorder()
+	server.handleGetSessions(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Error("A client not allowed listed the sessions, status ", recorder.Code)
+	}
+
+	body := protocol.SessionRevocationBody{UserName: testUserName}
+	if recorder := postJSON(server.handleRevokeSessions, "/sessions/revoke", "client-a", body); recorder.Code != http.StatusForbidden {
+		t.Error("A client not allowed revoked the sessions, status ", recorder.Code)
+	}
+	if recorder := postJSON(server.handleRevokeSessions, "/sessions/revoke", "", body); recorder.Code != http.StatusUnauthorized {
+		t.Error("The sessions were revoked without authentication, status ", recorder.Code)
+	}
+
+	if sessions := getTestSessions(t, server, "admin"); len(sessions) != 0 {
+		t.Errorf("%d sessions are listed, expected none", len(sessions))
+	}
+}
+
+func TestRevokeSessionRevokesTheWholeFamily(t *testing.T) {
+
+	server := newSessionsTestServer(t)
+	firstResponse := requestTestToken(t, server, "client-a")
+	if firstResponse == nil {
+		t.FailNow()
+	}
+	sessions := getTestSessions(t, server, "admin")
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions are listed, expected 1", len(sessions))
+	}
+	sessionId := sessions[0].SessionId
+
+	// The session keeps its id when it is refreshed
+	refreshBody := protocol.TokenRefreshBody{}
+	refreshBody.RefreshToken = firstResponse.RefreshToken
+	recorder := postJSON(server.handleRefreshRequest, "/refresh", "client-a", refreshBody)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("The refresh request failed with the status ", recorder.Code)
+	}
+	var refreshedResponse protocol.AuthenticationResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &refreshedResponse); err != nil {
+		t.Fatal("Unable to read the refresh response: ", err)
+	}
+	secondResponse := requestTestToken(t, server, "client-a")
+	if secondResponse == nil {
+		t.FailNow()
+	}
+	if sessions := getTestSessions(t, server, "admin"); len(sessions) != 2 {
+		t.Fatalf("%d sessions are listed, expected 2", len(sessions))
+	}
+
+	if revoked := revokeTestSession(t, server, "admin", sessionId); revoked != 1 {
+		t.Errorf("%d sessions were revoked, expected 1", revoked)
+	}
+	if isTokenActive(t, server, firstResponse.RefreshToken) || isTokenActive(t, server, refreshedResponse.RefreshToken) {
+		t.Error("A refresh token of the revoked session is still active")
+	}
+	if !isTokenActive(t, server, secondResponse.RefreshToken) {
+		t.Error("The refresh token of another session was revoked")
+	}
+	if sessions := getTestSessions(t, server, "admin"); (len(sessions) != 1) || (sessions[0].SessionId == sessionId) {
+		t.Error("The revoked session is still listed")
+	}
+}
+
+func TestRevokeAnUnknownSession(t *testing.T) {
+
+	server := newSessionsTestServer(t)
+	if requestTestToken(t, server, "client-a") == nil {
+		t.FailNow()
+	}
+
+	if revoked := revokeTestSession(t, server, "admin", "unknown-session"); revoked != 0 {
+		t.Errorf("%d sessions were revoked, expected none", revoked)
+	}
+	if sessions := getTestSessions(t, server, "admin"); len(sessions) != 1 {
+		t.Errorf("%d sessions are listed after revoking an unknown session, expected 1", len(sessions))
+	}
+
+	body := protocol.SessionRevocationBody{SessionId: "unknown-session", UserName: testUserName}
+	if recorder := postJSON(server.handleRevokeSessions, "/sessions/revoke", "admin", body); recorder.Code != http.StatusBadRequest {
+		t.Error("A revocation of both a session and a user was accepted, status ", recorder.Code)
+	}
+}
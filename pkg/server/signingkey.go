@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// defaultSigningAlgorithm is the algorithm used for signing the tokens if none is configured
+const defaultSigningAlgorithm = "RS512"
+
+// supportedSigningAlgorithms are the algorithms that can be configured for signing the tokens
+var supportedSigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "EdDSA"}
+
+// readinessSignedContent is the content signed for checking that the active key is usable
+const readinessSignedContent = "easy-sso readiness"
+
+// signingKey holds a key used for signing the tokens along with its id. The id is stamped in the header of the
+// tokens (kid), so that the services can find the key to use for validating them.
+type signingKey struct {
+	keyId      string
+	privateKey crypto.Signer
+	// The algorithm of the signature made with the key
+	signingMethod jwt.SigningMethod
+	// When the key was generated, for the keys generated by rotation
+	createdAt int64
+	// When the key stops being published and accepted, 0 if the key is not retired
+	retireAt int64
+}
+
+// loadSigningKey reads the private key from the given file and computes its id. The algorithm is used for the
+// key if it matches the type of the key, otherwise the default algorithm of the type of key is used.
+func loadSigningKey(privateKeyPath string, algorithm string) (*signingKey, error) {
+
+	// Read the private key for signing token
+	privateKeyData, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		log.Error("Configuration for SSO, the key ", privateKeyPath, " is an unreadable file")
+		return nil, err
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyData)
+	if err != nil {
+		log.Error("Configuration for SSO, the key ", privateKeyPath, " is a non-valid file")
+		return nil, err
+	}
+
+	return newSigningKey(privateKey, algorithm)
+}
+
+// generateSigningKey generates a new key for the given algorithm and writes it in the given file
+func generateSigningKey(privateKeyPath string, algorithm string) (*signingKey, error) {
+
+	var privateKey crypto.Signer
+	var err error
+
+	switch {
+	case strings.HasPrefix(algorithm, "RS"), strings.HasPrefix(algorithm, "PS"):
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case algorithm == "ES256":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case algorithm == "ES384":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case algorithm == "EdDSA":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+	if err != nil {
+		log.Error("Unable to generate a new key", err)
+		return nil, err
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		log.Error("Unable to encode the new key", err)
+		return nil, err
+	}
+
+	privateKeyData := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	if err := ioutil.WriteFile(privateKeyPath, privateKeyData, 0600); err != nil {
+		log.Error("Unable to write the new key ", privateKeyPath, err)
+		return nil, err
+	}
+
+	return newSigningKey(privateKey, algorithm)
+}
+
+// newSigningKey finds the algorithm to use with the given key and computes its id
+func newSigningKey(privateKey crypto.Signer, algorithm string) (*signingKey, error) {
+
+	var signingMethod jwt.SigningMethod
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		signingMethod = jwt.SigningMethodRS512
+		if strings.HasPrefix(algorithm, "RS") || strings.HasPrefix(algorithm, "PS") {
+			signingMethod = jwt.GetSigningMethod(algorithm)
+		}
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			signingMethod = jwt.SigningMethodES256
+		case elliptic.P384():
+			signingMethod = jwt.SigningMethodES384
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		signingMethod = protocol.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported type of key %T", privateKey)
+	}
+
+	jsonWebKey, err := newJsonWebKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKey{
+		keyId:         computeKeyId(jsonWebKey),
+		privateKey:    privateKey,
+		signingMethod: signingMethod,
+	}, nil
+}
+
+// parsePrivateKey reads a PEM encoded private key: a PKCS1 RSA key, a SEC1 EC key or a PKCS8 key of any
+// supported type
+func parsePrivateKey(privateKeyData []byte) (crypto.Signer, error) {
+
+	block, _ := pem.Decode(privateKeyData)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported type of key %T", privateKey)
+	}
+
+	return signer, nil
+}
+
+// computeKeyId computes the id of a key as its JWK thumbprint (RFC 7638), so that the id of a key is stable
+// across restarts and does not need to be configured
+func computeKeyId(jsonWebKey *protocol.JsonWebKey) string {
+
+	// The thumbprint is the hash of the required members of the key, in lexicographic order (which is the
+	// order used when serializing a map)
+	requiredMembers := map[string]string{"kty": jsonWebKey.KeyType}
+	switch jsonWebKey.KeyType {
+	case "RSA":
+		requiredMembers["e"] = jsonWebKey.E
+		requiredMembers["n"] = jsonWebKey.N
+	case "EC":
+		requiredMembers["crv"] = jsonWebKey.Curve
+		requiredMembers["x"] = jsonWebKey.X
+		requiredMembers["y"] = jsonWebKey.Y
+	case "OKP":
+		requiredMembers["crv"] = jsonWebKey.Curve
+		requiredMembers["x"] = jsonWebKey.X
+	}
+	thumbprintInput, _ := json.Marshal(requiredMembers)
+
+	thumbprint := sha256.Sum256(thumbprintInput)
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+// CheckSignature signs a test content with the key and verifies the signature with its public part
+func (key *signingKey) CheckSignature() error {
+
+	signature, err := key.signingMethod.Sign(readinessSignedContent, key.privateKey)
+	if err != nil {
+		return err
+	}
+
+	return key.signingMethod.Verify(readinessSignedContent, signature, key.privateKey.Public())
+}
+
+// toJsonWebKey returns the public part of the key as a JWK
+func (key *signingKey) toJsonWebKey() protocol.JsonWebKey {
+
+	// The type of the key is checked when the key is loaded
+	jsonWebKey, _ := newJsonWebKey(key.privateKey.Public())
+	jsonWebKey.Use = "sig"
+	jsonWebKey.Algorithm = key.signingMethod.Alg()
+	jsonWebKey.KeyId = key.keyId
+
+	return *jsonWebKey
+}
+
+// newJsonWebKey converts a public key to a JWK, without the optional members
+func newJsonWebKey(publicKey crypto.PublicKey) (*protocol.JsonWebKey, error) {
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &protocol.JsonWebKey{
+			KeyType: "RSA",
+			N:       encodeBigInt(key.N),
+			E:       encodeBigInt(big.NewInt(int64(key.E))),
+		}, nil
+	case *ecdsa.PublicKey:
+		// The coordinates have the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &protocol.JsonWebKey{
+			KeyType: "EC",
+			Curve:   key.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return &protocol.JsonWebKey{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type of key %T", publicKey)
+}
+
+// encodeBigInt encodes a big integer as an unsigned big-endian base64url value, as expected in the JWK
+func encodeBigInt(value *big.Int) string {
+
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+// signingKeyRing holds all the keys of the engine: the active key, signing the new tokens, and the keys that are
+// still published and accepted, so that the tokens signed before a change of key can still be validated.
+//
+// When the rotation is configured, a new key is generated in the key directory at each interval and becomes the
+// active key. The previous keys are retired once all the tokens they signed are expired.
+type signingKeyRing struct {
+	mutex sync.RWMutex
+	// The mutex serializing the rotations, so that a single key is generated when a rotation is due
+	rotationMutex sync.Mutex
+	// The key signing the new tokens
+	activeKey *signingKey
+	// The keys given in the configuration, that are never retired
+	configuredKeys []*signingKey
+	// The keys generated by rotation, the newest first
+	rotatedKeys []*signingKey
+	// The algorithm of the signature of the tokens
+	algorithm string
+	// The parameters of the rotation (rotationInterval is 0 if there is no rotation)
+	rotationInterval int64
+	keyDirectory     string
+	retirementDelay  int64
+}
+
+// rotatedKeyPrefix and rotatedKeySuffix define the name of the files of the keys generated by rotation. The
+// name of the file gives the time of the creation of the key.
+const (
+	rotatedKeyPrefix = "signing-"
+	rotatedKeySuffix = ".key"
+)
+
+// newSigningKeyRing loads all the keys defined by the configuration. The keys replaced by the rotation are kept
+// for the given delay.
+func newSigningKeyRing(configuration SsoConfiguration, retirementDelay int64) (*signingKeyRing, error) {
+
+	keyRing := &signingKeyRing{
+		configuredKeys:  make([]*signingKey, 0),
+		rotatedKeys:     make([]*signingKey, 0),
+		retirementDelay: retirementDelay,
+		algorithm:       defaultSigningAlgorithm,
+	}
+
+	if configuration.SigningAlgorithm != nil {
+		keyRing.algorithm = *configuration.SigningAlgorithm
+	}
+
+	// The historical single key
+	if configuration.PrivateKeyPath != nil {
+		key, err := loadSigningKey(*configuration.PrivateKeyPath, keyRing.algorithm)
+		if err != nil {
+			return nil, err
+		}
+		keyRing.configuredKeys = append(keyRing.configuredKeys, key)
+		keyRing.activeKey = key
+	}
+
+	// The ordered list of keys
+	if configuration.SigningKeys != nil {
+		for _, keyConfiguration := range *configuration.SigningKeys {
+			key, err := loadSigningKey(*keyConfiguration.PrivateKeyPath, keyRing.algorithm)
+			if err != nil {
+				return nil, err
+			}
+			keyRing.configuredKeys = append(keyRing.configuredKeys, key)
+			if (keyConfiguration.Active != nil) && *keyConfiguration.Active {
+				keyRing.activeKey = key
+			}
+		}
+	}
+
+	// The rotated keys, that take precedence over the configured ones
+	if configuration.KeyRotation != nil {
+		keyRing.rotationInterval = *configuration.KeyRotation.SecondsInterval
+		keyRing.keyDirectory = *configuration.KeyRotation.KeyDirectory
+
+		if err := keyRing.loadRotatedKeys(); err != nil {
+			return nil, err
+		}
+
+		if err := keyRing.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyRing.activeKey == nil {
+		log.Error("Configuration for SSO does not define an active key for signing the tokens")
+		return nil, common.ErrBadConfiguration
+	}
+
+	if keyRing.activeKey.signingMethod.Alg() != keyRing.algorithm {
+		log.Error("Configuration for SSO, the active key can not be used with the signing algorithm ", keyRing.algorithm)
+		return nil, common.ErrBadConfiguration
+	}
+
+	return keyRing, nil
+}
+
+// GetActiveKey returns the key to use for signing the new tokens
+func (keyRing *signingKeyRing) GetActiveKey() *signingKey {
+
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	return keyRing.activeKey
+}
+
+// GetPublishedKeys returns all the keys that are published and accepted: the active key first, then the
+// other keys
+func (keyRing *signingKeyRing) GetPublishedKeys() []*signingKey {
+
+	keyRing.mutex.RLock()
+	defer keyRing.mutex.RUnlock()
+
+	now := time.Now().Unix()
+	keys := []*signingKey{keyRing.activeKey}
+	for _, key := range append(keyRing.rotatedKeys, keyRing.configuredKeys...) {
+		if key != keyRing.activeKey && (key.retireAt == 0 || key.retireAt > now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// FindKey returns the published key with the given id, or nil if there is no such key
+func (keyRing *signingKeyRing) FindKey(keyId string) *signingKey {
+
+	for _, key := range keyRing.GetPublishedKeys() {
+		if key.keyId == keyId {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// Rotate generates a new active key if the rotation is configured and the active key is older than the rotation
+// interval or is not made for the configured algorithm. The rotated keys that are retired are removed. The new key
+// is generated and the retired keys are removed without holding the lock of the keys, so that the tokens can still
+// be signed and validated meanwhile.
+func (keyRing *signingKeyRing) Rotate() error {
+
+	if keyRing.rotationInterval <= 0 {
+		return nil
+	}
+
+	keyRing.rotationMutex.Lock()
+	defer keyRing.rotationMutex.Unlock()
+
+	now := time.Now().Unix()
+
+	// Generate a new key if needed. As the rotated keys are only changed by the rotations, they can be read
+	// without the lock of the keys.
+	var newKey *signingKey
+	if len(keyRing.rotatedKeys) == 0 ||
+		keyRing.rotatedKeys[0].createdAt+keyRing.rotationInterval <= now ||
+		keyRing.rotatedKeys[0].signingMethod.Alg() != keyRing.algorithm {
+
+		keyPath := filepath.Join(keyRing.keyDirectory, fmt.Sprintf("%s%d%s", rotatedKeyPrefix, now, rotatedKeySuffix))
+		key, err := generateSigningKey(keyPath, keyRing.algorithm)
+		if err != nil {
+			return err
+		}
+		key.createdAt = now
+		newKey = key
+	}
+
+	keyRing.mutex.Lock()
+
+	if newKey != nil {
+		// The previous key is kept until all the tokens it signed are expired
+		if len(keyRing.rotatedKeys) > 0 {
+			keyRing.rotatedKeys[0].retireAt = now + keyRing.retirementDelay
+		}
+		keyRing.rotatedKeys = append([]*signingKey{newKey}, keyRing.rotatedKeys...)
+	}
+
+	// Forget the retired keys
+	rotatedKeys := make([]*signingKey, 0, len(keyRing.rotatedKeys))
+	retiredKeys := make([]*signingKey, 0)
+	for _, key := range keyRing.rotatedKeys {
+		if key.retireAt != 0 && key.retireAt <= now {
+			retiredKeys = append(retiredKeys, key)
+			continue
+		}
+		rotatedKeys = append(rotatedKeys, key)
+	}
+	keyRing.rotatedKeys = rotatedKeys
+	keyRing.activeKey = rotatedKeys[0]
+
+	keyRing.mutex.Unlock()
+
+	if newKey != nil {
+		log.Infof("A new key %s was generated for signing the tokens", newKey.keyId)
+	}
+	for _, key := range retiredKeys {
+		keyRing.removeRotatedKey(key)
+	}
+
+	return nil
+}
+
+// loadRotatedKeys reads the keys previously generated in the key directory. The retirement of each key is
+// computed from the creation of the next one.
+func (keyRing *signingKeyRing) loadRotatedKeys() error {
+
+	files, err := ioutil.ReadDir(keyRing.keyDirectory)
+	if err != nil {
+		log.Error("Configuration for SSO, the keyDirectory of keyRotation can not be read")
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, rotatedKeyPrefix) || !strings.HasSuffix(name, rotatedKeySuffix) {
+			continue
+		}
+
+		createdAt, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, rotatedKeyPrefix), rotatedKeySuffix), 10, 64)
+		if err != nil {
+			log.Warn("The key directory has a key ", name, " with a non-valid name. Skipping key.")
+			continue
+		}
+
+		key, err := loadSigningKey(filepath.Join(keyRing.keyDirectory, name), keyRing.algorithm)
+		if err != nil {
+			return err
+		}
+		key.createdAt = createdAt
+
+		keyRing.rotatedKeys = append(keyRing.rotatedKeys, key)
+	}
+
+	// The newest first
+	sort.Slice(keyRing.rotatedKeys, func(i, j int) bool {
+		return keyRing.rotatedKeys[i].createdAt > keyRing.rotatedKeys[j].createdAt
+	})
+
+	for i := 1; i < len(keyRing.rotatedKeys); i++ {
+		keyRing.rotatedKeys[i].retireAt = keyRing.rotatedKeys[i-1].createdAt + keyRing.retirementDelay
+	}
+
+	return nil
+}
+
+// removeRotatedKey removes the file of a key generated by rotation
+func (keyRing *signingKeyRing) removeRotatedKey(key *signingKey) {
+
+	keyPath := filepath.Join(keyRing.keyDirectory, fmt.Sprintf("%s%d%s", rotatedKeyPrefix, key.createdAt, rotatedKeySuffix))
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		log.Warn("Unable to remove the retired key ", keyPath)
+		return
+	}
+
+	log.Infof("The key %s is retired", key.keyId)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestSigningKeyRing returns the key ring of the test configuration, whose retired keys are kept 100 seconds
+func newTestSigningKeyRing(t *testing.T) *signingKeyRing {
+
+	keyRing, err := newSigningKeyRing(*newTestConfiguration(t).Sso, 100)
+	if err != nil {
+		t.Fatal("Unable to build the key ring: ", err)
+	}
+
+	return keyRing
+}
+
+// rotatedKeyPath returns the path of the file of a key generated by rotation
+func rotatedKeyPath(keyRing *signingKeyRing, key *signingKey) string {
+
+	return filepath.Join(keyRing.keyDirectory, fmt.Sprintf("%s%d%s", rotatedKeyPrefix, key.createdAt, rotatedKeySuffix))
+}
+
+// backdateRotatedKey makes a key generated by rotation older by the given seconds, along with the name of its file
+func backdateRotatedKey(t *testing.T, keyRing *signingKeyRing, key *signingKey, seconds int64) {
+
+	previousPath := rotatedKeyPath(keyRing, key)
+	key.createdAt -= seconds
+	if err := os.Rename(previousPath, rotatedKeyPath(keyRing, key)); err != nil {
+		t.Fatal("Unable to backdate the key: ", err)
+	}
+}
+
+// isPublished returns true if the key is published by the key ring
+func isPublished(keyRing *signingKeyRing, key *signingKey) bool {
+
+	return keyRing.FindKey(key.keyId) != nil
+}
+
+func TestRotateReplacesTheActiveKeyAfterTheInterval(t *testing.T) {
+
+	keyRing := newTestSigningKeyRing(t)
+	firstKey := keyRing.GetActiveKey()
+
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal("Unable to rotate the keys: ", err)
+	}
+	if keyRing.GetActiveKey() != firstKey {
+		t.Fatal("The active key was replaced before the end of the interval")
+	}
+
+	backdateRotatedKey(t, keyRing, firstKey, keyRing.rotationInterval)
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal("Unable to rotate the keys: ", err)
+	}
+
+	secondKey := keyRing.GetActiveKey()
+	if secondKey == firstKey {
+		t.Fatal("The active key was not replaced at the end of the interval")
+	}
+	if firstKey.retireAt != secondKey.createdAt+keyRing.retirementDelay {
+		t.Error("The previous key should be retired after the retirement delay")
+	}
+	if !isPublished(keyRing, firstKey) || !isPublished(keyRing, secondKey) {
+		t.Error("Both the active key and the previous key should be published")
+	}
+	if publishedKeys := keyRing.GetPublishedKeys(); publishedKeys[0] != secondKey {
+		t.Error("The active key should be published first")
+	}
+}
+
+func TestRotateDropsTheRetiredKeys(t *testing.T) {
+
+	keyRing := newTestSigningKeyRing(t)
+	firstKey := keyRing.GetActiveKey()
+	backdateRotatedKey(t, keyRing, firstKey, keyRing.rotationInterval)
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal("Unable to rotate the keys: ", err)
+	}
+
+	// A retired key is no longer published, even before the next rotation removes it
+	firstKey.retireAt = firstKey.createdAt
+	if isPublished(keyRing, firstKey) {
+		t.Error("The retired key is still published")
+	}
+
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal("Unable to rotate the keys: ", err)
+	}
+	if len(keyRing.rotatedKeys) != 1 {
+		t.Fatalf("%d rotated keys are kept, expected only the active key", len(keyRing.rotatedKeys))
+	}
+	if _, err := os.Stat(rotatedKeyPath(keyRing, firstKey)); !os.IsNotExist(err) {
+		t.Error("The file of the retired key was not removed: ", err)
+	}
+	if _, err := os.Stat(rotatedKeyPath(keyRing, keyRing.GetActiveKey())); err != nil {
+		t.Error("The file of the active key was removed: ", err)
+	}
+}
+
+func TestRotatedKeysAreReloaded(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	keyRing, err := newSigningKeyRing(*configuration.Sso, 100)
+	if err != nil {
+		t.Fatal("Unable to build the key ring: ", err)
+	}
+	firstKey := keyRing.GetActiveKey()
+	backdateRotatedKey(t, keyRing, firstKey, keyRing.rotationInterval)
+	if err := keyRing.Rotate(); err != nil {
+		t.Fatal("Unable to rotate the keys: ", err)
+	}
+	secondKey := keyRing.GetActiveKey()
+
+	reloadedKeyRing, err := newSigningKeyRing(*configuration.Sso, 100)
+	if err != nil {
+		t.Fatal("Unable to reload the key ring: ", err)
+	}
+	if reloadedKeyRing.GetActiveKey().keyId != secondKey.keyId {
+		t.Error("The newest key should be the active key once reloaded")
+	}
+	if previousKey := reloadedKeyRing.FindKey(firstKey.keyId); (previousKey == nil) || (previousKey.retireAt != firstKey.retireAt) {
+		t.Error("The previous key should be reloaded with the same retirement")
+	}
+}
+
+func TestKeysAreUsableDuringTheRotations(t *testing.T) {
+
+	keyRing := newTestSigningKeyRing(t)
+
+	var waitGroup sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				activeKey := keyRing.GetActiveKey()
+				if (activeKey == nil) || (keyRing.FindKey(activeKey.keyId) == nil) {
+					t.Error("The active key is not published")
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		backdateRotatedKey(t, keyRing, keyRing.GetActiveKey(), keyRing.rotationInterval*int64(i+1))
+		if err := keyRing.Rotate(); err != nil {
+			t.Error("Unable to rotate the keys: ", err)
+		}
+	}
+	close(stop)
+	waitGroup.Wait()
+}
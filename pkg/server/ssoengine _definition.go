@@ -1,25 +1,173 @@
 package server
 
 import (
-	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"errors"
+	"time"
+
+	"github.com/twuillemin/easy-sso/pkg/protocol"
 )
 
+// errRefreshTokenReused is returned when a refresh token that was already used is presented again
+var errRefreshTokenReused = errors.New("the refresh token given was already used")
+
+// errTooManyRefreshTokens is returned when the maximum number of refresh tokens is reached and the eviction
+// policy is to reject new ones
+var errTooManyRefreshTokens = errors.New("the maximum number of refresh tokens is reached")
+
+// errAuthorizationCodeInvalid is returned when an authorization code can not be redeemed, because it is unknown,
+// expired, already used or presented with parameters that do not match
+var errAuthorizationCodeInvalid = errors.New("the authorization code is not valid")
+
+// errAudienceNotAllowed is returned when a client requests an audience that it can not request
+var errAudienceNotAllowed = errors.New("the audience can not be requested by the client")
+
+// errScopeNotAllowed is returned when a client requests a scope that is unknown or that it can not request, or
+// when a refresh requests a scope that was not granted with the refresh token
+var errScopeNotAllowed = errors.New("the scope can not be requested")
+
+// errSubjectTokenInvalid is returned when the token given for a token exchange was not issued by this server, or
+// is expired or revoked
+var errSubjectTokenInvalid = errors.New("the subject token is not valid")
+
+// errTokenNotOwned is returned when a client revokes a token that was issued to another client
+var errTokenNotOwned = errors.New("the token was not issued to the client")
+
 // ssoEngine defines all the function needed for a SSO engine
 type ssoEngine interface {
 	// Authenticate validates the given user/password against all the providers configured in the order give
-	// by the configuration
-	Authenticate(userName string, password string) (*authenticatedUser, error)
-	// Enroll add the authenticated user in the SSO and returns a new AuthenticatedResponse
-	Enroll(authenticatedUser *authenticatedUser) (*common.AuthenticationResponse, error)
-	// Refresh uses the given refresh token (the id) to returns a new AuthenticatedResponse
-	Refresh(refreshToken string) (*common.AuthenticationResponse, error)
-	// Return the list of current active refresh tokens, so that another engine can be
+	// by the configuration. If the user or the address (that can be empty if unknown) is locked because of too
+	// many failures, a *lockoutError is returned without trying the providers.
+	Authenticate(userName string, password string, remoteAddress string) (*authenticatedUser, error)
+	// GetLockouts returns the users and the addresses currently locked
+	GetLockouts() []*protocol.Lockout
+	// Unlock forgets the failed authentications of the given user and of the given address (any of them can be
+	// empty) and returns the number of them that were locked
+	Unlock(userName string, remoteAddress string) int
+	// GetAuthenticationFailureStore returns the store of the failed authentications, so that a new engine can be
+	// created without loosing them
+	GetAuthenticationFailureStore() *authenticationFailureStore
+	// Enroll add the authenticated user in the SSO and returns a new AuthenticatedResponse with the given grant
+	Enroll(authenticatedUser *authenticatedUser, grant tokenGrant) (*protocol.AuthenticationResponse, error)
+	// Refresh uses the given refresh token (the id) to returns a new AuthenticatedResponse. If the client is
+	// given, the refresh token must have been obtained by this client. If scopes are given, they must have been
+	// granted with the refresh token and only them are granted to the new token. The user of the refresh token is
+	// also returned, even with an error, if the refresh token is known.
+	Refresh(refreshToken string, clientId string, scopes []string) (*protocol.AuthenticationResponse, *authenticatedUser, error)
+	// Revoke invalidates the given token, that can be a refresh token (in which case all the refresh tokens of
+	// its family are revoked) or an access token. The hint, if not empty, gives the type of token to look for
+	// first. Revoking a token that is unknown is not an error. If the client is given, the token must have been
+	// obtained by this client (RFC 7009, section 2.1).
+	Revoke(token string, tokenTypeHint string, clientId string) error
+	// RevokeAccessTokenId invalidates the access token with the given id. As the client of the token is not known,
+	// the registered clients can not revoke an access token by its id.
+	RevokeAccessTokenId(tokenId string, clientId string) error
+	// GetSessions returns the active sessions (the families of refresh tokens that can still be used), only the
+	// ones of the given user if not empty
+	GetSessions(userName string) ([]*protocol.Session, error)
+	// RevokeSession invalidates all the refresh tokens of the given session and returns the number of sessions
+	// revoked (0 if the session is unknown)
+	RevokeSession(sessionId string) (int, error)
+	// RevokeUserSessions invalidates all the refresh tokens of the given user and returns the number of sessions
+	// revoked
+	RevokeUserSessions(userName string) (int, error)
+	// Introspect returns the information about the given token, that can be a refresh token or an access
+	// token. The hint, if not empty, gives the type of token to look for first.
+	Introspect(token string, tokenTypeHint string) (*protocol.IntrospectionResponse, error)
+	// GetPublicKeys returns the public part of the keys used for signing the tokens
+	GetPublicKeys() *protocol.JsonWebKeySet
+	// GetIssuer returns the issuer of the tokens (iss)
+	GetIssuer() string
+	// GetClient returns the registered client with the given id, or nil if the client is not registered
+	GetClient(clientId string) *registeredClient
+	// CheckAudiences returns an error if the given client (that can be empty if unknown) can not request one of the
+	// given audiences
+	CheckAudiences(clientId string, audiences []string) error
+	// GrantScopes returns the scopes granted to the user among the requested ones. An error is returned if a
+	// scope is unknown or can not be requested by the client (that can be empty if unknown). The scopes that the
+	// user can not obtain are not granted.
+	GrantScopes(authenticatedUser *authenticatedUser, clientId string, scopes []string) ([]string, error)
+	// GetSupportedScopes returns the name of all the scopes that can be requested
+	GetSupportedScopes() []string
+	// GetMappedClaims returns the name of the claims mapped from the attributes of the users
+	GetMappedClaims() []string
+	// CreateAuthorizationCode issues a new authorization code for the authenticated user. The code can only be
+	// redeemed by the client of the grant, with the same redirection URI and the verifier of the code challenge
+	// (PKCE).
+	CreateAuthorizationCode(authenticatedUser *authenticatedUser, grant tokenGrant, redirectURI string, codeChallenge string) (string, error)
+	// RedeemAuthorizationCode exchanges an authorization code for a new AuthenticatedResponse. The code can only
+	// be used once. The user of the code is also returned, even with an error, if the code is known.
+	RedeemAuthorizationCode(code string, clientId string, redirectURI string, codeVerifier string) (*protocol.AuthenticationResponse, *authenticatedUser, error)
+	// AuthenticateClient validates the given client id/secret against the registered clients
+	AuthenticateClient(clientId string, clientSecret string) (*registeredClient, error)
+	// EnrollClient returns a new AuthenticatedResponse for the authenticated client itself, without refresh token,
+	// with the given grant
+	EnrollClient(client *registeredClient, grant tokenGrant) (*protocol.AuthenticationResponse, error)
+	// ExchangeToken returns a new AuthenticatedResponse, without refresh token, for the user of the given access
+	// token (token exchange, RFC 8693). The new token has the authenticated client as actor, only the given
+	// audiences and a shorter time to live. If scopes are given, they must have been granted with the subject
+	// token. The user of the subject token is also returned, even with an error, if the token is valid.
+	ExchangeToken(client *registeredClient, subjectToken string, audiences []string, scopes []string) (*protocol.AuthenticationResponse, *authenticatedUser, error)
+	// GetAuthorizationCodeStore returns the store of the authorization codes not redeemed yet, so that a new
+	// engine can be created without loosing them
+	GetAuthorizationCodeStore() *authorizationCodeStore
+	// RotateSigningKeys generates a new key for signing the tokens if the rotation is configured and the active
+	// key is older than the rotation interval. The keys that are retired are removed.
+	RotateSigningKeys() error
+	// GetRefreshTokenStore returns the store of the current active refresh tokens, so that another engine can be
 	// created without loosing the history
-	GetRefreshToken() map[string]*refreshInformation
+	GetRefreshTokenStore() refreshTokenStore
+	// GetRefreshTokenCounters returns the counters of the refresh tokens, so that another engine can be
+	// created without loosing them
+	GetRefreshTokenCounters() *refreshTokenCounters
+	// GetMetrics returns the metrics of the server, so that another engine can be created without loosing them
+	GetMetrics() *serverMetrics
+	// CheckReadiness checks, concurrently, that each provider can be used and that the active key can sign the
+	// tokens. A check not done within readinessCheckTimeout is failed.
+	CheckReadiness() []*protocol.ReadinessCheck
+	// SweepRefreshTokens removes all the refresh tokens that are timed out and returns the number of refresh
+	// tokens removed. The revoked access tokens that are expired and the old failed authentications are also
+	// forgotten.
+	SweepRefreshTokens() (int, error)
 }
 
-// refreshInformation holds the information needed to re-issue a token when a refresh is asked
+// readinessCheckTimeout is the delay after which a check of the readiness is failed
+const readinessCheckTimeout = 5 * time.Second
+
+// refreshInformation holds the information needed to re-issue a token when a refresh is asked. All the refresh
+// tokens issued from the same authentication share the same family. A refresh token can only be used once:
+// once used it is kept as consumed until its time out so that a reuse can be detected.
 type refreshInformation struct {
 	authenticatedUser *authenticatedUser
 	refreshTimeOut    int64
+	createdAt         int64
+	familyId          string
+	consumed          bool
+	grant             tokenGrant
+	// The creation of the family, that is the authentication of the user
+	familyCreatedAt int64
+}
+
+// tokenGrant holds what was granted with a token: the client that obtained it, the audiences for which it is
+// valid and its scopes. The tokens issued by a refresh keep the grant of the refresh token, possibly with less
+// scopes.
+type tokenGrant struct {
+	// The client that obtained the token, empty if unknown
+	clientId string
+	// The audiences of the token, empty if the token is not restricted
+	audiences []string
+	// The scopes granted to the token
+	scopes []string
+	// The address from which the user authenticated, if known
+	remoteAddress string
+}
+
+// refreshTokenCounters holds the counters about the life of the refresh tokens. The counters are updated
+// atomically so that they can be read while tokens are issued.
+type refreshTokenCounters struct {
+	issued   int64
+	consumed int64
+	reused   int64
+	swept    int64
+	evicted  int64
+	rejected int64
 }
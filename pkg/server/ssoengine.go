@@ -1,10 +1,6 @@
 package server
 
 import (
-	"crypto/rsa"
-	"io/ioutil"
-
-	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
 )
@@ -17,25 +13,19 @@ func newSsoEngine(configuration *Configuration) (ssoEngine, error) {
 		return nil, common.ErrBadConfiguration
 	}
 
-	// Build the providers
-	ssoProviders, err := newAuthenticationProvider(configuration)
-	if err != nil {
-		return nil, err
-	}
-
-	// The presence of SSO config is checked while loading config
-	privateKey, err := loadPrivateKey(*configuration.Sso)
+	// Open the store for the refresh tokens
+	refreshTokens, err := newRefreshTokenStore(*configuration.Sso)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ssoEngineImpl{
-		providers:            ssoProviders,
-		privateKey:           privateKey,
-		refreshTokens:        make(map[string]*refreshInformation),
-		tokenSecondsToLive:   *configuration.Sso.TokenSecondsToLive,
-		refreshSecondsToLive: *configuration.Sso.RefreshSecondsToLive,
-	}, nil
+	return buildSsoEngine(
+		configuration,
+		refreshTokens,
+		&refreshTokenCounters{},
+		buildAuthorizationCodeStore(),
+		buildAuthenticationFailureStore(),
+		newServerMetrics())
 }
 
 // newSsoEngineKeepingRefreshToken allocates a new ssoEngine reusing refresh tokens existing in the previous engine
@@ -46,42 +36,115 @@ func newSsoEngineKeepingRefreshToken(configuration *Configuration, previousEngin
 		return nil, common.ErrBadConfiguration
 	}
 
+	// Create a new engine, but keep the refresh token store, the pending authorization codes, the failed
+	// authentications and the metrics. Note that a change of the store in the configuration is only taken into account when the
+	// server is restarted.
+	return buildSsoEngine(
+		configuration,
+		previousEngine.GetRefreshTokenStore(),
+		previousEngine.GetRefreshTokenCounters(),
+		previousEngine.GetAuthorizationCodeStore(),
+		previousEngine.GetAuthenticationFailureStore(),
+		previousEngine.GetMetrics())
+}
+
+// buildSsoEngine allocates a new ssoEngine with the given configuration, using the given refresh token store,
+// authorization code store, failed authentication store and metrics
+func buildSsoEngine(
+	configuration *Configuration,
+	refreshTokens refreshTokenStore,
+	counters *refreshTokenCounters,
+	authorizationCodes *authorizationCodeStore,
+	authenticationFailures *authenticationFailureStore,
+	metrics *serverMetrics) (ssoEngine, error) {
+
 	// Build the providers
 	ssoProviders, err := newAuthenticationProvider(configuration)
 	if err != nil {
 		return nil, err
 	}
 
-	// The presence of SSO config is checked while loading config
-	privateKey, err := loadPrivateKey(*configuration.Sso)
+	// The longest time to live of the access tokens, among all the clients
+	clients := newRegisteredClients(configuration)
+	maxTokenSecondsToLive := *configuration.Sso.TokenSecondsToLive
+	for _, client := range clients {
+		if client.tokenSecondsToLive > maxTokenSecondsToLive {
+			maxTokenSecondsToLive = client.tokenSecondsToLive
+		}
+	}
+
+	// Load the keys for signing the tokens, keeping the retired keys as long as their tokens can live. The keys
+	// are checked while loading config
+	signingKeys, err := newSigningKeyRing(*configuration.Sso, maxTokenSecondsToLive)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a new engine, but keep the refresh token
-	return &ssoEngineImpl{
-		providers:            ssoProviders,
-		privateKey:           privateKey,
-		refreshTokens:        previousEngine.GetRefreshToken(),
-		tokenSecondsToLive:   *configuration.Sso.TokenSecondsToLive,
-		refreshSecondsToLive: *configuration.Sso.RefreshSecondsToLive,
-	}, nil
-}
+	// By default, the number of refresh tokens is not limited and the oldest are evicted when it is
+	maxRefreshTokens := 0
+	if configuration.Sso.MaxRefreshTokens != nil {
+		maxRefreshTokens = *configuration.Sso.MaxRefreshTokens
+	}
+	refreshEvictionPolicy := "oldest"
+	if configuration.Sso.RefreshEvictionPolicy != nil {
+		refreshEvictionPolicy = *configuration.Sso.RefreshEvictionPolicy
+	}
 
-func loadPrivateKey(configuration SsoConfiguration) (*rsa.PrivateKey, error) {
+	// By default, the first provider knowing the user authenticates it
+	providerPolicy := providerPolicyFirstMatch
+	if configuration.Sso.ProviderPolicy != nil {
+		providerPolicy = *configuration.Sso.ProviderPolicy
+	}
 
-	// Read the private key for signing token
-	privateKeyData, err := ioutil.ReadFile(*configuration.PrivateKeyPath)
-	if err != nil {
-		log.Error("Configuration for SSO, attribute privateKeyPath is referencing an unreadable file")
-		return nil, err
+	// By default, the tokens obtained by a token exchange live 5 minutes at most
+	exchangeSecondsToLive := int64(300)
+	if configuration.Sso.ExchangeSecondsToLive != nil {
+		exchangeSecondsToLive = *configuration.Sso.ExchangeSecondsToLive
 	}
 
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyData)
-	if err != nil {
-		log.Error("Configuration for SSO, attribute privateKeyPath is referencing a non-valid file")
-		return nil, err
+	// By default, keep the historical issuer
+	issuer := "EasySSO Server"
+	if configuration.Sso.Issuer != nil {
+		issuer = *configuration.Sso.Issuer
+	}
+
+	// The audiences that can be requested by the clients not registered
+	audiences := make([]string, 0)
+	if configuration.Sso.Audiences != nil {
+		for _, audience := range *configuration.Sso.Audiences {
+			audiences = append(audiences, *audience)
+		}
+	}
+
+	engine := &ssoEngineImpl{
+		providers:              ssoProviders,
+		providerPolicy:         providerPolicy,
+		signingKeys:            signingKeys,
+		issuer:                 issuer,
+		clients:                clients,
+		authorizationCodes:     authorizationCodes,
+		lockoutPolicy:          newLockoutPolicy(*configuration.Sso),
+		authenticationFailures: authenticationFailures,
+		refreshTokens:          refreshTokens,
+		refreshCounters:        counters,
+		metrics:                metrics,
+		tokenSecondsToLive:     *configuration.Sso.TokenSecondsToLive,
+		maxTokenSecondsToLive:  maxTokenSecondsToLive,
+		exchangeSecondsToLive:  exchangeSecondsToLive,
+		audiences:              audiences,
+		scopes:                 newScopeDefinitions(configuration.Sso),
+		claimMappings:          newClaimMappings(configuration.Sso),
+		roleMapping:            newRoleMapping(configuration.Sso),
+		roleHierarchy:          newRoleHierarchy(configuration.Sso),
+		refreshSecondsToLive:   *configuration.Sso.RefreshSecondsToLive,
+		maxRefreshTokens:       maxRefreshTokens,
+		refreshEvictionPolicy:  refreshEvictionPolicy,
+	}
+
+	// The roles of the registered clients are resolved once, the roles of the users when they authenticate
+	for _, client := range clients {
+		client.roles = engine.resolveRoles(authenticatedUserProviderClient, client.roles)
 	}
 
-	return privateKey, nil
+	return engine, nil
 }
@@ -1,22 +1,44 @@
 package server
 
 import (
-	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
 )
 
 // ssoEngine holds together all the information needed by the default SSO engine
 type ssoEngineImpl struct {
-	providers            []authenticationProvider
-	privateKey           *rsa.PrivateKey
-	refreshTokens        map[string]*refreshInformation
-	tokenSecondsToLive   int64
-	refreshSecondsToLive int64
+	providers              []authenticationProvider
+	providerPolicy         string
+	signingKeys            *signingKeyRing
+	issuer                 string
+	clients                map[string]*registeredClient
+	authorizationCodes     *authorizationCodeStore
+	lockoutPolicy          *lockoutPolicy
+	authenticationFailures *authenticationFailureStore
+	refreshTokens          refreshTokenStore
+	refreshCounters        *refreshTokenCounters
+	metrics                *serverMetrics
+	tokenSecondsToLive     int64
+	maxTokenSecondsToLive  int64
+	exchangeSecondsToLive  int64
+	audiences              []string
+	scopes                 []*scopeDefinition
+	claimMappings          []*claimMapping
+	roleMapping            *roleMapping
+	roleHierarchy          *roleHierarchy
+	refreshSecondsToLive   int64
+	maxRefreshTokens       int
+	refreshEvictionPolicy  string
 }
 
 // -------------------------------------------------------------------------------------------
@@ -26,70 +48,945 @@ type ssoEngineImpl struct {
 // -------------------------------------------------------------------------------------------
 
 // Authenticate validates the given user/password against all the providers configured in the order give
-// by the configuration
-func (engine ssoEngineImpl) Authenticate(userName string, password string) (*authenticatedUser, error) {
+// by the configuration. If the user or the address (that can be empty if unknown) is locked because of too
+// many failures, a *lockoutError is returned without trying the providers. Only the invalid credentials are
+// counted as failures, not the errors of the providers.
+func (engine ssoEngineImpl) Authenticate(userName string, password string, remoteAddress string) (*authenticatedUser, error) {
 
-	for _, provider := range engine.providers {
-		if user, err := provider.Authenticate(userName, password); err == nil {
-			return user, nil
-		}
+	// Without policy, the authentications are not limited
+	if engine.lockoutPolicy == nil {
+		return engine.authenticateWithProviders(userName, password)
+	}
+
+	// Do not even try the providers when locked, so that they are not flooded. The attempt is reserved at once, so
+	// that concurrent attempts can not go past the limit.
+	if retryAfter := engine.authenticationFailures.TryBegin(engine.lockoutPolicy, userName, remoteAddress); retryAfter > 0 {
+		log.WithFields(log.Fields{
+			"security":      true,
+			"user":          userName,
+			"remoteAddress": remoteAddress,
+		}).Warn("Authentication refused as the user or the address is locked")
+		return nil, &lockoutError{retryAfter: retryAfter}
+	}
+
+	user, err := engine.authenticateWithProviders(userName, password)
+	if (err == common.ErrUserNotFound) || (err == common.ErrUnauthorized) {
+		engine.authenticationFailures.AddFailure(engine.lockoutPolicy, userName, remoteAddress)
+		return nil, err
+	} else if err != nil {
+		engine.authenticationFailures.Cancel(engine.lockoutPolicy, userName, remoteAddress)
+		return nil, err
 	}
-	return nil, common.ErrUserNotFound
+
+	engine.authenticationFailures.AddSuccess(engine.lockoutPolicy, userName, remoteAddress)
+	return user, nil
 }
 
-// Enroll add the authenticated user in the SSO and returns a new AuthenticatedResponse
-func (engine ssoEngineImpl) Enroll(authenticatedUser *authenticatedUser) (*common.AuthenticationResponse, error) {
+// GetLockouts returns the users and the addresses currently locked
+func (engine ssoEngineImpl) GetLockouts() []*protocol.Lockout {
+	return engine.authenticationFailures.GetLockouts()
+}
 
-	return engine.generateAuthenticationResponse(authenticatedUser)
+// Unlock forgets the failed authentications of the given user and of the given address (any of them can be
+// empty) and returns the number of them that were locked
+func (engine ssoEngineImpl) Unlock(userName string, remoteAddress string) int {
+	return engine.authenticationFailures.Unlock(userName, remoteAddress)
 }
 
-// Refresh uses the given refresh token (the id) to returns a new AuthenticatedResponse
-func (engine *ssoEngineImpl) Refresh(refreshToken string) (*common.AuthenticationResponse, error) {
+// Enroll add the authenticated user in the SSO and returns a new AuthenticatedResponse with the given grant
+func (engine ssoEngineImpl) Enroll(authenticatedUser *authenticatedUser, grant tokenGrant) (*protocol.AuthenticationResponse, error) {
 
-	refreshInformation := engine.refreshTokens[refreshToken]
+	// Each authentication starts a new family of refresh tokens
+	familyId := uuid.NewV4().String()
+
+	return engine.generateAuthenticationResponse(authenticatedUser, familyId, time.Now().Unix(), grant)
+}
+
+// Refresh uses the given refresh token (the id) to returns a new AuthenticatedResponse. If the client is given,
+// the refresh token must have been obtained by this client. If scopes are given, they must have been granted with
+// the refresh token and only them are granted to the new token. The user of the refresh token is also returned,
+// even with an error, if the refresh token is known.
+func (engine ssoEngineImpl) Refresh(refreshToken string, clientId string, scopes []string) (*protocol.AuthenticationResponse, *authenticatedUser, error) {
+
+	// The scopes can not be widened. This is checked before consuming the refresh token, so that the client can
+	// still use it with the right scopes
+	if len(scopes) > 0 {
+		refreshInformation, err := engine.refreshTokens.Get(refreshToken)
+		if err != nil {
+			log.Error("Unable to read the RefreshToken ", refreshToken)
+			return nil, nil, err
+		}
+		if refreshInformation != nil {
+			for _, scope := range scopes {
+				if !containsString(refreshInformation.grant.scopes, scope) {
+					log.WithFields(log.Fields{
+						"security": true,
+						"user":     refreshInformation.authenticatedUser.UserName,
+						"scope":    scope,
+					}).Warn("A refresh requested a scope that was not granted with the RefreshToken")
+					return nil, refreshInformation.authenticatedUser, errScopeNotAllowed
+				}
+			}
+		}
+	}
+
+	// Consume the refresh token. It is kept until its time out so that a reuse can be detected. As the
+	// consumption is atomic, only one of two concurrent queries with the same refresh token can succeed
+	refreshInformation, err := engine.refreshTokens.Consume(refreshToken)
+	if err != nil {
+		log.Error("Unable to consume the RefreshToken ", refreshToken)
+		return nil, nil, err
+	}
 
 	if refreshInformation == nil {
 		log.Error("Unable to find the refreshInformation for the RefreshToken ", refreshToken)
-		return nil, common.ErrRefreshTokenNotFound
+		return nil, nil, common.ErrRefreshTokenNotFound
+	}
+
+	// A refresh token used twice was probably stolen: as it is not possible to know which of the two
+	// users is the legitimate one, the whole family is revoked
+	if refreshInformation.consumed {
+		log.WithFields(log.Fields{
+			"security": true,
+			"user":     refreshInformation.authenticatedUser.UserName,
+			"familyId": refreshInformation.familyId,
+		}).Warn("A consumed RefreshToken was presented again. Revoking all the RefreshTokens of its family.")
+		atomic.AddInt64(&engine.refreshCounters.reused, 1)
+		engine.revokeRefreshTokenFamily(refreshInformation.familyId)
+		return nil, refreshInformation.authenticatedUser, errRefreshTokenReused
 	}
 
 	if refreshInformation.refreshTimeOut < time.Now().Unix() {
 		log.Error("The RefreshToken is too old to be used ", refreshToken)
-		return nil, common.ErrRefreshTooOld
+		return nil, refreshInformation.authenticatedUser, common.ErrRefreshTooOld
+	}
+
+	// A client can not use the refresh tokens of another client
+	if (len(clientId) > 0) && (len(refreshInformation.grant.clientId) > 0) && (clientId != refreshInformation.grant.clientId) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"user":     refreshInformation.authenticatedUser.UserName,
+			"clientId": clientId,
+		}).Warn("A RefreshToken was presented by another client. Revoking all the RefreshTokens of its family.")
+		engine.revokeRefreshTokenFamily(refreshInformation.familyId)
+		return nil, refreshInformation.authenticatedUser, common.ErrUnauthorized
+	}
+
+	atomic.AddInt64(&engine.refreshCounters.consumed, 1)
+
+	// The new tokens keep the grant, with only the scopes requested if any
+	grant := refreshInformation.grant
+	if len(scopes) > 0 {
+		grant.scopes = scopes
+	}
+
+	response, err := engine.generateAuthenticationResponse(
+		refreshInformation.authenticatedUser,
+		refreshInformation.familyId,
+		refreshInformation.familyCreatedAt,
+		grant)
+
+	return response, refreshInformation.authenticatedUser, err
+}
+
+// Revoke invalidates the given token, that can be a refresh token (in which case all the refresh tokens of
+// its family are revoked) or an access token. Revoking a token that is unknown is not an error. If the client is
+// given, the token must have been obtained by this client.
+func (engine ssoEngineImpl) Revoke(token string, tokenTypeHint string, clientId string) error {
+
+	// Unless told otherwise, the token is first looked for as a refresh token
+	if tokenTypeHint != protocol.TokenTypeHintAccessToken {
+		refreshInformation, err := engine.refreshTokens.Get(token)
+		if err != nil {
+			log.Error("Unable to read the RefreshToken to revoke")
+			return err
+		}
+		if refreshInformation != nil {
+			if (len(clientId) > 0) && (refreshInformation.grant.clientId != clientId) {
+				log.WithFields(log.Fields{
+					"security": true,
+					"clientId": clientId,
+					"user":     refreshInformation.authenticatedUser.UserName,
+				}).Warn("A client tried to revoke a RefreshToken issued to another client")
+				return errTokenNotOwned
+			}
+			log.WithFields(log.Fields{
+				"user":     refreshInformation.authenticatedUser.UserName,
+				"familyId": refreshInformation.familyId,
+			}).Info("Revoking all the RefreshTokens of a family")
+			engine.revokeRefreshTokenFamily(refreshInformation.familyId)
+			return nil
+		}
+	}
+
+	// Then as an access token, that must have been issued by this server (even if already expired)
+	claims, err := engine.parseAccessToken(token)
+	if err != nil || len(claims.Id) == 0 {
+		log.Debug("The token to revoke is neither a known RefreshToken nor a valid access token")
+		return nil
+	}
+
+	if (len(clientId) > 0) && (claims.ClientId != clientId) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"clientId": clientId,
+			"user":     claims.User,
+		}).Warn("A client tried to revoke an access token issued to another client")
+		return errTokenNotOwned
+	}
+
+	log.WithFields(log.Fields{
+		"user":    claims.User,
+		"tokenId": claims.Id,
+	}).Info("Revoking an access token")
+
+	return engine.refreshTokens.RevokeAccessToken(claims.Id, claims.ExpiresAt)
+}
+
+// RevokeAccessTokenId invalidates the access token with the given id. As the client of the token is not known,
+// the registered clients can not revoke an access token by its id: they must give the token itself.
+func (engine ssoEngineImpl) RevokeAccessTokenId(tokenId string, clientId string) error {
+
+	if engine.clients[clientId] != nil {
+		log.WithFields(log.Fields{
+			"security": true,
+			"clientId": clientId,
+			"tokenId":  tokenId,
+		}).Warn("A registered client tried to revoke an access token by its id")
+		return errTokenNotOwned
 	}
-	return engine.generateAuthenticationResponse(refreshInformation.authenticatedUser)
+
+	log.WithFields(log.Fields{
+		"tokenId": tokenId,
+	}).Info("Revoking an access token")
+
+	// As the expiration of the token is not known, keep it as long as a token can live
+	return engine.refreshTokens.RevokeAccessToken(tokenId, time.Now().Unix()+engine.maxTokenSecondsToLive)
+}
+
+// GetSessions returns the active sessions, only the ones of the given user if not empty. A session is a family of
+// refresh tokens, described by its refresh token that can still be used.
+func (engine ssoEngineImpl) GetSessions(userName string) ([]*protocol.Session, error) {
+
+	refreshTokens, err := engine.refreshTokens.GetAll()
+	if err != nil {
+		log.Error("Unable to read the RefreshTokens for listing the sessions")
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	sessions := make([]*protocol.Session, 0)
+	for _, refreshInformation := range refreshTokens {
+
+		if refreshInformation.consumed || (refreshInformation.refreshTimeOut < now) {
+			continue
+		}
+		if (len(userName) > 0) && (refreshInformation.authenticatedUser.UserName != userName) {
+			continue
+		}
+
+		// The refresh tokens issued before the sessions were followed do not know their creation
+		createdAt := refreshInformation.familyCreatedAt
+		if createdAt == 0 {
+			createdAt = refreshInformation.createdAt
+		}
+
+		sessions = append(sessions, &protocol.Session{
+			SessionId:     refreshInformation.familyId,
+			UserName:      refreshInformation.authenticatedUser.UserName,
+			ClientId:      refreshInformation.grant.clientId,
+			RemoteAddress: refreshInformation.grant.remoteAddress,
+			CreatedAt:     createdAt,
+			LastRefreshAt: refreshInformation.createdAt,
+			ExpiresAt:     refreshInformation.refreshTimeOut,
+		})
+	}
+
+	// Give the oldest sessions first
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt != sessions[j].CreatedAt {
+			return sessions[i].CreatedAt < sessions[j].CreatedAt
+		}
+		return sessions[i].SessionId < sessions[j].SessionId
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession invalidates all the refresh tokens of the given session and returns the number of sessions
+// revoked (0 if the session is unknown)
+func (engine ssoEngineImpl) RevokeSession(sessionId string) (int, error) {
+
+	return engine.revokeSessions(func(refreshInformation *refreshInformation) bool {
+		return refreshInformation.familyId == sessionId
+	})
+}
+
+// RevokeUserSessions invalidates all the refresh tokens of the given user and returns the number of sessions
+// revoked
+func (engine ssoEngineImpl) RevokeUserSessions(userName string) (int, error) {
+
+	return engine.revokeSessions(func(refreshInformation *refreshInformation) bool {
+		return refreshInformation.authenticatedUser.UserName == userName
+	})
 }
 
-func (engine ssoEngineImpl) GetRefreshToken() map[string]*refreshInformation {
+// Introspect returns the information about the given token, that can be a refresh token or an access token.
+// A token that is unknown, expired, consumed or revoked is reported as not active.
+func (engine ssoEngineImpl) Introspect(token string, tokenTypeHint string) (*protocol.IntrospectionResponse, error) {
+
+	now := time.Now().Unix()
+
+	// Unless told otherwise, the token is first looked for as a refresh token
+	if tokenTypeHint != protocol.TokenTypeHintAccessToken {
+		refreshInformation, err := engine.refreshTokens.Get(token)
+		if err != nil {
+			log.Error("Unable to read the RefreshToken to introspect")
+			return nil, err
+		}
+		if refreshInformation != nil {
+			if refreshInformation.consumed || refreshInformation.refreshTimeOut < now {
+				return &protocol.IntrospectionResponse{Active: false}, nil
+			}
+			return &protocol.IntrospectionResponse{
+				Active:    true,
+				TokenType: protocol.TokenTypeHintRefreshToken,
+				Subject:   refreshInformation.authenticatedUser.UserName,
+				UserName:  refreshInformation.authenticatedUser.UserName,
+				Roles:     engine.tokenRoles(refreshInformation.authenticatedUser.Roles),
+				ExpiresAt: refreshInformation.refreshTimeOut,
+				IssuedAt:  refreshInformation.createdAt,
+				ClientId:  refreshInformation.grant.clientId,
+				Audience:  refreshInformation.grant.audiences,
+				Scope:     formatScope(refreshInformation.grant.scopes),
+			}, nil
+		}
+	}
+
+	// Then as an access token, that must have been issued by this server
+	claims, err := engine.parseAccessToken(token)
+	if err != nil || claims.ExpiresAt < now {
+		return &protocol.IntrospectionResponse{Active: false}, nil
+	}
+
+	revoked, err := engine.refreshTokens.IsAccessTokenRevoked(claims.Id)
+	if err != nil {
+		log.Error("Unable to read the revoked access tokens")
+		return nil, err
+	}
+	if revoked {
+		return &protocol.IntrospectionResponse{Active: false}, nil
+	}
+
+	return &protocol.IntrospectionResponse{
+		Active:    true,
+		TokenType: protocol.TokenTypeHintAccessToken,
+		Subject:   claims.User,
+		UserName:  claims.User,
+		Roles:     claims.Roles,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		Issuer:    claims.Issuer,
+		TokenId:   claims.Id,
+		ClientId:  claims.ClientId,
+		Audience:  claims.Audience,
+		Scope:     claims.Scope,
+		Actor:     claims.Actor,
+	}, nil
+}
+
+// GetPublicKeys returns the public part of the keys used for signing the tokens
+func (engine ssoEngineImpl) GetPublicKeys() *protocol.JsonWebKeySet {
+
+	publishedKeys := engine.signingKeys.GetPublishedKeys()
+
+	keys := make([]protocol.JsonWebKey, 0, len(publishedKeys))
+	for _, key := range publishedKeys {
+		keys = append(keys, key.toJsonWebKey())
+	}
+
+	return &protocol.JsonWebKeySet{
+		Keys: keys,
+	}
+}
+
+// RotateSigningKeys generates a new key for signing the tokens if the rotation is configured and due
+func (engine ssoEngineImpl) RotateSigningKeys() error {
+	return engine.signingKeys.Rotate()
+}
+
+// GetIssuer returns the issuer of the tokens
+func (engine ssoEngineImpl) GetIssuer() string {
+	return engine.issuer
+}
+
+// GetClient returns the registered client with the given id, or nil if the client is not registered
+func (engine ssoEngineImpl) GetClient(clientId string) *registeredClient {
+	return engine.clients[clientId]
+}
+
+// CheckAudiences returns an error if the given client can not request one of the given audiences. A registered
+// client can request the audiences it is allowed to, the other clients the audiences of the SSO.
+func (engine ssoEngineImpl) CheckAudiences(clientId string, audiences []string) error {
+
+	allowedAudiences := engine.audiences
+	if client := engine.clients[clientId]; (client != nil) && (client.allowedAudiences != nil) {
+		allowedAudiences = client.allowedAudiences
+	}
+
+	for _, audience := range audiences {
+		if !containsString(allowedAudiences, audience) {
+			log.WithFields(log.Fields{
+				"security": true,
+				"clientId": clientId,
+				"audience": audience,
+			}).Warn("A client requested an audience that it is not allowed to request")
+			return errAudienceNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// GrantScopes returns the scopes granted to the user among the requested ones. An error is returned if a scope is
+// unknown or can not be requested by the client. The scopes that the user can not obtain are not granted.
+func (engine ssoEngineImpl) GrantScopes(authenticatedUser *authenticatedUser, clientId string, scopes []string) ([]string, error) {
+
+	client := engine.clients[clientId]
+
+	grantedScopes := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+
+		definition := engine.getScopeDefinition(scope)
+		if (definition == nil) || ((client != nil) && !client.isScopeAllowed(scope)) {
+			log.WithFields(log.Fields{
+				"security": true,
+				"clientId": clientId,
+				"scope":    scope,
+			}).Warn("A client requested a scope that is unknown or that it is not allowed to request")
+			return nil, errScopeNotAllowed
+		}
+
+		// The roles of the user are expanded, so that the scopes given to a role are also given to the roles
+		// implying it
+		if definition.isGrantedTo(authenticatedUser.Roles) {
+			grantedScopes = append(grantedScopes, scope)
+		}
+	}
+
+	return grantedScopes, nil
+}
+
+// GetSupportedScopes returns the name of all the scopes that can be requested
+func (engine ssoEngineImpl) GetSupportedScopes() []string {
+
+	names := make([]string, 0, len(engine.scopes))
+	for _, scope := range engine.scopes {
+		names = append(names, scope.name)
+	}
+
+	return names
+}
+
+// GetMappedClaims returns the name of the claims mapped from the attributes of the users
+func (engine ssoEngineImpl) GetMappedClaims() []string {
+
+	names := make([]string, 0, len(engine.claimMappings))
+	for _, mapping := range engine.claimMappings {
+		names = append(names, mapping.claim)
+	}
+
+	return names
+}
+
+// CreateAuthorizationCode issues a new authorization code for the authenticated user. The code can only be
+// redeemed by the client of the grant, with the same redirection URI and the verifier of the code challenge
+// (PKCE).
+func (engine ssoEngineImpl) CreateAuthorizationCode(
+	authenticatedUser *authenticatedUser,
+	grant tokenGrant,
+	redirectURI string,
+	codeChallenge string) (string, error) {
+
+	code, err := engine.authorizationCodes.Put(&authorizationCode{
+		authenticatedUser: authenticatedUser,
+		grant:             grant,
+		redirectURI:       redirectURI,
+		codeChallenge:     codeChallenge,
+		expiresAt:         time.Now().Unix() + authorizationCodeSecondsToLive,
+	})
+	if err != nil {
+		log.Error("Unable to generate an authorization code", err)
+		return "", err
+	}
+
+	return code, nil
+}
+
+// RedeemAuthorizationCode exchanges an authorization code for a new AuthenticatedResponse. The code can only be
+// used once. The user of the code is also returned, even with an error, if the code is known.
+func (engine ssoEngineImpl) RedeemAuthorizationCode(
+	code string,
+	clientId string,
+	redirectURI string,
+	codeVerifier string) (*protocol.AuthenticationResponse, *authenticatedUser, error) {
+
+	information := engine.authorizationCodes.Consume(code)
+	if information == nil {
+		log.Debug("The authorization code is not known or was already used")
+		return nil, nil, errAuthorizationCodeInvalid
+	}
+
+	if information.expiresAt < time.Now().Unix() {
+		log.Debug("The authorization code is expired")
+		return nil, information.authenticatedUser, errAuthorizationCodeInvalid
+	}
+
+	if (information.grant.clientId != clientId) || (information.redirectURI != redirectURI) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"clientId": clientId,
+		}).Warn("An authorization code was presented by another client or with another redirect URI")
+		return nil, information.authenticatedUser, errAuthorizationCodeInvalid
+	}
+
+	// The challenge is the hash of the verifier (S256 method, RFC 7636)
+	verifierHash := sha256.Sum256([]byte(codeVerifier))
+	expectedChallenge := base64.RawURLEncoding.EncodeToString(verifierHash[:])
+	if subtle.ConstantTimeCompare([]byte(expectedChallenge), []byte(information.codeChallenge)) != 1 {
+		log.Debug("The code verifier does not match the code challenge")
+		return nil, information.authenticatedUser, errAuthorizationCodeInvalid
+	}
+
+	response, err := engine.Enroll(information.authenticatedUser, information.grant)
+
+	return response, information.authenticatedUser, err
+}
+
+// AuthenticateClient validates the given client id/secret against the registered clients
+func (engine ssoEngineImpl) AuthenticateClient(clientId string, clientSecret string) (*registeredClient, error) {
+
+	client := engine.clients[clientId]
+	if client == nil || !client.isSecretValid(clientSecret) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"clientId": clientId,
+		}).Warn("A client failed to authenticate")
+		return nil, common.ErrUnauthorized
+	}
+
+	return client, nil
+}
+
+// EnrollClient returns a new AuthenticatedResponse for the authenticated client itself (client credentials grant),
+// with the given grant. The response does not have a refresh token, as the client can authenticate again at any
+// time.
+func (engine ssoEngineImpl) EnrollClient(client *registeredClient, grant tokenGrant) (*protocol.AuthenticationResponse, error) {
+
+	// The token is always obtained by the client itself
+	grant.clientId = client.clientId
+
+	_, token, err := engine.generateJWTToken(client.toAuthenticatedUser(), grant)
+	if err != nil {
+		log.Error("Unable to generate a response for the client credentials query", err)
+		return nil, err
+	}
+
+	return &protocol.AuthenticationResponse{
+		AuthenticationResponse: common.AuthenticationResponse{
+			TokenType:   "bearer",
+			AccessToken: token,
+		},
+		Scope: formatScope(grant.scopes),
+	}, nil
+}
+
+// ExchangeToken returns a new AuthenticatedResponse, without refresh token, for the user of the given access token
+// (token exchange, RFC 8693). The access token must have been issued for the client: either its audiences include
+// the client, or it has no audience and was obtained by the client. The new token has the authenticated client as
+// actor, only the given audiences and a shorter time to live. If scopes are given, they must have been granted
+// with the subject token. The user of the subject token is also returned, even with an error, if the token is valid.
+func (engine ssoEngineImpl) ExchangeToken(
+	client *registeredClient,
+	subjectToken string,
+	audiences []string,
+	scopes []string) (*protocol.AuthenticationResponse, *authenticatedUser, error) {
+
+	// The subject token must be an access token issued by this server that can still be used
+	now := time.Now().Unix()
+	subjectClaims, err := engine.parseAccessToken(subjectToken)
+	if err != nil || subjectClaims.ExpiresAt < now {
+		return nil, nil, errSubjectTokenInvalid
+	}
+	revoked, err := engine.refreshTokens.IsAccessTokenRevoked(subjectClaims.Id)
+	if err != nil {
+		log.Error("Unable to read the revoked access tokens")
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, errSubjectTokenInvalid
+	}
+
+	// The provider of the user is not kept in the tokens
+	user := &authenticatedUser{
+		UserName: subjectClaims.User,
+		Roles:    subjectClaims.Roles,
+	}
+
+	// The client can only exchange the tokens that it received (RFC 8693, section 2.2.1)
+	if !client.isSubjectTokenAllowed(subjectClaims) {
+		log.WithFields(log.Fields{
+			"security": true,
+			"user":     user.UserName,
+			"clientId": client.clientId,
+		}).Warn("A client tried to exchange a token that was not issued for it")
+		return nil, user, errSubjectTokenInvalid
+	}
+
+	// The scopes can not be widened, and must be allowed to the client
+	subjectScopes := parseScope(subjectClaims.Scope)
+	if len(scopes) == 0 {
+		scopes = subjectScopes
+	}
+	for _, scope := range scopes {
+		if !containsString(subjectScopes, scope) {
+			log.WithFields(log.Fields{
+				"security": true,
+				"user":     user.UserName,
+				"clientId": client.clientId,
+				"scope":    scope,
+			}).Warn("A token exchange requested a scope that was not granted with the subject token")
+			return nil, user, errScopeNotAllowed
+		}
+	}
+	scopes, err = engine.GrantScopes(user, client.clientId, scopes)
+	if err != nil {
+		return nil, user, err
+	}
+
+	// The new token can not outlive the subject token
+	expiresAt := now + engine.exchangeSecondsToLive
+	if clientExpiresAt := now + engine.getTokenSecondsToLive(client.clientId); clientExpiresAt < expiresAt {
+		expiresAt = clientExpiresAt
+	}
+	if subjectClaims.ExpiresAt < expiresAt {
+		expiresAt = subjectClaims.ExpiresAt
+	}
+
+	claims := &protocol.TokenClaims{
+		CustomClaims: common.CustomClaims{
+			User:  subjectClaims.User,
+			Roles: subjectClaims.Roles,
+			StandardClaims: jwt.StandardClaims{
+				Id:        uuid.NewV4().String(),
+				Subject:   subjectClaims.Subject,
+				ExpiresAt: expiresAt,
+				IssuedAt:  now,
+				Issuer:    engine.issuer,
+			},
+		},
+		Audience:        audiences,
+		AuthorizedParty: client.clientId,
+		ClientId:        client.clientId,
+		Scope:           formatScope(scopes),
+		Actor: &protocol.Actor{
+			Subject: client.clientId,
+			Actor:   subjectClaims.Actor,
+		},
+		Extra: subjectClaims.Extra,
+	}
+
+	token, err := engine.signTokenClaims(claims)
+	if err != nil {
+		log.Error("Unable to generate a response for the token exchange query", err)
+		return nil, user, err
+	}
+
+	return &protocol.AuthenticationResponse{
+		AuthenticationResponse: common.AuthenticationResponse{
+			TokenType:   "bearer",
+			AccessToken: token,
+		},
+		Scope:           formatScope(scopes),
+		IssuedTokenType: protocol.TokenTypeAccessToken,
+	}, user, nil
+}
+
+// GetAuthorizationCodeStore returns the store of the authorization codes not redeemed yet
+func (engine ssoEngineImpl) GetAuthorizationCodeStore() *authorizationCodeStore {
+	return engine.authorizationCodes
+}
+
+// GetAuthenticationFailureStore returns the store of the failed authentications
+func (engine ssoEngineImpl) GetAuthenticationFailureStore() *authenticationFailureStore {
+	return engine.authenticationFailures
+}
+
+// GetRefreshTokenStore returns the store of the current active refresh tokens
+func (engine ssoEngineImpl) GetRefreshTokenStore() refreshTokenStore {
 	return engine.refreshTokens
 }
 
+// GetRefreshTokenCounters returns the counters of the refresh tokens
+func (engine ssoEngineImpl) GetRefreshTokenCounters() *refreshTokenCounters {
+	return engine.refreshCounters
+}
+
+// GetMetrics returns the metrics of the server
+func (engine ssoEngineImpl) GetMetrics() *serverMetrics {
+	return engine.metrics
+}
+
+// SweepRefreshTokens removes all the refresh tokens that are timed out and returns the number of refresh
+// tokens removed
+func (engine ssoEngineImpl) SweepRefreshTokens() (int, error) {
+
+	refreshTokens, err := engine.refreshTokens.GetAll()
+	if err != nil {
+		log.Error("Unable to read the RefreshTokens for sweeping them")
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	timedOutIds := make([]string, 0)
+	for refreshId, refreshInformation := range refreshTokens {
+		if refreshInformation.refreshTimeOut < now {
+			timedOutIds = append(timedOutIds, refreshId)
+		}
+	}
+
+	swept := 0
+	if err := engine.refreshTokens.DeleteMany(timedOutIds); err != nil {
+		log.Error("Unable to remove the timed out RefreshTokens")
+	} else {
+		swept = len(timedOutIds)
+	}
+
+	atomic.AddInt64(&engine.refreshCounters.swept, int64(swept))
+
+	if _, err := engine.refreshTokens.PurgeRevokedAccessTokens(now); err != nil {
+		log.Error("Unable to forget the expired revoked access tokens")
+	}
+
+	if err := engine.refreshTokens.Compact(); err != nil {
+		log.Error("Unable to compact the RefreshTokens store")
+	}
+
+	engine.authenticationFailures.Sweep(engine.lockoutPolicy)
+
+	return swept, nil
+}
+
+// CheckReadiness checks, concurrently, that each provider can be used and that the active key can sign the
+// tokens. A check not done within readinessCheckTimeout is failed. The details of the failures are only logged.
+func (engine ssoEngineImpl) CheckReadiness() []*protocol.ReadinessCheck {
+
+	type indexedCheck struct {
+		index int
+		check *protocol.ReadinessCheck
+	}
+
+	signingKey := engine.signingKeys.GetActiveKey()
+
+	// Until its result is received, each check is reported as timed out. The channel can receive all the results,
+	// so that the checks ending after the delay are not blocked.
+	checks := make([]*protocol.ReadinessCheck, 0, len(engine.providers)+1)
+	instances := make([]string, 0, len(engine.providers)+1)
+	results := make(chan indexedCheck, len(engine.providers)+1)
+
+	for _, provider := range engine.providers {
+		checks = append(checks, newTimedOutReadinessCheck(provider.Name()))
+		instances = append(instances, provider.Instance())
+		go func(index int, provider authenticationProvider) {
+			results <- indexedCheck{index, runReadinessCheck(provider.Name(), provider.Instance(), provider.CheckHealth)}
+		}(len(checks)-1, provider)
+	}
+
+	checks = append(checks, newTimedOutReadinessCheck("signingKey"))
+	instances = append(instances, signingKey.keyId)
+	go func(index int) {
+		results <- indexedCheck{index, runReadinessCheck("signingKey", signingKey.keyId, signingKey.CheckSignature)}
+	}(len(checks) - 1)
+
+	timeout := time.After(readinessCheckTimeout)
+	received := make([]bool, len(checks))
+	for count := 0; count < len(checks); count++ {
+		select {
+		case result := <-results:
+			checks[result.index] = result.check
+			received[result.index] = true
+		case <-timeout:
+			for index, check := range checks {
+				if !received[index] {
+					log.Warn("The readiness check ", check.Name, " (", instances[index], ") did not end in time")
+				}
+			}
+			return checks
+		}
+	}
+
+	return checks
+}
+
 // -------------------------------------------------------------------------------------------
 //
 // Private methods
 //
 // -------------------------------------------------------------------------------------------
 
+// authenticateWithProviders validates the given user/password against the providers, following the policy configured
+func (engine ssoEngineImpl) authenticateWithProviders(userName string, password string) (*authenticatedUser, error) {
+
+	switch engine.providerPolicy {
+	case providerPolicyMergeAll:
+		return engine.authenticateWithAllProviders(userName, password)
+	case providerPolicyPrimary:
+		return engine.authenticateWithPrimaryProvider(userName, password)
+	default:
+		return engine.authenticateWithFirstProvider(userName, password)
+	}
+}
+
+// authenticateWithFirstProvider returns the user authenticated by the first provider that knows it. A wrong password
+// stops the chain, so that the user can not be authenticated by a later provider with another password. If no provider
+// knows the user but some of them could not answer, the error of the first of them is returned, as the user may be
+// known by it.
+func (engine ssoEngineImpl) authenticateWithFirstProvider(userName string, password string) (*authenticatedUser, error) {
+
+	failure := common.ErrUserNotFound
+	for _, provider := range engine.providers {
+		user, err := engine.authenticateWithProvider(provider, userName, password)
+		if err == nil {
+			return user, nil
+		}
+		if err == common.ErrUnauthorized {
+			return nil, common.ErrUnauthorized
+		}
+		if (err != common.ErrUserNotFound) && (failure == common.ErrUserNotFound) {
+			failure = err
+		}
+	}
+	return nil, failure
+}
+
+// authenticateWithAllProviders returns the user authenticated by at least one provider, with the roles of all the
+// providers authenticating it. The attributes of the first provider authenticating the user are preferred. A wrong
+// password given to any provider stops the chain, so that the user can not be authenticated by another provider with
+// another password. If no provider authenticates the user, the error of a provider that could not answer is preferred
+// to an unknown user.
+func (engine ssoEngineImpl) authenticateWithAllProviders(userName string, password string) (*authenticatedUser, error) {
+
+	var mergedUser *authenticatedUser
+	failure := common.ErrUserNotFound
+	for _, provider := range engine.providers {
+		user, err := engine.authenticateWithProvider(provider, userName, password)
+		if err == common.ErrUnauthorized {
+			return nil, common.ErrUnauthorized
+		}
+		if err != nil {
+			if (err != common.ErrUserNotFound) && (failure == common.ErrUserNotFound) {
+				failure = err
+			}
+			continue
+		}
+
+		if mergedUser == nil {
+			mergedUser = user
+		} else {
+			mergedUser = mergeAuthenticatedUsers(mergedUser, user)
+		}
+	}
+
+	if mergedUser == nil {
+		return nil, failure
+	}
+	return mergedUser, nil
+}
+
+// authenticateWithPrimaryProvider returns the user authenticated by the first provider, with the roles the other
+// providers give to it. The other providers never authenticate the user and can not make the authentication fail.
+func (engine ssoEngineImpl) authenticateWithPrimaryProvider(userName string, password string) (*authenticatedUser, error) {
+
+	user, err := engine.authenticateWithProvider(engine.providers[0], userName, password)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, provider := range engine.providers[1:] {
+		otherUser, err := provider.Lookup(userName)
+		if err == common.ErrUserNotFound {
+			continue
+		} else if err != nil {
+			log.Warn("Unable to read the roles of the user ", userName, " from the provider ", provider.Name(), " (", provider.Instance(), "): ", err)
+			continue
+		}
+
+		otherUser.Roles = engine.resolveRoles(otherUser.Provider, otherUser.Roles)
+		user = mergeAuthenticatedUsers(user, otherUser)
+	}
+
+	return user, nil
+}
+
+// authenticateWithProvider validates the given user/password against a single provider
+func (engine ssoEngineImpl) authenticateWithProvider(provider authenticationProvider, userName string, password string) (*authenticatedUser, error) {
+
+	start := time.Now()
+	user, err := provider.Authenticate(userName, password)
+
+	// A provider that can not give an answer (e.g. not reachable) is an error, not a failure
+	outcome := metricsOutcomeSuccess
+	if err == common.ErrUserNotFound || err == common.ErrUnauthorized {
+		outcome = metricsOutcomeFailure
+	} else if err != nil {
+		outcome = metricsOutcomeError
+	}
+	engine.metrics.ObserveProviderAuthentication(provider.Name(), provider.Instance(), outcome, time.Since(start))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The groups given by the provider are rewritten before being used for anything
+	user.Roles = engine.resolveRoles(user.Provider, user.Roles)
+	return user, nil
+}
+
 // generateAuthenticationResponse convert the information from an authentication to a response suitable for the client
-func (engine ssoEngineImpl) generateAuthenticationResponse(authenticatedUser *authenticatedUser) (*common.AuthenticationResponse, error) {
+func (engine ssoEngineImpl) generateAuthenticationResponse(
+	authenticatedUser *authenticatedUser,
+	familyId string,
+	familyCreatedAt int64,
+	grant tokenGrant) (*protocol.AuthenticationResponse, error) {
 
-	_, token, err := engine.generateJWTToken(authenticatedUser)
+	_, token, err := engine.generateJWTToken(authenticatedUser, grant)
 	if err != nil {
 		log.Error("Unable to generate a response for the authentication/refresh query", err)
 		return nil, err
 	}
 
-	refreshId := engine.generateRefreshToken(authenticatedUser)
+	refreshId, err := engine.generateRefreshToken(authenticatedUser, familyId, familyCreatedAt, grant)
+	if err != nil {
+		log.Error("Unable to generate a refresh token for the authentication/refresh query", err)
+		return nil, err
+	}
 
-	return &common.AuthenticationResponse{
-		TokenType:    "bearer",
-		AccessToken:  token,
-		RefreshToken: refreshId,
+	return &protocol.AuthenticationResponse{
+		AuthenticationResponse: common.AuthenticationResponse{
+			TokenType:    "bearer",
+			AccessToken:  token,
+			RefreshToken: refreshId,
+		},
+		Scope: formatScope(grant.scopes),
 	}, nil
 }
 
-// generateRefreshToken generate a new Refresh information for the given user
-func (engine ssoEngineImpl) generateRefreshToken(authenticatedUser *authenticatedUser) string {
+// generateRefreshToken generate a new Refresh information for the given user in the given family
+func (engine ssoEngineImpl) generateRefreshToken(
+	authenticatedUser *authenticatedUser,
+	familyId string,
+	familyCreatedAt int64,
+	grant tokenGrant) (string, error) {
 
 	refreshUuid := uuid.NewV4()
 
@@ -97,35 +994,246 @@ func (engine ssoEngineImpl) generateRefreshToken(authenticatedUser *authenticate
 
 	refreshInformation := &refreshInformation{
 		authenticatedUser: authenticatedUser,
-		refreshTimeOut:    time.Now().Unix() + engine.refreshSecondsToLive,
+		refreshTimeOut:    time.Now().Unix() + engine.getRefreshSecondsToLive(grant.clientId),
+		createdAt:         time.Now().Unix(),
+		familyId:          familyId,
+		grant:             grant,
+		familyCreatedAt:   familyCreatedAt,
+	}
+
+	// The limit is checked by the store, atomically with the insertion of the new refresh token
+	evicted, err := engine.refreshTokens.Add(refreshId, refreshInformation, engine.maxRefreshTokens, engine.refreshEvictionPolicy != "reject")
+	atomic.AddInt64(&engine.refreshCounters.evicted, int64(evicted))
+	if err == errTooManyRefreshTokens {
+		log.Warn("The maximum number of RefreshTokens is reached. Rejecting the new RefreshToken.")
+		atomic.AddInt64(&engine.refreshCounters.rejected, 1)
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	atomic.AddInt64(&engine.refreshCounters.issued, 1)
+
+	return refreshId, nil
+}
+
+// revokeSessions removes all the refresh tokens selected by the given function and returns the number of
+// sessions (families) that had at least one refresh token removed
+func (engine ssoEngineImpl) revokeSessions(isSelected func(refreshInformation *refreshInformation) bool) (int, error) {
+
+	refreshTokens, err := engine.refreshTokens.GetAll()
+	if err != nil {
+		log.Error("Unable to read the RefreshTokens for revoking the sessions")
+		return 0, err
+	}
+
+	revokedIds := make([]string, 0)
+	revokedFamilies := make(map[string]bool)
+	for refreshId, refreshInformation := range refreshTokens {
+		if isSelected(refreshInformation) {
+			revokedIds = append(revokedIds, refreshId)
+			revokedFamilies[refreshInformation.familyId] = true
+		}
+	}
+
+	if err := engine.refreshTokens.DeleteMany(revokedIds); err != nil {
+		log.Error("Unable to revoke the RefreshTokens of the sessions")
+		return 0, err
+	}
+
+	return len(revokedFamilies), nil
+}
+
+// revokeRefreshTokenFamily removes all the refresh tokens of the given family
+func (engine ssoEngineImpl) revokeRefreshTokenFamily(familyId string) {
+
+	refreshTokens, err := engine.refreshTokens.GetAll()
+	if err != nil {
+		log.Error("Unable to read the RefreshTokens for revoking the family ", familyId)
+		return
 	}
 
-	engine.refreshTokens[refreshId] = refreshInformation
+	familyRefreshIds := make([]string, 0)
+	for refreshId, refreshInformation := range refreshTokens {
+		if refreshInformation.familyId == familyId {
+			familyRefreshIds = append(familyRefreshIds, refreshId)
+		}
+	}
 
-	return refreshId
+	if err := engine.refreshTokens.DeleteMany(familyRefreshIds); err != nil {
+		log.Error("Unable to revoke the RefreshTokens of the family ", familyId)
+	}
 }
 
-// generateJWTToken generate a new JWT Token for the given user
-func (engine ssoEngineImpl) generateJWTToken(authenticatedUser *authenticatedUser) (*common.CustomClaims, string, error) {
+// generateJWTToken generate a new JWT Token for the given user, with the given grant
+func (engine ssoEngineImpl) generateJWTToken(authenticatedUser *authenticatedUser, grant tokenGrant) (*protocol.TokenClaims, string, error) {
 
 	// Build the claims
-	claims := &common.CustomClaims{
-		User:  authenticatedUser.UserName,
-		Roles: authenticatedUser.Roles,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + engine.tokenSecondsToLive,
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    "EasySSO Server",
+	claims := &protocol.TokenClaims{
+		CustomClaims: common.CustomClaims{
+			User:  authenticatedUser.UserName,
+			Roles: engine.tokenRoles(authenticatedUser.Roles),
+			StandardClaims: jwt.StandardClaims{
+				Id:        uuid.NewV4().String(),
+				Subject:   authenticatedUser.UserName,
+				ExpiresAt: time.Now().Unix() + engine.getTokenSecondsToLive(grant.clientId),
+				IssuedAt:  time.Now().Unix(),
+				Issuer:    engine.issuer,
+			},
 		},
+		Audience:        grant.audiences,
+		AuthorizedParty: grant.clientId,
+		ClientId:        grant.clientId,
+		Scope:           formatScope(grant.scopes),
+		Extra:           mapAttributesToClaims(engine.claimMappings, authenticatedUser),
 	}
-	// Build the token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS512, claims)
 
-	// Convert the token to a string
-	tokenString, err := token.SignedString(engine.privateKey)
+	tokenString, err := engine.signTokenClaims(claims)
 	if err != nil {
-		log.Error("Unable to sign generated token", err)
 		return nil, "", err
 	}
 	return claims, tokenString, nil
 }
+
+// signTokenClaims returns the JWT Token with the given claims, signed with the active key
+func (engine ssoEngineImpl) signTokenClaims(claims *protocol.TokenClaims) (string, error) {
+
+	// Build the token, giving the id of the key so that the services can find the key to validate it
+	signingKey := engine.signingKeys.GetActiveKey()
+	token := jwt.NewWithClaims(signingKey.signingMethod, claims)
+	token.Header["kid"] = signingKey.keyId
+
+	// Convert the token to a string
+	start := time.Now()
+	tokenString, err := token.SignedString(signingKey.privateKey)
+	engine.metrics.ObserveSigning(signingKey.signingMethod.Alg(), time.Since(start))
+	if err != nil {
+		log.Error("Unable to sign generated token", err)
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// runReadinessCheck runs the given check and returns its result with its latency. The error of a failed check is
+// logged with the instance checked, as it can hold information (addresses, bind DN, ...) not to be published.
+func runReadinessCheck(name string, instance string, check func() error) *protocol.ReadinessCheck {
+
+	start := time.Now()
+	err := check()
+
+	result := &protocol.ReadinessCheck{
+		Name:      name,
+		Status:    protocol.ReadinessStatusOk,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		log.Warn("The readiness check ", name, " (", instance, ") failed: ", err)
+		result.Status = protocol.ReadinessStatusFailed
+	}
+
+	return result
+}
+
+// newTimedOutReadinessCheck returns the result of a check not done within readinessCheckTimeout
+func newTimedOutReadinessCheck(name string) *protocol.ReadinessCheck {
+
+	return &protocol.ReadinessCheck{
+		Name:      name,
+		Status:    protocol.ReadinessStatusFailed,
+		LatencyMs: float64(readinessCheckTimeout) / float64(time.Millisecond),
+	}
+}
+
+// parseAccessToken reads an access token issued by this server and returns its claims. The signature of the
+// token is verified, but not its expiration.
+func (engine ssoEngineImpl) parseAccessToken(accessToken string) (*protocol.TokenClaims, error) {
+
+	token, err := jwt.ParseWithClaims(accessToken, &protocol.TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		// Without kid, the token can only have been signed by the active key
+		signingKey := engine.signingKeys.GetActiveKey()
+		if keyId, ok := token.Header["kid"].(string); ok {
+			signingKey = engine.signingKeys.FindKey(keyId)
+		}
+		if signingKey == nil || token.Method.Alg() != signingKey.signingMethod.Alg() {
+			return nil, common.ErrSignatureInvalid
+		}
+		return signingKey.privateKey.Public(), nil
+	})
+
+	// Accept the tokens that are only invalid because expired
+	if err != nil {
+		validationError, ok := err.(*jwt.ValidationError)
+		if !ok || validationError.Errors != jwt.ValidationErrorExpired {
+			return nil, common.ErrTokenMalformed
+		}
+	}
+
+	claims, ok := token.Claims.(*protocol.TokenClaims)
+	if !ok {
+		return nil, common.ErrTokenMalformed
+	}
+
+	return claims, nil
+}
+
+// getTokenSecondsToLive returns the time to live of the access tokens issued for the given client
+func (engine ssoEngineImpl) getTokenSecondsToLive(clientId string) int64 {
+
+	if client := engine.clients[clientId]; (client != nil) && (client.tokenSecondsToLive > 0) {
+		return client.tokenSecondsToLive
+	}
+
+	return engine.tokenSecondsToLive
+}
+
+// getRefreshSecondsToLive returns the time to live of the refresh tokens issued for the given client
+func (engine ssoEngineImpl) getRefreshSecondsToLive(clientId string) int64 {
+
+	if client := engine.clients[clientId]; (client != nil) && (client.refreshSecondsToLive > 0) {
+		return client.refreshSecondsToLive
+	}
+
+	return engine.refreshSecondsToLive
+}
+
+// resolveRoles returns the roles of a user for the groups given by its provider. This is the only place where the
+// roles are computed, always in the same order: the groups are first rewritten by the role mapping, then the roles
+// are expanded with all the roles they imply. The roles of the registered clients are given in the configuration
+// and are only expanded. The resolved roles are kept with the refresh tokens, so that a refreshed token has the same
+// roles as the token it replaces.
+func (engine ssoEngineImpl) resolveRoles(provider string, groups []string) []string {
+
+	roles := groups
+	if (engine.roleMapping != nil) && (provider != authenticatedUserProviderClient) {
+		roles = engine.roleMapping.MapRoles(provider, roles)
+	}
+
+	if engine.roleHierarchy != nil {
+		roles = engine.roleHierarchy.ExpandRoles(roles)
+	}
+
+	return roles
+}
+
+// tokenRoles returns the roles given in the tokens for the resolved roles of a user: all of them, or only the ones
+// not implied by another of them if the role hierarchy is configured so
+func (engine ssoEngineImpl) tokenRoles(roles []string) []string {
+
+	if engine.roleHierarchy == nil {
+		return roles
+	}
+
+	return engine.roleHierarchy.TokenRoles(roles)
+}
+
+// getScopeDefinition returns the definition of the scope with the given name, or nil if the scope is unknown
+func (engine ssoEngineImpl) getScopeDefinition(name string) *scopeDefinition {
+
+	for _, scope := range engine.scopes {
+		if scope.name == name {
+			return scope
+		}
+	}
+
+	return nil
+}
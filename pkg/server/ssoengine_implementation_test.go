@@ -0,0 +1,215 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+)
+
+func TestRefreshRotatesTheRefreshToken(t *testing.T) {
+
+	engine := newTestEngine(t, newTestConfiguration(t))
+	_, refreshToken := enrollTestUser(t, engine, tokenGrant{})
+
+	response, _, err := engine.Refresh(refreshToken, "", nil)
+	if err != nil {
+		t.Fatal("The refresh failed: ", err)
+	}
+	if len(response.RefreshToken) == 0 || response.RefreshToken == refreshToken {
+		t.Error("The refresh did not give a new refresh token")
+	}
+}
+
+func TestRefreshWithAConsumedTokenRevokesItsFamily(t *testing.T) {
+
+	engine := newTestEngine(t, newTestConfiguration(t))
+	_, refreshToken := enrollTestUser(t, engine, tokenGrant{})
+	_, otherRefreshToken := enrollTestUser(t, engine, tokenGrant{})
+
+	response, _, err := engine.Refresh(refreshToken, "", nil)
+	if err != nil {
+		t.Fatal("The first refresh failed: ", err)
+	}
+
+	// Presenting the consumed refresh token again is a reuse
+	_, user, err := engine.Refresh(refreshToken, "", nil)
+	if err != errRefreshTokenReused {
+		t.Fatal("The reuse of the refresh token was not detected: ", err)
+	}
+	if user == nil || user.UserName != testUserName {
+		t.Error("The user of the reused refresh token was not returned")
+	}
+
+	// The refresh token obtained with the consumed one is revoked with the whole family
+	if _, _, err := engine.Refresh(response.RefreshToken, "", nil); err != common.ErrRefreshTokenNotFound {
+		t.Error("The refresh token of the family was not revoked: ", err)
+	}
+
+	// The other families are kept
+	if _, _, err := engine.Refresh(otherRefreshToken, "", nil); err != nil {
+		t.Error("The refresh token of another family was revoked: ", err)
+	}
+}
+
+func TestExchangeTokenAcceptsTheTokensWithoutAudienceOfTheClient(t *testing.T) {
+
+	engine := newTestEngine(t, newTestConfigurationWithClients(t, "orders-service"))
+	accessToken, _ := enrollTestUser(t, engine, tokenGrant{clientId: "orders-service"})
+
+	response, user, err := engine.ExchangeToken(engine.GetClient("orders-service"), accessToken, []string{"billing"}, nil)
+	if err != nil {
+		t.Fatal("The exchange of a token without audience obtained by the client failed: ", err)
+	}
+	if len(response.AccessToken) == 0 || user == nil || user.UserName != testUserName {
+		t.Error("The exchange did not give a token for the user of the subject token")
+	}
+}
+
+func TestExchangeTokenRefusesTheTokensWithoutAudienceOfAnotherClient(t *testing.T) {
+
+	engine := newTestEngine(t, newTestConfigurationWithClients(t, "orders-service", "billing-service"))
+	accessToken, _ := enrollTestUser(t, engine, tokenGrant{clientId: "orders-service"})
+
+	_, _, err := engine.ExchangeToken(engine.GetClient("billing-service"), accessToken, nil, nil)
+	if err != errSubjectTokenInvalid {
+		t.Fatal("A client exchanged a token without audience obtained by another client: ", err)
+	}
+}
+
+func TestExchangeTokenAcceptsTheTokensForTheClient(t *testing.T) {
+
+	engine := newTestEngine(t, newTestConfigurationWithClients(t, "orders-service", "billing-service"))
+	grant := tokenGrant{clientId: "orders-service", audiences: []string{"billing-service"}}
+	accessToken, _ := enrollTestUser(t, engine, grant)
+
+	if _, _, err := engine.ExchangeToken(engine.GetClient("billing-service"), accessToken, nil, nil); err != nil {
+		t.Fatal("The exchange of a token having the client as audience failed: ", err)
+	}
+	if _, _, err := engine.ExchangeToken(engine.GetClient("orders-service"), accessToken, nil, nil); err != errSubjectTokenInvalid {
+		t.Fatal("A client exchanged a token whose audiences do not include it: ", err)
+	}
+}
+
+// stubProvider is a provider knowing the users of its table, or failing with its error if given
+type stubProvider struct {
+	name string
+	// The password of each user
+	passwords map[string]string
+	roles     []string
+	err       error
+}
+
+func (provider stubProvider) Authenticate(userName string, password string) (*authenticatedUser, error) {
+
+	user, err := provider.Lookup(userName)
+	if err != nil {
+		return nil, err
+	}
+	if provider.passwords[userName] != password {
+		return nil, common.ErrUnauthorized
+	}
+	return user, nil
+}
+
+func (provider stubProvider) Lookup(userName string) (*authenticatedUser, error) {
+
+	if provider.err != nil {
+		return nil, provider.err
+	}
+	if _, ok := provider.passwords[userName]; !ok {
+		return nil, common.ErrUserNotFound
+	}
+	return &authenticatedUser{UserName: userName, Roles: provider.roles, Provider: provider.name}, nil
+}
+
+func (provider stubProvider) Name() string {
+	return provider.name
+}
+
+func (provider stubProvider) Instance() string {
+	return provider.name
+}
+
+func (provider stubProvider) CheckHealth() error {
+	return provider.err
+}
+
+func TestProviderPolicies(t *testing.T) {
+
+	knowing := func(name string, password string, role string) stubProvider {
+		return stubProvider{name: name, passwords: map[string]string{testUserName: password}, roles: []string{role}}
+	}
+	unknowing := stubProvider{name: "unknowing", passwords: map[string]string{}}
+	unreachable := stubProvider{name: "unreachable", err: errUnreachableProvider}
+
+	tests := []struct {
+		name          string
+		policy        string
+		providers     []authenticationProvider
+		expectedError error
+		expectedRoles []string
+	}{
+		{"first match, first provider", providerPolicyFirstMatch, []authenticationProvider{knowing("a", testPassword, "a"), knowing("b", testPassword, "b")}, nil, []string{"a"}},
+		{"first match, unknown user passes to the next provider", providerPolicyFirstMatch, []authenticationProvider{unknowing, knowing("b", testPassword, "b")}, nil, []string{"b"}},
+		{"first match, provider error passes to the next provider", providerPolicyFirstMatch, []authenticationProvider{unreachable, knowing("b", testPassword, "b")}, nil, []string{"b"}},
+		{"first match, rejection stops the chain", providerPolicyFirstMatch, []authenticationProvider{knowing("a", "other-password", "a"), knowing("b", testPassword, "b")}, common.ErrUnauthorized, nil},
+		{"first match, provider error is not an unknown user", providerPolicyFirstMatch, []authenticationProvider{unreachable, unknowing}, errUnreachableProvider, nil},
+		{"first match, unknown user", providerPolicyFirstMatch, []authenticationProvider{unknowing}, common.ErrUserNotFound, nil},
+		{"merge all, roles are merged", providerPolicyMergeAll, []authenticationProvider{knowing("a", testPassword, "a"), unknowing, knowing("b", testPassword, "b")}, nil, []string{"a", "b"}},
+		{"merge all, rejection stops the chain", providerPolicyMergeAll, []authenticationProvider{knowing("a", testPassword, "a"), knowing("b", "other-password", "b")}, common.ErrUnauthorized, nil},
+		{"merge all, rejection before an authentication", providerPolicyMergeAll, []authenticationProvider{knowing("a", "other-password", "a"), knowing("b", testPassword, "b")}, common.ErrUnauthorized, nil},
+		{"merge all, provider error is ignored if another provider authenticates", providerPolicyMergeAll, []authenticationProvider{unreachable, knowing("b", testPassword, "b")}, nil, []string{"b"}},
+		{"merge all, provider error is not an unknown user", providerPolicyMergeAll, []authenticationProvider{unknowing, unreachable}, errUnreachableProvider, nil},
+		{"primary, roles of the other providers are added", providerPolicyPrimary, []authenticationProvider{knowing("a", testPassword, "a"), knowing("b", "other-password", "b")}, nil, []string{"a", "b"}},
+		{"primary, rejection is not passed to the other providers", providerPolicyPrimary, []authenticationProvider{knowing("a", "other-password", "a"), knowing("b", testPassword, "b")}, common.ErrUnauthorized, nil},
+		{"primary, unknown user is not passed to the other providers", providerPolicyPrimary, []authenticationProvider{unknowing, knowing("b", testPassword, "b")}, common.ErrUserNotFound, nil},
+		{"primary, provider error is not an unknown user", providerPolicyPrimary, []authenticationProvider{unreachable, knowing("b", testPassword, "b")}, errUnreachableProvider, nil},
+		{"primary, unreachable other provider is ignored", providerPolicyPrimary, []authenticationProvider{knowing("a", testPassword, "a"), unreachable}, nil, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		configuration := newTestConfiguration(t)
+		configuration.Sso.ProviderPolicy = stringPointer(test.policy)
+		engine := newTestEngine(t, configuration)
+		engine.(*ssoEngineImpl).providers = test.providers
+
+		user, err := engine.Authenticate(testUserName, testPassword, "")
+		if err != test.expectedError {
+			t.Errorf("%s: the authentication returned %v, expected %v", test.name, err, test.expectedError)
+			continue
+		}
+		if (err == nil) && (strings.Join(user.Roles, ",") != strings.Join(test.expectedRoles, ",")) {
+			t.Errorf("%s: the user has the roles %v, expected %v", test.name, user.Roles, test.expectedRoles)
+		}
+	}
+}
+
+func TestRefreshWithWiderScopesIsRefusedWithoutConsumingTheToken(t *testing.T) {
+
+	configuration := newTestConfiguration(t)
+	configuration.Sso.Scopes = &[]*ScopeConfiguration{
+		{Name: stringPointer("read")},
+		{Name: stringPointer("write")},
+	}
+	engine := newTestEngine(t, configuration)
+	_, refreshToken := enrollTestUser(t, engine, tokenGrant{scopes: []string{"read"}})
+
+	if _, _, err := engine.Refresh(refreshToken, "", []string{"read", "write"}); err != errScopeNotAllowed {
+		t.Fatal("The refresh with a wider scope was not refused: ", err)
+	}
+
+	information, err := engine.(*ssoEngineImpl).refreshTokens.Get(refreshToken)
+	if (err != nil) || (information == nil) || information.consumed {
+		t.Fatal("The refused refresh consumed the refresh token")
+	}
+
+	// The refresh token can still be used with the scopes it was granted
+	response, _, err := engine.Refresh(refreshToken, "", []string{"read"})
+	if err != nil {
+		t.Fatal("The refresh with the granted scope failed: ", err)
+	}
+	if response.Scope != "read" {
+		t.Errorf("The refreshed token has the scope %q, expected read", response.Scope)
+	}
+}
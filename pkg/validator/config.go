@@ -6,7 +6,10 @@ import (
 )
 
 type Configuration struct {
-	PublicKeyPath *string `json:"publicKeyPath"`
+	PublicKeyPath        *string `json:"publicKeyPath"`
+	JwksURL              *string `json:"jwksURL"`
+	JwksHTTPSCertificate *string `json:"jwksHTTPSCertificate"`
+	Audience             *string `json:"audience"`
 }
 
 // validateConfiguration validates the configuration data
@@ -18,8 +21,18 @@ func ValidateConfiguration(configuration *Configuration) error {
 	}
 
 	// Basic tests
-	if configuration.PublicKeyPath == nil {
-		log.Error("Configuration for SSO is missing the definition for publicKeyPath attribute")
+	if (configuration.PublicKeyPath == nil) && (configuration.JwksURL == nil) {
+		log.Error("Configuration for SSO is missing the definition for publicKeyPath or jwksURL attribute")
+		return common.ErrBadConfiguration
+	}
+
+	if (configuration.PublicKeyPath != nil) && (configuration.JwksURL != nil) {
+		log.Error("Configuration for SSO can not have both publicKeyPath and jwksURL attributes")
+		return common.ErrBadConfiguration
+	}
+
+	if (configuration.Audience != nil) && (len(*configuration.Audience) == 0) {
+		log.Error("Configuration for SSO, attribute audience can not be empty")
 		return common.ErrBadConfiguration
 	}
 
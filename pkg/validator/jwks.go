@@ -0,0 +1,183 @@
+package validator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// jwksMinimumFetchInterval is the minimum time between two queries of the keys, so that tokens with an unknown
+// key id can not be used to flood the server
+const jwksMinimumFetchInterval = 10 * time.Second
+
+// jwksKeySet holds the public keys published by the server as a JWKS. The keys are fetched when a token
+// references a key id that is not known yet, so that the rotations of the keys are followed.
+type jwksKeySet struct {
+	url        string
+	httpClient *http.Client
+	mutex      sync.RWMutex
+	keys       map[string]crypto.PublicKey
+	lastFetch  time.Time
+}
+
+// getKey returns the key with the given id. If the id is empty and the server only publishes a single key,
+// this key is returned.
+func (keySet *jwksKeySet) getKey(keyId string) (crypto.PublicKey, error) {
+
+	if key := keySet.findKey(keyId); key != nil {
+		return key, nil
+	}
+
+	// Unknown key, try to fetch the keys again
+	if err := keySet.fetch(); err != nil {
+		return nil, err
+	}
+
+	if key := keySet.findKey(keyId); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("the key %s is not published by the server", keyId)
+}
+
+// findKey returns the key with the given id among the keys already fetched, or nil
+func (keySet *jwksKeySet) findKey(keyId string) crypto.PublicKey {
+
+	keySet.mutex.RLock()
+	defer keySet.mutex.RUnlock()
+
+	if len(keyId) == 0 && len(keySet.keys) == 1 {
+		for _, key := range keySet.keys {
+			return key
+		}
+	}
+
+	return keySet.keys[keyId]
+}
+
+// fetch queries the keys from the server, unless they were queried recently
+func (keySet *jwksKeySet) fetch() error {
+
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	if time.Since(keySet.lastFetch) < jwksMinimumFetchInterval {
+		return nil
+	}
+	keySet.lastFetch = time.Now()
+
+	response, err := keySet.httpClient.Get(keySet.url)
+	if err != nil {
+		log.Error("Unable to fetch the keys from ", keySet.url, err)
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		log.Error("Unable to fetch the keys from ", keySet.url, " - status ", response.StatusCode)
+		return fmt.Errorf("the server answered the query of the keys with the status %d", response.StatusCode)
+	}
+
+	var jsonWebKeySet protocol.JsonWebKeySet
+	if err := json.NewDecoder(response.Body).Decode(&jsonWebKeySet); err != nil {
+		log.Error("Unable to read the keys from ", keySet.url, err)
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jsonWebKeySet.Keys))
+	for _, jsonWebKey := range jsonWebKeySet.Keys {
+		key, err := parseJsonWebKey(jsonWebKey)
+		if err != nil {
+			log.Warn("The server published the key ", jsonWebKey.KeyId, " that can not be used. Skipping key.")
+			continue
+		}
+		keys[jsonWebKey.KeyId] = key
+	}
+	keySet.keys = keys
+
+	return nil
+}
+
+// parseJsonWebKey converts a JWK to a public key. The RSA keys, the EC keys on the curves P-256 and P-384 and the
+// Ed25519 keys are supported.
+func parseJsonWebKey(jsonWebKey protocol.JsonWebKey) (crypto.PublicKey, error) {
+
+	switch jsonWebKey.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jsonWebKey.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jsonWebKey.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jsonWebKey.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jsonWebKey.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jsonWebKey.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(jsonWebKey.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, fmt.Errorf("the point of the key is not on the curve %s", jsonWebKey.Curve)
+		}
+
+		return publicKey, nil
+
+	case "OKP":
+		if jsonWebKey.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jsonWebKey.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jsonWebKey.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("the Ed25519 key does not have the expected size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jsonWebKey.KeyType)
+}
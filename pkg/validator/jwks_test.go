@@ -0,0 +1,229 @@
+package validator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// testSigningKeys holds a key of each supported type, by key id
+type testSigningKeys map[string]crypto.Signer
+
+func newTestSigningKeys(t *testing.T) testSigningKeys {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Unable to generate the RSA key: ", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate the P-256 key: ", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate the P-384 key: ", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate the Ed25519 key: ", err)
+	}
+
+	return testSigningKeys{"rsa": rsaKey, "p256": p256Key, "p384": p384Key, "ed25519": ed25519Key}
+}
+
+// toJsonWebKey returns the public part of the given key as a JWK
+func toJsonWebKey(t *testing.T, keyId string, privateKey crypto.Signer) protocol.JsonWebKey {
+
+	jsonWebKey := protocol.JsonWebKey{KeyId: keyId, Use: "sig"}
+
+	switch key := privateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jsonWebKey.KeyType = "RSA"
+		jsonWebKey.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jsonWebKey.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jsonWebKey.KeyType = "EC"
+		jsonWebKey.Curve = key.Curve.Params().Name
+		jsonWebKey.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jsonWebKey.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jsonWebKey.KeyType = "OKP"
+		jsonWebKey.Curve = "Ed25519"
+		jsonWebKey.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		t.Fatalf("Unsupported type of key %T", key)
+	}
+
+	return jsonWebKey
+}
+
+// newTestJwksValidator returns a validator fetching the given keys from a test server
+func newTestJwksValidator(t *testing.T, keys testSigningKeys) *validatorImpl {
+
+	keySet := protocol.JsonWebKeySet{Keys: make([]protocol.JsonWebKey, 0, len(keys))}
+	for keyId, key := range keys {
+		keySet.Keys = append(keySet.Keys, toJsonWebKey(t, keyId, key))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(keySet)
+	}))
+	t.Cleanup(server.Close)
+
+	jwksURL := server.URL
+	validator, err := New(&Configuration{JwksURL: &jwksURL})
+	if err != nil {
+		t.Fatal("Unable to build the validator: ", err)
+	}
+
+	return validator.(*validatorImpl)
+}
+
+func TestTokensSignedWithEachAlgorithmAreValidatedWithTheJwks(t *testing.T) {
+
+	keys := newTestSigningKeys(t)
+	validator := newTestJwksValidator(t, keys)
+
+	tests := []struct {
+		signingMethod jwt.SigningMethod
+		keyId         string
+	}{
+		{jwt.SigningMethodRS256, "rsa"},
+		{jwt.SigningMethodRS384, "rsa"},
+		{jwt.SigningMethodRS512, "rsa"},
+		{jwt.SigningMethodPS256, "rsa"},
+		{jwt.SigningMethodPS384, "rsa"},
+		{jwt.SigningMethodPS512, "rsa"},
+		{jwt.SigningMethodES256, "p256"},
+		{jwt.SigningMethodES384, "p384"},
+		{protocol.SigningMethodEdDSA, "ed25519"},
+	}
+
+	for _, test := range tests {
+		token := signTestToken(t, test.signingMethod, test.keyId, keys[test.keyId])
+
+		claims, err := validator.getClaimsFromRequest(newTestRequest(token))
+		if err != nil {
+			t.Errorf("%s: the token was refused: %v", test.signingMethod.Alg(), err)
+			continue
+		}
+		if claims.User != "user" {
+			t.Errorf("%s: the validation returned the user %s", test.signingMethod.Alg(), claims.User)
+		}
+	}
+}
+
+func TestKeysCanNotBeUsedWithTheAlgorithmOfAnotherType(t *testing.T) {
+
+	keys := newTestSigningKeys(t)
+	validator := newTestJwksValidator(t, keys)
+
+	// The public RSA key, as known by everybody, used as the secret of an HMAC
+	rsaPublicKey, err := x509.MarshalPKIXPublicKey(keys["rsa"].Public())
+	if err != nil {
+		t.Fatal("Unable to serialize the RSA key: ", err)
+	}
+	hmacHeaderToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user": "user"})
+	hmacHeaderToken.Header["kid"] = "rsa"
+	hmacToken, err := hmacHeaderToken.SignedString(rsaPublicKey)
+	if err != nil {
+		t.Fatal("Unable to sign the HMAC token: ", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"RSA key with HS256", hmacToken},
+		{"RSA key with ES256", signTestToken(t, jwt.SigningMethodES256, "rsa", keys["p256"])},
+		{"P-256 key with ES384", signTestToken(t, jwt.SigningMethodES384, "p256", keys["p384"])},
+		{"P-384 key with ES256", signTestToken(t, jwt.SigningMethodES256, "p384", keys["p256"])},
+		{"P-256 key with RS256", signTestToken(t, jwt.SigningMethodRS256, "p256", keys["rsa"])},
+		{"Ed25519 key with RS256", signTestToken(t, jwt.SigningMethodRS256, "ed25519", keys["rsa"])},
+		{"RSA key with EdDSA", signTestToken(t, protocol.SigningMethodEdDSA, "rsa", keys["ed25519"])},
+	}
+
+	for _, test := range tests {
+		if _, err := validator.getClaimsFromRequest(newTestRequest(test.token)); err != common.ErrSignatureInvalid {
+			t.Errorf("%s: the validation returned %v, expected an invalid signature", test.name, err)
+		}
+	}
+}
+
+func TestIsAlgorithmOfKey(t *testing.T) {
+
+	keys := newTestSigningKeys(t)
+
+	tests := []struct {
+		signingMethod jwt.SigningMethod
+		keyId         string
+		expected      bool
+	}{
+		{jwt.SigningMethodRS256, "rsa", true},
+		{jwt.SigningMethodPS512, "rsa", true},
+		{jwt.SigningMethodHS256, "rsa", false},
+		{jwt.SigningMethodES256, "rsa", false},
+		{protocol.SigningMethodEdDSA, "rsa", false},
+		{jwt.SigningMethodES256, "p256", true},
+		{jwt.SigningMethodES384, "p256", false},
+		{jwt.SigningMethodES384, "p384", true},
+		{jwt.SigningMethodES256, "p384", false},
+		{jwt.SigningMethodRS256, "p256", false},
+		{jwt.SigningMethodHS256, "p256", false},
+		{protocol.SigningMethodEdDSA, "ed25519", true},
+		{jwt.SigningMethodES256, "ed25519", false},
+		{jwt.SigningMethodHS256, "ed25519", false},
+	}
+
+	for _, test := range tests {
+		if isAlgorithmOfKey(test.signingMethod, keys[test.keyId].Public()) != test.expected {
+			t.Errorf("The algorithm %s with the key %s should give %v", test.signingMethod.Alg(), test.keyId, test.expected)
+		}
+	}
+}
+
+func TestInvalidJsonWebKeysAreRefused(t *testing.T) {
+
+	keys := newTestSigningKeys(t)
+
+	// A point of P-256 given as a point of P-384
+	p256OnP384 := toJsonWebKey(t, "p256", keys["p256"])
+	p256OnP384.Curve = "P-384"
+
+	truncatedEd25519 := toJsonWebKey(t, "ed25519", keys["ed25519"])
+	truncatedEd25519.X = truncatedEd25519.X[:10]
+
+	tests := []struct {
+		name       string
+		jsonWebKey protocol.JsonWebKey
+	}{
+		{"unknown type", protocol.JsonWebKey{KeyType: "oct"}},
+		{"unsupported curve", protocol.JsonWebKey{KeyType: "EC", Curve: "P-521"}},
+		{"point not on the curve", p256OnP384},
+		{"unsupported OKP curve", protocol.JsonWebKey{KeyType: "OKP", Curve: "X25519"}},
+		{"truncated Ed25519 key", truncatedEd25519},
+		{"malformed modulus", protocol.JsonWebKey{KeyType: "RSA", N: "not base64!", E: "AQAB"}},
+	}
+
+	for _, test := range tests {
+		if _, err := parseJsonWebKey(test.jsonWebKey); err == nil {
+			t.Errorf("%s: the key was accepted", test.name)
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package validator
 
 import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
@@ -17,14 +23,26 @@ func New(configuration *Configuration) (Validator, error) {
 		return nil, err
 	}
 
-	// Read the private key for signing token
+	// If the keys are published by the server
+	if configuration.JwksURL != nil {
+		keySet, err := newJwksKeySet(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return &validatorImpl{
+			serverKeySet: keySet,
+			audience:     getAudience(configuration),
+		}, nil
+	}
+
+	// Read the public key for validating the tokens
 	publicKeyData, err := ioutil.ReadFile(*configuration.PublicKeyPath)
 	if err != nil {
 		log.Error("Configuration for SSO, attribute privateKeyPath is referencing an unreadable file")
 		return nil, err
 	}
 
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+	publicKey, err := parsePublicKey(publicKeyData)
 	if err != nil {
 		log.Error("Configuration for SSO, attribute privateKeyPath is referencing a non-valid file")
 		return nil, err
@@ -32,5 +50,75 @@ func New(configuration *Configuration) (Validator, error) {
 
 	return &validatorImpl{
 		serverPublicKey: publicKey,
+		audience:        getAudience(configuration),
 	}, nil
 }
+
+// getAudience returns the audience expected in the tokens, or an empty string if the audience is not checked
+func getAudience(configuration *Configuration) string {
+
+	if configuration.Audience == nil {
+		return ""
+	}
+
+	return *configuration.Audience
+}
+
+// newJwksKeySet creates the key set fetching the keys published by the server. If the server can not be
+// reached, the keys will be fetched when the first token is received
+func newJwksKeySet(configuration *Configuration) (*jwksKeySet, error) {
+
+	httpClient := &http.Client{}
+
+	// If a specific certificate is added
+	if configuration.JwksHTTPSCertificate != nil {
+		pool := x509.NewCertPool()
+
+		contents, err := ioutil.ReadFile(*configuration.JwksHTTPSCertificate)
+		if err != nil {
+			log.Error("Configuration for SSO, attribute jwksHTTPSCertificate is referencing an unreadable file")
+			return nil, err
+		}
+
+		pool.AppendCertsFromPEM(contents)
+
+		httpClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	keySet := &jwksKeySet{
+		url:        *configuration.JwksURL,
+		httpClient: httpClient,
+	}
+
+	if err := keySet.fetch(); err != nil {
+		log.Warn("Unable to fetch the keys from the server. The keys will be fetched with the first token.")
+		keySet.lastFetch = time.Time{}
+	}
+
+	return keySet, nil
+}
+
+// parsePublicKey reads a PEM encoded public key: a PKIX key of any supported type, a PKCS1 RSA key or a
+// certificate
+func parsePublicKey(publicKeyData []byte) (crypto.PublicKey, error) {
+
+	block, _ := pem.Decode(publicKeyData)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -1,31 +1,40 @@
 package validator
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"github.com/twuillemin/easy-sso-common/pkg/common"
 	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
 )
 
 type validatorImpl struct {
-	serverPublicKey *rsa.PublicKey
+	// The key read from the configuration, if any
+	serverPublicKey crypto.PublicKey
+	// The keys published by the server, if any
+	serverKeySet *jwksKeySet
+	// The audience that the tokens must have, if any
+	audience string
 }
 
 // GetUserFromTokenOrFail is be inserted at beginning of each endpoint for ensuring that
 // the authentication token is present and valid
-func (validator validatorImpl) GetUserFromHeaderOrFail(writer http.ResponseWriter, request *http.Request) (string, []string, error) {
+func (validator *validatorImpl) GetUserFromHeaderOrFail(writer http.ResponseWriter, request *http.Request) (string, []string, error) {
 
-	// Use the common package to retrieve authentication
-	authenticationInformation, err := common.GetAuthenticationFromRequest(request, validator.serverPublicKey, false)
+	claims, err := validator.getClaimsFromRequest(request)
 	if err != nil {
 		switch err {
-		case common.ErrMalformedAuthorization:
-		case common.ErrTokenMalformed:
+		case common.ErrMalformedAuthorization, common.ErrTokenMalformed:
 			{
 				// Write an error and stop the handler chain
 				http.Error(writer, "Bad Request", http.StatusBadRequest)
 			}
-		case common.ErrSignatureInvalid:
-		case common.ErrNoAuthorization:
+		case common.ErrSignatureInvalid, common.ErrNoAuthorization, common.ErrTokenTooOld, common.ErrUnauthorized:
 			{
 				http.Error(writer, "Unauthorized", http.StatusUnauthorized)
 			}
@@ -37,5 +46,86 @@ func (validator validatorImpl) GetUserFromHeaderOrFail(writer http.ResponseWrite
 		return "", nil, err
 	}
 
-	return authenticationInformation.User, authenticationInformation.Roles, nil
+	return claims.User, claims.Roles, nil
+}
+
+// getClaimsFromRequest locates and validates the token in the Authorization header of the request. The errors
+// returned are the same as the ones of common.GetAuthenticationFromRequest, which is limited to the RS512
+// algorithm. If an audience is expected, a token not issued for this audience returns common.ErrUnauthorized.
+func (validator *validatorImpl) getClaimsFromRequest(request *http.Request) (*protocol.TokenClaims, error) {
+
+	authorization := request.Header.Get("Authorization")
+	if len(authorization) == 0 {
+		return nil, common.ErrNoAuthorization
+	}
+
+	if !strings.HasPrefix(authorization, "Bearer ") || len(strings.Split(authorization[7:], ".")) != 3 {
+		return nil, common.ErrMalformedAuthorization
+	}
+
+	token, err := jwt.ParseWithClaims(authorization[7:], &protocol.TokenClaims{}, validator.getPublicKey)
+	if err != nil {
+		validationError, ok := err.(*jwt.ValidationError)
+		switch {
+		case !ok:
+			return nil, common.ErrTokenMalformed
+		case validationError.Errors&(jwt.ValidationErrorUnverifiable|jwt.ValidationErrorSignatureInvalid) != 0:
+			return nil, common.ErrSignatureInvalid
+		case validationError.Errors&jwt.ValidationErrorExpired != 0:
+			return nil, common.ErrTokenTooOld
+		default:
+			return nil, common.ErrTokenMalformed
+		}
+	}
+
+	claims, ok := token.Claims.(*protocol.TokenClaims)
+	if !ok {
+		return nil, common.ErrTokenMalformed
+	}
+
+	if (len(validator.audience) > 0) && !claims.Audience.Contains(validator.audience) {
+		return nil, common.ErrUnauthorized
+	}
+
+	return claims, nil
+}
+
+// getPublicKey returns the key to use for validating the token. If the keys are published by the server, the
+// key is selected with the id (kid) given in the header of the token. The algorithm given in the header of the
+// token must match the type of the key.
+func (validator *validatorImpl) getPublicKey(token *jwt.Token) (interface{}, error) {
+
+	publicKey := validator.serverPublicKey
+	if validator.serverKeySet != nil {
+		keyId, _ := token.Header["kid"].(string)
+
+		var err error
+		if publicKey, err = validator.serverKeySet.getKey(keyId); err != nil {
+			return nil, err
+		}
+	}
+
+	if !isAlgorithmOfKey(token.Method, publicKey) {
+		return nil, common.ErrSignatureInvalid
+	}
+
+	return publicKey, nil
+}
+
+// isAlgorithmOfKey returns true if the signatures made with the given algorithm can be verified with the key
+func isAlgorithmOfKey(signingMethod jwt.SigningMethod, publicKey crypto.PublicKey) bool {
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		_, isRSA := signingMethod.(*jwt.SigningMethodRSA)
+		_, isRSAPSS := signingMethod.(*jwt.SigningMethodRSAPSS)
+		return isRSA || isRSAPSS
+	case *ecdsa.PublicKey:
+		method, isECDSA := signingMethod.(*jwt.SigningMethodECDSA)
+		return isECDSA && method.CurveBits == key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return signingMethod == protocol.SigningMethodEdDSA
+	}
+
+	return false
 }
@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/twuillemin/easy-sso-common/pkg/common"
+	"github.com/twuillemin/easy-sso/pkg/protocol"
+)
+
+// newTestRequest returns a request with the given token in its Authorization header
+func newTestRequest(token string) *http.Request {
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+// signTestToken returns a token of the user "user" for the given audiences, signed with the given key and algorithm
+func signTestToken(t *testing.T, signingMethod jwt.SigningMethod, keyId string, privateKey crypto.Signer, audiences ...string) string {
+
+	claims := protocol.TokenClaims{
+		CustomClaims: common.CustomClaims{
+			User:  "user",
+			Roles: []string{"user"},
+			StandardClaims: jwt.StandardClaims{
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+		},
+		Audience: audiences,
+	}
+
+	token := jwt.NewWithClaims(signingMethod, claims)
+	if len(keyId) > 0 {
+		token.Header["kid"] = keyId
+	}
+
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal("Unable to sign the token: ", err)
+	}
+
+	return signedToken
+}
+
+func TestAudienceOfTheTokens(t *testing.T) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate the key: ", err)
+	}
+
+	tests := []struct {
+		name          string
+		expected      string
+		audiences     []string
+		expectedError error
+	}{
+		{"no audience expected, token without audience", "", nil, nil},
+		{"no audience expected, token with an audience", "", []string{"other-service"}, nil},
+		{"token without audience", "my-service", nil, common.ErrUnauthorized},
+		{"token for another audience", "my-service", []string{"other-service"}, common.ErrUnauthorized},
+		{"token for the audience", "my-service", []string{"my-service"}, nil},
+		{"token for several audiences including the audience", "my-service", []string{"other-service", "my-service"}, nil},
+		{"token for several other audiences", "my-service", []string{"other-service", "another-service"}, common.ErrUnauthorized},
+	}
+
+	for _, test := range tests {
+		validator := &validatorImpl{serverPublicKey: privateKey.Public(), audience: test.expected}
+		token := signTestToken(t, jwt.SigningMethodES256, "", privateKey, test.audiences...)
+
+		claims, err := validator.getClaimsFromRequest(newTestRequest(token))
+		if err != test.expectedError {
+			t.Errorf("%s: the validation returned %v, expected %v", test.name, err, test.expectedError)
+			continue
+		}
+		if (err == nil) && (claims.User != "user") {
+			t.Errorf("%s: the validation returned the user %s", test.name, claims.User)
+		}
+	}
+}
+
+func TestRefusedAudienceIsUnauthorized(t *testing.T) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate the key: ", err)
+	}
+	validator := &validatorImpl{serverPublicKey: privateKey.Public(), audience: "my-service"}
+
+	recorder := httptest.NewRecorder()
+	token := signTestToken(t, jwt.SigningMethodES256, "", privateKey, "other-service")
+	if _, _, err := validator.GetUserFromHeaderOrFail(recorder, newTestRequest(token)); err != common.ErrUnauthorized {
+		t.Fatal("The token for another audience was not refused: ", err)
+	}
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatal("The token for another audience was answered with the status ", recorder.Code)
+	}
+}